@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var acmeDeployed = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "acme_certificate_deployed",
+		Help:      "Whether the server presents the newest certificate that the local ACME client has obtained (1) or an older one (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var acmeDeploymentLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "acme_deployment_lag_seconds",
+		Help:      "Time since the local ACME client obtained a certificate that the server does not present yet, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Reads the certificates that ACME clients such as certbot, lego or
+// acme.sh have stored on the local host, so they can be compared with
+// what the servers actually present.
+type ACMEState struct {
+	dirs []string
+
+	mutex    sync.Mutex
+	scanned  time.Time
+	certs    []*x509.Certificate
+	rescanIn time.Duration
+}
+
+func NewACMEState(dirs []string) *ACMEState {
+	return &ACMEState{dirs: dirs, rescanIn: time.Minute}
+}
+
+// Returns the newest certificate for domain known to the ACME clients,
+// or nil if there is none.
+func (a *ACMEState) Newest(domain string) *x509.Certificate {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if time.Since(a.scanned) > a.rescanIn {
+		a.certs = scanACMEDirs(a.dirs)
+		a.scanned = time.Now()
+	}
+
+	var newest *x509.Certificate
+	for _, cert := range a.certs {
+		if cert.VerifyHostname(domain) != nil {
+			continue
+		}
+		if newest == nil || cert.NotBefore.After(newest.NotBefore) {
+			newest = cert
+		}
+	}
+	return newest
+}
+
+// Compares the leaf certificate served for domain with the newest one
+// obtained by the local ACME clients, and exports the result as metrics.
+func (a *ACMEState) Correlate(domain string, served *x509.Certificate) {
+	newest := a.Newest(domain)
+	if newest == nil {
+		acmeDeployed.DeleteLabelValues(domain)
+		acmeDeploymentLag.DeleteLabelValues(domain)
+		return
+	}
+
+	if bytes.Equal(newest.Raw, served.Raw) || !newest.NotBefore.After(served.NotBefore) {
+		acmeDeployed.WithLabelValues(domain).Set(1)
+		acmeDeploymentLag.WithLabelValues(domain).Set(0)
+		return
+	}
+
+	acmeDeployed.WithLabelValues(domain).Set(0)
+	acmeDeploymentLag.WithLabelValues(domain).Set(time.Since(newest.NotBefore).Seconds())
+}
+
+// Finds the leaf certificates in the directories of ACME clients.
+// Certbot keeps them in live/<name>/cert.pem, lego in
+// certificates/<domain>.crt and acme.sh in <domain>/<domain>.cer;
+// CA certificates stored alongside get skipped.
+func scanACMEDirs(dirs []string) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".pem", ".crt", ".cer":
+			default:
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			if cert := firstLeafCertificate(data); cert != nil {
+				certs = append(certs, cert)
+			}
+			return nil
+		})
+	}
+	return certs
+}
+
+// Returns the first non-CA certificate in PEM-encoded data, or nil.
+func firstLeafCertificate(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil && !cert.IsCA {
+			return cert
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var addressCheckSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "address_check_success",
+		Help:      "Whether the most recent check at one of the addresses of a domain succeeded (1) or failed (0), by domain name, port and IP address.",
+	},
+	[]string{
+		"domain",
+		"port",
+		"ip",
+	},
+)
+
+var addressCertExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "address_tls_certificate_expiration_timestamp",
+		Help:      "TLS certificate expiration dates served at one of the addresses of a domain, in seconds since 1970-01-01 midnight UTC, by domain name, port and IP address.",
+	},
+	[]string{
+		"domain",
+		"port",
+		"ip",
+	},
+)
+
+// A port and IP address of a target.
+type portAddress struct {
+	port int
+	ip   string
+}
+
+// Checks the certificate at every address that the name of a target
+// resolves to, on all its ports, so that a single backend behind a
+// load balancer cannot hide a stale certificate. Series for addresses
+// that the name no longer resolves to get removed.
+func (cm *CertMon) checkAllAddresses(domain string, target Target) {
+	addrs := []string{target.Host}
+	if net.ParseIP(target.Host) == nil {
+		countLookup()
+		ctx, cancel := context.WithTimeout(context.Background(), target.CheckTimeout())
+		resolved, err := target.DNSResolver().LookupHost(ctx, target.Host)
+		cancel()
+		if err != nil {
+			// The main check reports the failure.
+			return
+		}
+		addrs = resolved
+	}
+
+	checked := make(map[portAddress]bool, len(addrs)*len(target.Ports))
+	for _, port := range target.Ports {
+		portLabel := strconv.Itoa(port)
+		for _, ip := range addrs {
+			checked[portAddress{port, ip}] = true
+			result, err := checkCertificateAt(net.DefaultResolver, target.ProxyURL(port), target.Host, ip, port, target.Protocol, target.TLSConfig(), target.CheckConnectTimeout(), target.CheckTimeout())
+			addressCheckSuccess.WithLabelValues(domain, portLabel, ip).Set(boolToFloat(err == nil))
+			if err != nil {
+				log.Printf("%s: %s port %d: %v", domain, ip, port, err)
+				addressCertExpiration.DeleteLabelValues(domain, portLabel, ip)
+				continue
+			}
+			addressCertExpiration.WithLabelValues(domain, portLabel, ip).Set(float64(result.Expiration.Unix()))
+		}
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	status, ok := cm.domains[domain]
+	if !ok {
+		deleteAddressMetrics(domain, checked)
+		return
+	}
+	for pa := range status.allAddresses {
+		if !checked[pa] {
+			deleteAddressMetrics(domain, map[portAddress]bool{pa: true})
+		}
+	}
+	status.allAddresses = checked
+}
+
+func deleteAddressMetrics(domain string, addrs map[portAddress]bool) {
+	for pa := range addrs {
+		portLabel := strconv.Itoa(pa.port)
+		addressCheckSuccess.DeleteLabelValues(domain, portLabel, pa.ip)
+		addressCertExpiration.DeleteLabelValues(domain, portLabel, pa.ip)
+	}
+}
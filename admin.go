@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Lets other automation, such as deploy pipelines or inventory sync
+// scripts, manage the monitored targets at runtime:
+//
+//	GET    /api/domains            lists the monitored hosts
+//	POST   /api/domains            adds {"target": "example.org:443?min_tls=1.2"}
+//	DELETE /api/domains/<host>     stops monitoring a host
+//
+// Requests must carry "Authorization: Bearer <token>". Like targets
+// added in a batch, changes last until certmon restarts or reloads its
+// configuration.
+type AdminAPI struct {
+	cm    *CertMon
+	token []byte
+}
+
+// Reads the bearer token from a file, ignoring surrounding whitespace.
+func ReadAdminToken(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return []byte(token), nil
+}
+
+func NewAdminAPI(cm *CertMon, token []byte) *AdminAPI {
+	return &AdminAPI{cm: cm, token: token}
+}
+
+// Wraps a handler so that it only serves requests with the bearer token.
+func (a *AdminAPI) Authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+type adminAddRequest struct {
+	// Target specification, in the same syntax as the -hosts flag.
+	Target string `json:"target"`
+}
+
+func (a *AdminAPI) HandleDomains(w http.ResponseWriter, r *http.Request) {
+	domain := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/domains"), "/")
+	switch {
+	case domain == "" && r.Method == http.MethodGet:
+		a.list(w)
+	case domain == "" && r.Method == http.MethodPost:
+		a.add(w, r)
+	case domain != "" && r.Method == http.MethodDelete:
+		if !a.cm.RemoveTargets([]string{domain})[0] {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *AdminAPI) list(w http.ResponseWriter) {
+	a.cm.mutex.Lock()
+	domains := make([]string, 0, len(a.cm.domains))
+	for domain := range a.cm.domains {
+		domains = append(domains, domain)
+	}
+	a.cm.mutex.Unlock()
+	sort.Strings(domains)
+	writeJSON(w, http.StatusOK, struct {
+		Domains []string `json:"domains"`
+	}{domains})
+}
+
+func (a *AdminAPI) add(w http.ResponseWriter, r *http.Request) {
+	var req adminAddRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := ParseTarget(req.Target)
+	if err == nil {
+		err = checkViews([]Target{t}, a.cm.opts.Views)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !a.cm.AddTargets([]Target{t})[0] {
+		http.Error(w, t.Host+" is monitored already", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Location", "/api/domains/"+t.Host)
+	writeJSON(w, http.StatusCreated, struct {
+		Host string `json:"host"`
+	}{t.Host})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,394 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// Results that an edge certmon pushes to a central one, for
+// deployments across several data centers.
+type AgentReport struct {
+	Results []AgentResult `json:"results"`
+}
+
+type AgentResult struct {
+	Domain     string     `json:"domain"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	Success    bool       `json:"success"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Returns the current state of all targets, for pushing to a central
+// certmon. Targets that have not been checked yet are left out.
+func (cm *CertMon) AgentReport() *AgentReport {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	report := &AgentReport{Results: make([]AgentResult, 0, len(cm.domains))}
+	for domain, status := range cm.domains {
+		if status.leaf == nil && !status.failing {
+			continue
+		}
+		r := AgentResult{Domain: domain, Success: !status.failing}
+		if !status.expiration.IsZero() {
+			exp := status.expiration.UTC()
+			r.Expiration = &exp
+		}
+		switch {
+		case status.unresolvable:
+			r.Error = "domain name does not resolve"
+		case status.failing && len(status.errors) > 0:
+			r.Error = status.errors[len(status.errors)-1].Error
+		}
+		report.Results = append(report.Results, r)
+	}
+	sort.Slice(report.Results, func(i, j int) bool {
+		return report.Results[i].Domain < report.Results[j].Domain
+	})
+	return report
+}
+
+// Pushes the results of this certmon to a central one.
+type Pusher struct {
+	url    string
+	token  []byte
+	client *http.Client
+}
+
+// Creates a pusher to the central certmon at baseURL, such as
+// "https://certmon.example.org", under the given agent name. If cert
+// is not nil, the pusher presents it as TLS client certificate.
+func NewPusher(baseURL, agent string, token []byte, cert *tls.Certificate) *Pusher {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if cert != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{*cert}}
+		client.Transport = transport
+	}
+	return &Pusher{
+		url:    strings.TrimSuffix(baseURL, "/") + "/api/v1/agents/" + url.PathEscape(agent),
+		token:  token,
+		client: client,
+	}
+}
+
+func (p *Pusher) Push(ctx context.Context, report *AgentReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != nil {
+		req.Header.Set("Authorization", "Bearer "+string(p.token))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Pushes the results of cm once per interval, until ctx is done.
+func (p *Pusher) Run(ctx context.Context, cm *CertMon, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.Push(ctx, cm.AgentReport()); err != nil {
+			log.Printf("pushing results to %s: %v", p.url, err)
+		}
+	}
+}
+
+// Collects the results that edge certmons push, and serves them as
+// metrics labeled by agent, and on the status page.
+type Aggregator struct {
+	// If not nil, only the agents listed here may push, each for its
+	// own domains.
+	policies map[string]*AgentPolicy
+
+	mutex  sync.Mutex
+	agents map[string]*agentState
+}
+
+// Agents file given with -agents-file, which tells the aggregator how
+// each agent authenticates, and which domains it may report on. Example:
+//
+//	agents:
+//	  - name: edge-zrh
+//	    token_file: /run/secrets/edge-zrh
+//	    domains: ["*.zrh.example.org"]
+//	  - name: edge-sfo
+//	    client_certificate: edge-sfo.certmon.example.org
+//	    domains: ["*.sfo.example.org", "example.org"]
+//
+// An agent authenticates with a bearer token, a TLS client certificate
+// for the given name (which needs -tls-client-ca-file), or both. Domain
+// patterns use the syntax of path.Match, so "*.example.org" matches all
+// subdomains of example.org, and "*" matches any domain.
+type AgentsFile struct {
+	Agents []AgentPolicy `yaml:"agents"`
+}
+
+type AgentPolicy struct {
+	Name              string   `yaml:"name"`
+	TokenFile         string   `yaml:"token_file"`
+	ClientCertificate string   `yaml:"client_certificate"`
+	Domains           []string `yaml:"domains"`
+	token             []byte
+}
+
+// Reads an agents file, and returns the policies by agent name.
+func ReadAgentPolicies(filename string) (map[string]*AgentPolicy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file AgentsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]*AgentPolicy, len(file.Agents))
+	for i := range file.Agents {
+		p := &file.Agents[i]
+		if p.Name == "" || strings.Contains(p.Name, "/") {
+			return nil, fmt.Errorf("bad agent name %q", p.Name)
+		}
+		if policies[p.Name] != nil {
+			return nil, fmt.Errorf("agent %s is listed twice", p.Name)
+		}
+		if p.TokenFile == "" && p.ClientCertificate == "" {
+			return nil, fmt.Errorf("agent %s needs token_file or client_certificate", p.Name)
+		}
+		if p.TokenFile != "" {
+			if p.token, err = ReadAdminToken(p.TokenFile); err != nil {
+				return nil, fmt.Errorf("agent %s: %v", p.Name, err)
+			}
+		}
+		if len(p.Domains) == 0 {
+			return nil, fmt.Errorf("agent %s has no domains", p.Name)
+		}
+		for _, pattern := range p.Domains {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("agent %s: bad domain pattern %q", p.Name, pattern)
+			}
+		}
+		policies[p.Name] = p
+	}
+	return policies, nil
+}
+
+// Checks that a request comes from the agent, by its bearer token and
+// its verified TLS client certificate, whichever the policy asks for.
+func (p *AgentPolicy) authenticate(r *http.Request) bool {
+	if p.token != nil {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), p.token) != 1 {
+			return false
+		}
+	}
+	if p.ClientCertificate != "" {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return false
+		}
+		if r.TLS.VerifiedChains[0][0].VerifyHostname(p.ClientCertificate) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the agent may report on a domain.
+func (p *AgentPolicy) allows(domain string) bool {
+	for _, pattern := range p.Domains {
+		if ok, _ := path.Match(pattern, domain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type agentState struct {
+	received time.Time
+	results  []AgentResult
+}
+
+// Creates an aggregator. If policies is nil, any agent may push, so
+// the endpoint must be protected otherwise, such as by -admin-token-file.
+func NewAggregator(policies map[string]*AgentPolicy) *Aggregator {
+	return &Aggregator{policies: policies, agents: make(map[string]*agentState)}
+}
+
+// Serves POST /api/v1/agents/<name>, replacing the results of the agent.
+func (a *Aggregator) HandlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	agent := strings.TrimPrefix(r.URL.Path, "/api/v1/agents/")
+	if agent == "" || strings.Contains(agent, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !utf8.ValidString(agent) {
+		http.Error(w, "agent name is not valid UTF-8", http.StatusBadRequest)
+		return
+	}
+	var policy *AgentPolicy
+	if a.policies != nil {
+		if policy = a.policies[agent]; policy == nil || !policy.authenticate(r) {
+			log.Printf("rejected push from %s by %s", r.RemoteAddr, agent)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	var report AgentReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBatchBytes)).Decode(&report); err != nil {
+		http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Agent names and domains become label values, which must be valid
+	// UTF-8 and unique within a push.
+	seen := make(map[string]bool, len(report.Results))
+	for _, result := range report.Results {
+		if !utf8.ValidString(result.Domain) {
+			http.Error(w, fmt.Sprintf("domain %q is not valid UTF-8", result.Domain), http.StatusBadRequest)
+			return
+		}
+		if seen[result.Domain] {
+			http.Error(w, "domain "+result.Domain+" is reported twice", http.StatusBadRequest)
+			return
+		}
+		seen[result.Domain] = true
+	}
+	if policy != nil {
+		// Rejecting the entire push, rather than dropping the foreign
+		// domains, makes a misconfigured agent noticeable at its end.
+		for _, result := range report.Results {
+			if !policy.allows(result.Domain) {
+				log.Printf("rejected push by %s: not allowed to report on %s", agent, result.Domain)
+				http.Error(w, "not allowed to report on "+result.Domain, http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	a.mutex.Lock()
+	a.agents[agent] = &agentState{received: time.Now(), results: report.Results}
+	a.mutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var (
+	agentExpirationDesc = prometheus.NewDesc("certmon_agent_tls_certificate_expiration_timestamp",
+		"TLS certificate expiration dates as pushed by edge agents, in seconds since 1970-01-01 midnight UTC, by agent and domain name.",
+		[]string{"agent", "domain"}, nil)
+	agentCheckSuccessDesc = prometheus.NewDesc("certmon_agent_check_success",
+		"Whether the most recent check by an edge agent succeeded (1) or failed (0), by agent and domain name.",
+		[]string{"agent", "domain"}, nil)
+	agentLastPushDesc = prometheus.NewDesc("certmon_agent_last_push_timestamp",
+		"When an edge agent last pushed its results, in seconds since 1970-01-01 midnight UTC, by agent.",
+		[]string{"agent"}, nil)
+)
+
+func (a *Aggregator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- agentExpirationDesc
+	ch <- agentCheckSuccessDesc
+	ch <- agentLastPushDesc
+}
+
+func (a *Aggregator) Collect(ch chan<- prometheus.Metric) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	send := func(desc *prometheus.Desc, value float64, labels ...string) {
+		m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+		if err != nil {
+			log.Printf("agent metrics: %v", err)
+			return
+		}
+		ch <- m
+	}
+	for agent, state := range a.agents {
+		send(agentLastPushDesc, float64(state.received.Unix()), agent)
+		for _, r := range state.results {
+			send(agentCheckSuccessDesc, boolToFloat(r.Success), agent, r.Domain)
+			if r.Expiration != nil {
+				send(agentExpirationDesc, float64(r.Expiration.Unix()), agent, r.Domain)
+			}
+		}
+	}
+}
+
+// Writes a section for the status page, with one row per agent and domain.
+func (a *Aggregator) WriteHTML(w io.Writer, loc *time.Location) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	agents := make([]string, 0, len(a.agents))
+	for agent := range a.agents {
+		agents = append(agents, agent)
+	}
+	sort.Strings(agents)
+
+	fmt.Fprintf(w, "%s", `<h2>Agents</h2>
+<p><table>
+<tr><th>Agent</th><th>Domain</th><th>Certificate expires</th><th>Check</th></tr>
+`)
+	for _, agent := range agents {
+		state := a.agents[agent]
+		pushed := " (last push " + relativeTime(time.Until(state.received)) + ")"
+		for _, r := range state.results {
+			expires := "unknown"
+			if r.Expiration != nil {
+				expires = formatTime(*r.Expiration, loc)
+			}
+			check := "ok"
+			if !r.Success {
+				check = "failing: " + r.Error
+			}
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+				html.EscapeString(agent+pushed), html.EscapeString(r.Domain),
+				expires, html.EscapeString(check))
+		}
+	}
+	fmt.Fprintf(w, "%s", "</table></p>\n")
+}
@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var chainValidAhead = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "chain_valid_ahead",
+		Help:      "Whether the served chain still verifies at the time given by -verify-ahead (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Verifies a chain as of a future time, to detect intermediates or roots
+// that expire before the leaf. The verification time is capped to just
+// before the leaf expires, since its own expiration is tracked anyway.
+// If roots is nil, the chain gets verified against the system roots.
+func VerifyAhead(host string, chain []*x509.Certificate, roots *x509.CertPool, ahead time.Duration) error {
+	at := time.Now().Add(ahead)
+	if leafEnd := chain[0].NotAfter.Add(-time.Second); leafEnd.Before(at) {
+		at = leafEnd
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+	})
+	return err
+}
@@ -0,0 +1,225 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeps certmon snoozes and Prometheus Alertmanager silences in sync,
+// so the two systems agree about which domains are muted. Snoozing a
+// domain in certmon creates a silence matching domain="<name>"; a silence
+// with exactly that matcher, created in Alertmanager, snoozes the domain
+// in certmon until the silence ends.
+type Alertmanager struct {
+	url    string
+	client *http.Client
+
+	// ID of the silence that corresponds to the snooze of a domain.
+	mutex    sync.Mutex
+	silences map[string]string
+}
+
+// Silence as represented by the Alertmanager v2 API.
+type amSilence struct {
+	ID        string      `json:"id,omitempty"`
+	Matchers  []amMatcher `json:"matchers"`
+	StartsAt  time.Time   `json:"startsAt"`
+	EndsAt    time.Time   `json:"endsAt"`
+	CreatedBy string      `json:"createdBy"`
+	Comment   string      `json:"comment"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
+}
+
+type amMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+// Returns the domain that a silence is for, or "" if the silence
+// does not consist of a single domain="<name>" matcher.
+func (s *amSilence) domain() string {
+	if len(s.Matchers) != 1 {
+		return ""
+	}
+	m := s.Matchers[0]
+	if m.Name != "domain" || m.IsRegex || (m.IsEqual != nil && !*m.IsEqual) {
+		return ""
+	}
+	return m.Value
+}
+
+func NewAlertmanager(baseURL string) *Alertmanager {
+	return &Alertmanager{
+		url:      strings.TrimSuffix(baseURL, "/"),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		silences: make(map[string]string),
+	}
+}
+
+func (am *Alertmanager) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, am.url+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := am.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Creates or updates the silence for domain so it ends at until, or
+// expires it if until is the zero time. The source of the snooze, if
+// not empty, gets mentioned in the comment of the silence.
+func (am *Alertmanager) Silence(ctx context.Context, domain string, until time.Time, source string) error {
+	am.mutex.Lock()
+	id := am.silences[domain]
+	am.mutex.Unlock()
+
+	if until.IsZero() {
+		if id == "" {
+			return nil
+		}
+		err := am.do(ctx, http.MethodDelete, "/api/v2/silence/"+url.PathEscape(id), nil, nil)
+		if err == nil {
+			am.mutex.Lock()
+			if am.silences[domain] == id {
+				delete(am.silences, domain)
+			}
+			am.mutex.Unlock()
+		}
+		return err
+	}
+
+	isEqual := true
+	s := amSilence{
+		ID:        id,
+		Matchers:  []amMatcher{{Name: "domain", Value: domain, IsEqual: &isEqual}},
+		StartsAt:  time.Now().UTC(),
+		EndsAt:    until.UTC(),
+		CreatedBy: "certmon",
+		Comment:   "snoozed in certmon",
+	}
+	if source != "" {
+		s.Comment += " by " + source
+	}
+	var resp struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err := am.do(ctx, http.MethodPost, "/api/v2/silences", &s, &resp); err != nil {
+		return err
+	}
+	am.mutex.Lock()
+	am.silences[domain] = resp.SilenceID
+	am.mutex.Unlock()
+	return nil
+}
+
+// Fetches the silences from Alertmanager, and snoozes or unsnoozes
+// domains in cm to match.
+func (am *Alertmanager) Sync(ctx context.Context, cm *CertMon) error {
+	var silences []amSilence
+	if err := am.do(ctx, http.MethodGet, "/api/v2/silences", nil, &silences); err != nil {
+		return err
+	}
+
+	// If several silences are active for the same domain, the one
+	// that ends last wins.
+	active := make(map[string]*amSilence)
+	expired := make(map[string]bool)
+	for i := range silences {
+		s := &silences[i]
+		domain := s.domain()
+		if domain == "" || s.Status == nil {
+			continue
+		}
+		switch s.Status.State {
+		case "active":
+			if a := active[domain]; a == nil || s.EndsAt.After(a.EndsAt) {
+				active[domain] = s
+			}
+		case "expired":
+			expired[s.ID] = true
+		}
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	for domain, s := range active {
+		am.silences[domain] = s.ID
+		until := s.EndsAt.Truncate(time.Second)
+		if cm.snoozeEnd(domain).Truncate(time.Second).Equal(until) {
+			continue
+		}
+		source := "Alertmanager silence " + s.ID
+		if err := cm.snooze(domain, until, source); err != nil {
+			// Silences for domains that certmon does not monitor are none
+			// of our business.
+			delete(am.silences, domain)
+		}
+	}
+
+	// A silence that got expired in Alertmanager before its end lifts
+	// the snooze.
+	for domain, id := range am.silences {
+		if active[domain] != nil || !expired[id] {
+			continue
+		}
+		delete(am.silences, domain)
+		if !cm.snoozeEnd(domain).IsZero() {
+			cm.snooze(domain, time.Time{}, "expiry of Alertmanager silence "+id)
+		}
+	}
+	return nil
+}
+
+// Syncs with Alertmanager once per interval, until ctx is done.
+func (am *Alertmanager) Run(ctx context.Context, cm *CertMon, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := am.Sync(ctx, cm); err != nil {
+			log.Printf("alertmanager: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
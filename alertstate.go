@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Messages of threshold events, which get parsed again when restoring
+// alert states.
+const (
+	thresholdMessage       = "certificate expires in less than %d days"
+	stapleThresholdMessage = "stapled OCSP response expires in less than %s"
+	caRevokedMessage       = "issuing CA %s was revoked at %s"
+
+	registrationThresholdMessage = "registration of %s expires in less than %d days"
+)
+
+// State of the alerts for a target, as of the most recent events for
+// it. Restoring this state at startup keeps certmon from notifying
+// again about conditions it had reported before a restart, and lets it
+// notice when such a condition cleared while it was down.
+type AlertState struct {
+	Failing          bool
+	HostnameMismatch bool
+	Unresolvable     bool
+	PortMismatch     bool
+	LargeChain       bool
+	RenewalOverdue   bool
+	Revoked          bool
+
+	// Smallest threshold crossed, in days before expiration, or zero.
+	Crossed int
+
+	// Smallest threshold crossed by the stapled OCSP response, or zero.
+	StapleCrossed time.Duration
+}
+
+// Returns the alert state of each domain, replayed from the logged
+// events. Domains that were removed are left out.
+func (el *EventLog) AlertStates() map[string]*AlertState {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	states := make(map[string]*AlertState)
+	for _, e := range el.events {
+		if e.Type == EventTargetRemoved {
+			delete(states, e.Domain)
+			continue
+		}
+		s := states[e.Domain]
+		if s == nil {
+			s = &AlertState{}
+			states[e.Domain] = s
+		}
+		switch e.Type {
+		case EventCheckFailed, EventHostnameMismatch, EventUnresolvable:
+			s.Failing = true
+			s.HostnameMismatch = e.Type == EventHostnameMismatch
+			s.Unresolvable = e.Type == EventUnresolvable
+		case EventCheckRecovered:
+			s.Failing, s.HostnameMismatch, s.Unresolvable = false, false, false
+		case EventPortMismatch:
+			s.PortMismatch = true
+		case EventLargeChain:
+			s.LargeChain = true
+		case EventRevoked:
+			s.Revoked = true
+		case EventCertificateObserved:
+			s.Revoked = false
+		case EventRenewalOverdue:
+			s.RenewalOverdue = true
+		case EventRenewalDetected:
+			s.RenewalOverdue = false
+			s.Crossed = 0
+		case EventThresholdCrossed:
+			var days int
+			if _, err := fmt.Sscanf(e.Message, thresholdMessage, &days); err == nil {
+				s.Crossed = days
+			}
+		case EventStapleThresholdCrossed:
+			var str string
+			if _, err := fmt.Sscanf(e.Message, stapleThresholdMessage, &str); err == nil {
+				if d, err := time.ParseDuration(str); err == nil {
+					s.StapleCrossed = d
+				}
+			}
+		}
+	}
+	return states
+}
+
+// Restores the alert state of a target at startup. For overdue renewals,
+// the newest certificate in the inventory is taken as the one served
+// before the restart, so the renewal does not count as overdue again if
+// the certificate is still the same.
+func (cm *CertMon) restoreAlertState(status *domainStatus, state *AlertState) {
+	status.failing = state.Failing
+	status.hostnameMismatch = state.HostnameMismatch
+	status.unresolvable = state.Unresolvable
+	status.portMismatch = state.PortMismatch
+	status.largeChain = state.LargeChain
+	status.revoked = state.Revoked
+	status.crossed = state.Crossed
+	status.stapleCrossed = state.StapleCrossed
+	if state.RenewalOverdue && len(status.inventory) > 0 {
+		newest := status.inventory[len(status.inventory)-1]
+		if fp, err := hex.DecodeString(newest.Fingerprint); err == nil && len(fp) == len(status.fingerprint) {
+			copy(status.fingerprint[:], fp)
+			status.unchanged = cm.opts.RenewalStuckChecks
+			status.renewalOverdue = true
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var targetAnnotationsDesc = prometheus.NewDesc("certmon_target_annotations",
+	"Always 1, labeled with the owner, runbook URL and notes of a target, by domain name. Alerting rules can join it with group_left, so that Alertmanager templates can tell who to call and what to do.",
+	[]string{"domain", "owner", "runbook", "notes"}, nil)
+
+// Exports certmon_target_annotations for every target that has an
+// owner, a runbook or notes. Since these can change whenever targets
+// get reloaded, they are collected afresh at every scrape.
+type TargetAnnotationsCollector struct {
+	cm *CertMon
+}
+
+func NewTargetAnnotationsCollector(cm *CertMon) *TargetAnnotationsCollector {
+	return &TargetAnnotationsCollector{cm: cm}
+}
+
+func (c *TargetAnnotationsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- targetAnnotationsDesc
+}
+
+func (c *TargetAnnotationsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cm.mutex.Lock()
+	defer c.cm.mutex.Unlock()
+
+	for domain, status := range c.cm.domains {
+		t := status.target
+		if t.Owner == "" && t.Runbook == "" && t.Notes == "" {
+			continue
+		}
+		m, err := prometheus.NewConstMetric(targetAnnotationsDesc, prometheus.GaugeValue, 1,
+			domain, t.Owner, t.Runbook, t.Notes)
+		if err != nil {
+			log.Printf("%s: annotations: %v", domain, err)
+			continue
+		}
+		ch <- m
+	}
+}
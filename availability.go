@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var availabilityRatio = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "availability_ratio",
+		Help:      "Fraction of successful checks over a rolling window, by domain name and window.",
+	},
+	[]string{
+		"domain",
+		"window",
+	},
+)
+
+// Rolling windows over which availability gets computed.
+var availabilityWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// Outcomes of the checks of a target, counted per hour, for the longest
+// availability window. Counting per hour keeps memory bounded no matter
+// how often a target gets checked, at the price of windows that start
+// at a full hour.
+type availability struct {
+	buckets []availabilityBucket
+}
+
+type availabilityBucket struct {
+	hour              int64
+	checks, successes int
+}
+
+// Counts the outcome of a check, and drops buckets that have fallen out
+// of the longest window.
+func (a *availability) record(now time.Time, success bool) {
+	hour := now.Unix() / 3600
+	if n := len(a.buckets); n == 0 || a.buckets[n-1].hour != hour {
+		a.buckets = append(a.buckets, availabilityBucket{hour: hour})
+	}
+	b := &a.buckets[len(a.buckets)-1]
+	b.checks += 1
+	if success {
+		b.successes += 1
+	}
+
+	longest := availabilityWindows[len(availabilityWindows)-1].duration
+	oldest := hour - int64(longest/time.Hour)
+	i := 0
+	for i < len(a.buckets) && a.buckets[i].hour <= oldest {
+		i++
+	}
+	if i > 0 {
+		a.buckets = append([]availabilityBucket(nil), a.buckets[i:]...)
+	}
+}
+
+// Returns the fraction of successful checks within window before now,
+// and false if there were no checks.
+func (a *availability) ratio(now time.Time, window time.Duration) (float64, bool) {
+	oldest := now.Unix()/3600 - int64(window/time.Hour)
+	checks, successes := 0, 0
+	for _, b := range a.buckets {
+		if b.hour > oldest {
+			checks += b.checks
+			successes += b.successes
+		}
+	}
+	if checks == 0 {
+		return 0, false
+	}
+	return float64(successes) / float64(checks), true
+}
+
+// Counts the outcome of a check of a domain, and exports its availability.
+// The caller must hold cm.mutex.
+func observeAvailability(domain string, status *domainStatus, success bool) {
+	now := time.Now()
+	status.availability.record(now, success)
+	for _, w := range availabilityWindows {
+		if r, ok := status.availability.ratio(now, w.duration); ok {
+			availabilityRatio.WithLabelValues(domain, w.name).Set(r)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of the bulk import endpoint.
+const (
+	maxBatchTargets  = 10000
+	maxBatchBytes    = 4 << 20
+	minBatchInterval = 10 * time.Second
+)
+
+type BatchRequest struct {
+	// Target specifications, in the same syntax as the -hosts flag,
+	// such as "example.org:443/8443?min_tls=1.2".
+	Targets []string `json:"targets"`
+}
+
+type BatchResult struct {
+	Target string `json:"target"`
+	Host   string `json:"host,omitempty"`
+
+	// "added", "exists" or "invalid".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Accepts many targets in one request, so that inventory sync jobs
+// need not make one request per host. To protect the checked servers
+// from a sudden flood of new targets, a batch is accepted at most
+// once per minBatchInterval.
+type BatchImporter struct {
+	cm *CertMon
+
+	mutex sync.Mutex
+	last  time.Time
+}
+
+func NewBatchImporter(cm *CertMon) *BatchImporter {
+	return &BatchImporter{cm: cm}
+}
+
+// Returns how long to wait before the next batch gets accepted.
+func (b *BatchImporter) wait() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return minBatchInterval - time.Since(b.last)
+}
+
+func tooManyBatches(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "too many batch requests", http.StatusTooManyRequests)
+}
+
+// Serves POST /api/v1/targets:batch, which is only registered behind
+// the admin token. The response lists the validation result of each
+// entry, in the order of the request. Entries for the same host get
+// merged into one target with the ports of all of them, as long as
+// their options are the same. Added targets are checked until certmon
+// restarts; to keep them, they also need to go into the configuration.
+func (b *BatchImporter) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if wait := b.wait(); wait > 0 {
+		tooManyBatches(w, wait)
+		return
+	}
+
+	var req BatchRequest
+	body := io.LimitReader(r.Body, maxBatchBytes)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Targets) > maxBatchTargets {
+		http.Error(w, "too many targets, at most "+strconv.Itoa(maxBatchTargets)+" per batch",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Only accepted batches count against the rate limit.
+	b.mutex.Lock()
+	if wait := minBatchInterval - time.Since(b.last); wait > 0 {
+		b.mutex.Unlock()
+		tooManyBatches(w, wait)
+		return
+	}
+	b.last = time.Now()
+	b.mutex.Unlock()
+
+	// Entries for the same host get merged like in ParseTargets, so
+	// entries[j] lists the entries that make up targets[j].
+	results := make([]BatchResult, len(req.Targets))
+	var targets []Target
+	var entries [][]int
+	index := make(map[string]int)
+	for i, spec := range req.Targets {
+		results[i].Target = spec
+		t, err := ParseTarget(spec)
+		if err == nil {
+			err = checkViews([]Target{t}, b.cm.opts.Views)
+		}
+		j, seen := index[t.Host]
+		if err == nil && seen && !sameOptions(targets[j], t) {
+			err = fmt.Errorf("options differ from an earlier entry for %s", t.Host)
+		}
+		if err != nil {
+			results[i].Status, results[i].Error = "invalid", err.Error()
+			continue
+		}
+		results[i].Host = t.Host
+		if !seen {
+			index[t.Host] = len(targets)
+			targets = append(targets, t)
+			entries = append(entries, []int{i})
+			continue
+		}
+		for _, port := range t.Ports {
+			if !containsPort(targets[j].Ports, port) {
+				targets[j].Ports = append(targets[j].Ports, port)
+			}
+		}
+		entries[j] = append(entries[j], i)
+	}
+	for j, added := range b.cm.AddTargets(targets) {
+		status := "exists"
+		if added {
+			status = "added"
+		}
+		for _, i := range entries[j] {
+			results[i].Status = status
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Results []BatchResult `json:"results"`
+	}{results})
+}
@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ocsp"
+)
+
+var caRevoked = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ca_revoked",
+		Help:      "Whether a registered issuing CA certificate has been revoked by its parent CA (1) or not (0), according to OCSP or the CRL of the parent.",
+	},
+	[]string{
+		"ca",
+	},
+)
+
+var caRevocationCheckSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ca_revocation_check_success",
+		Help:      "Whether the most recent check of the revocation status of a registered issuing CA succeeded (1) or failed (0).",
+	},
+	[]string{
+		"ca",
+	},
+)
+
+// Checks the revocation status of the registered CAs once per interval,
+// until ctx is done. Since a revoked intermediate invalidates all the
+// certificates it issued at once, revocations get logged to events.
+func (t *CATracker) Run(ctx context.Context, events *EventLog, interval time.Duration) {
+	// Do not log revocations again that were logged before a restart.
+	t.mutex.Lock()
+	for _, e := range events.Query("", EventCARevoked, time.Time{}) {
+		var name, at string
+		if _, err := fmt.Sscanf(e.Message, caRevokedMessage, &name, &at); err == nil {
+			for _, ca := range t.cas {
+				if ca.Name == name {
+					ca.Revoked = true
+				}
+			}
+		}
+	}
+	t.mutex.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		t.checkRevocations(ctx, events)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *CATracker) checkRevocations(ctx context.Context, events *EventLog) {
+	t.mutex.Lock()
+	cas := append([]*IssuingCA(nil), t.cas...)
+	t.mutex.Unlock()
+
+	for _, ca := range cas {
+		t.mutex.Lock()
+		cert, parent := ca.Cert, ca.Parent
+		t.mutex.Unlock()
+
+		// CAs registered by fingerprint are unknown until they
+		// show up in a monitored chain.
+		if cert == nil {
+			continue
+		}
+		if parent == nil {
+			if issuer, err := fetchIssuer(ctx, cert); err == nil {
+				parent = issuer
+				t.mutex.Lock()
+				ca.Parent = issuer
+				t.mutex.Unlock()
+			}
+		}
+
+		revokedAt, err := revocationStatus(ctx, cert, parent)
+		caRevocationCheckSuccess.WithLabelValues(ca.Name).Set(boolToFloat(err == nil))
+		if err != nil {
+			log.Printf("checking revocation of CA %s: %v", ca.Name, err)
+			continue
+		}
+		revoked := !revokedAt.IsZero()
+		caRevoked.WithLabelValues(ca.Name).Set(boolToFloat(revoked))
+
+		t.mutex.Lock()
+		if revoked && !ca.Revoked {
+			events.Record(Event{
+				Type:    EventCARevoked,
+				Message: fmt.Sprintf(caRevokedMessage, ca.Name, revokedAt.UTC().Format(time.RFC3339)),
+			})
+		}
+		ca.Revoked = revoked
+		t.mutex.Unlock()
+	}
+}
+
+// Returns when cert was revoked by its issuer parent, or the zero time
+// if it was not. The OCSP responders of the issuer get asked first, and
+// its CRLs are the fallback. Without parent, only unsigned answers are
+// available, so only the CRLs get consulted, without verifying them.
+func revocationStatus(ctx context.Context, cert, parent *x509.Certificate) (time.Time, error) {
+	err := errors.New("neither OCSP responder nor CRL distribution point known")
+	if parent != nil {
+		for _, server := range cert.OCSPServer {
+			var resp *ocsp.Response
+			if resp, err = queryOCSP(ctx, server, cert, parent); err != nil {
+				continue
+			}
+			switch resp.Status {
+			case ocsp.Good:
+				return time.Time{}, nil
+			case ocsp.Revoked:
+				return resp.RevokedAt, nil
+			}
+			err = fmt.Errorf("%s: status unknown", server)
+		}
+	}
+	for _, url := range cert.CRLDistributionPoints {
+		var crl *x509.RevocationList
+		if crl, _, err = FetchCRL(url); err != nil {
+			continue
+		}
+		if parent != nil {
+			if err = crl.CheckSignatureFrom(parent); err != nil {
+				err = fmt.Errorf("%s: %v", url, err)
+				continue
+			}
+		}
+		for _, revoked := range crl.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return revoked.RevocationTime, nil
+			}
+		}
+		return time.Time{}, nil
+	}
+	return time.Time{}, err
+}
+
+// Asks an OCSP responder about the status of cert, issued by issuer.
+func queryOCSP(ctx context.Context, server string, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	body, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	data, err := fetchPKIData(req)
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(data, cert, issuer)
+}
+
+// Downloads the certificate of the issuer of cert from the URLs in its
+// Authority Information Access extension.
+func fetchIssuer(ctx context.Context, cert *x509.Certificate) (*x509.Certificate, error) {
+	err := errors.New("no issuer URL")
+	for _, url := range cert.IssuingCertificateURL {
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil); err != nil {
+			continue
+		}
+		var data []byte
+		if data, err = fetchPKIData(req); err != nil {
+			continue
+		}
+		issuer := firstCertificate(data)
+		if issuer == nil {
+			if issuer, err = x509.ParseCertificate(data); err != nil {
+				continue
+			}
+		}
+		if err = cert.CheckSignatureFrom(issuer); err == nil {
+			return issuer, nil
+		}
+	}
+	return nil, err
+}
+
+// Downloads a certificate, CRL or OCSP response.
+func fetchPKIData(req *http.Request) ([]byte, error) {
+	resp, err := crlClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %d", req.URL, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+}
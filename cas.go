@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var caExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ca_certificate_expiration_timestamp",
+		Help:      "Expiration dates of registered issuing CA certificates, in seconds since 1970-01-01 midnight UTC.",
+	},
+	[]string{
+		"ca",
+	},
+)
+
+var caLeafRatio = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ca_leaf_ratio",
+		Help:      "Fraction of monitored leaf certificates that chain to a registered issuing CA.",
+	},
+	[]string{
+		"ca",
+	},
+)
+
+// An issuing or intermediate certificate authority of our own PKI.
+// If it was registered by fingerprint, the certificate becomes known
+// once it shows up in a monitored chain.
+type IssuingCA struct {
+	Name        string
+	Fingerprint [32]byte
+	Cert        *x509.Certificate
+
+	// Certificate of the CA that issued Cert, once it is known from a
+	// monitored chain or from the issuer URL in Cert.
+	Parent *x509.Certificate
+
+	// Whether Cert has been revoked, as of the most recent check.
+	Revoked bool
+}
+
+// Parses a comma-separated list of issuing CAs. Each entry is a path to
+// a PEM file or a SHA-256 fingerprint written as "sha256:<hex>", either
+// of which may be prefixed by a name and "=", as in "internal=ca.pem".
+func ParseIssuingCAs(spec string) ([]*IssuingCA, error) {
+	var cas []*IssuingCA
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, value := "", entry
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			name, value = entry[:i], entry[i+1:]
+		}
+
+		ca := &IssuingCA{Name: name}
+		if strings.HasPrefix(value, "sha256:") {
+			fp, err := hex.DecodeString(strings.ReplaceAll(value[7:], ":", ""))
+			if err != nil || len(fp) != 32 {
+				return nil, fmt.Errorf("bad fingerprint %q", value)
+			}
+			copy(ca.Fingerprint[:], fp)
+			if ca.Name == "" {
+				ca.Name = hex.EncodeToString(fp)
+			}
+		} else {
+			data, err := os.ReadFile(value)
+			if err != nil {
+				return nil, err
+			}
+			ca.Cert = firstCertificate(data)
+			if ca.Cert == nil {
+				return nil, fmt.Errorf("%s: no certificate found", value)
+			}
+			ca.Fingerprint = sha256.Sum256(ca.Cert.Raw)
+			if ca.Name == "" {
+				ca.Name = strings.TrimSuffix(filepath.Base(value), filepath.Ext(value))
+			}
+		}
+		cas = append(cas, ca)
+	}
+	return cas, nil
+}
+
+// Returns the first certificate in PEM-encoded data, or nil.
+func firstCertificate(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			return cert
+		}
+	}
+}
+
+// Keeps track of which monitored chains lead to the registered
+// issuing CAs.
+type CATracker struct {
+	mutex sync.Mutex
+	cas   []*IssuingCA
+
+	// For each domain, the names of the CAs its chain leads to.
+	chained map[string]map[string]bool
+}
+
+func NewCATracker(cas []*IssuingCA) *CATracker {
+	t := &CATracker{cas: cas, chained: make(map[string]map[string]bool)}
+	t.export()
+	return t
+}
+
+// Records which registered CAs the chain of a domain leads to.
+func (t *CATracker) Observe(domain string, result *CheckResult) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	certs := append([]*x509.Certificate(nil), result.Chain...)
+	for _, chain := range result.Verified {
+		certs = append(certs, chain...)
+	}
+	last := result.Chain[len(result.Chain)-1]
+
+	chained := make(map[string]bool)
+	for _, ca := range t.cas {
+		if ca.Parent == nil {
+			ca.Parent = findParent(ca.Fingerprint, append([][]*x509.Certificate{result.Chain}, result.Verified...))
+		}
+		for _, cert := range certs {
+			if sha256.Sum256(cert.Raw) == ca.Fingerprint {
+				if ca.Cert == nil {
+					ca.Cert = cert
+				}
+				chained[ca.Name] = true
+			}
+		}
+		// Servers usually do not send the root, so we also
+		// check whether the CA has signed the last certificate.
+		if ca.Cert != nil && last.CheckSignatureFrom(ca.Cert) == nil {
+			chained[ca.Name] = true
+		}
+	}
+	t.chained[domain] = chained
+	t.export()
+}
+
+// Returns the certificate that follows the one with fingerprint in
+// one of chains and has signed it, or nil.
+func findParent(fingerprint [32]byte, chains [][]*x509.Certificate) *x509.Certificate {
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			if sha256.Sum256(chain[i].Raw) == fingerprint && chain[i].CheckSignatureFrom(chain[i+1]) == nil {
+				return chain[i+1]
+			}
+		}
+	}
+	return nil
+}
+
+// Forgets a domain that is not monitored anymore, so it does not count
+// towards the share of chains leading to each CA.
+func (t *CATracker) Forget(domain string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.chained, domain)
+	t.export()
+}
+
+// Exports the metrics about the registered CAs. Must be called
+// with the mutex held, or before the tracker is shared.
+func (t *CATracker) export() {
+	for _, ca := range t.cas {
+		if ca.Cert != nil {
+			caExpiration.WithLabelValues(ca.Name).Set(float64(ca.Cert.NotAfter.Unix()))
+		}
+		if len(t.chained) == 0 {
+			continue
+		}
+		n := 0
+		for _, chained := range t.chained {
+			if chained[ca.Name] {
+				n += 1
+			}
+		}
+		caLeafRatio.WithLabelValues(ca.Name).Set(float64(n) / float64(len(t.chained)))
+	}
+}
+
+// Serves a web page listing the registered CAs, so their rotation can
+// be planned.
+func (t *CATracker) HandleCAs(w http.ResponseWriter, r *http.Request) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	fmt.Fprintf(w, "%s", htmlHead+`<body><h1>CertMon: Issuing CAs</h1>
+<p><table>
+<tr><th>CA</th><th>Subject</th><th>Expires</th><th>Revoked</th><th>Leaves</th></tr>
+`)
+	for _, ca := range t.cas {
+		subject, expires := "unknown", "unknown"
+		if ca.Cert != nil {
+			subject = ca.Cert.Subject.String()
+			expires = ca.Cert.NotAfter.Format(time.RFC3339)
+		}
+		n := 0
+		for _, chained := range t.chained {
+			if chained[ca.Name] {
+				n += 1
+			}
+		}
+		revoked := "no"
+		if ca.Revoked {
+			revoked = "<b>yes</b>"
+		}
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d of %d</td></tr>\n",
+			html.EscapeString(ca.Name), html.EscapeString(subject), expires, revoked, n, len(t.chained))
+	}
+	fmt.Fprintf(w, "%s", "</table></p></body></html>\n")
+}
@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var certificateInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "certificate_info",
+		Help:      "Always 1, labeled with the common name of the issuer and the hexadecimal serial number of the leaf certificate, by domain name.",
+	},
+	[]string{
+		"domain",
+		"issuer_cn",
+		"serial",
+	},
+)
+
+var certificateSANs = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "certificate_san_count",
+		Help:      "Number of subject alternative names, DNS names and IP addresses, in the leaf certificate, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var certificateKeyBits = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "certificate_key_bits",
+		Help:      "Size of the public key in the leaf certificate, in bits, by domain name and key algorithm (RSA, ECDSA, Ed25519, DSA). For ECDSA, the size is that of the curve.",
+	},
+	[]string{
+		"domain",
+		"algorithm",
+	},
+)
+
+var certificateWeakKey = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "certificate_weak_key",
+		Help:      "Whether the public key in the leaf certificate is below the minimum size given by -min-rsa-bits or -min-ec-bits, or uses DSA (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Returns the algorithm and size in bits of the public key in a
+// certificate, as in "RSA" and 2048.
+func keyAlgorithm(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	case *dsa.PublicKey:
+		return "DSA", key.P.BitLen()
+	}
+	return cert.PublicKeyAlgorithm.String(), 0
+}
+
+// Returns the serial number of a certificate in hexadecimal, the way
+// CAs and certificate search engines usually show it.
+func serialNumber(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// Exports the identity of the leaf certificate.
+func exportCertificateInfo(domain string, leaf *x509.Certificate) {
+	certificateInfo.WithLabelValues(domain, leaf.Issuer.CommonName, serialNumber(leaf)).Set(1)
+	certificateSANs.WithLabelValues(domain).Set(float64(len(subjectAltNames(leaf))))
+	algorithm, bits := keyAlgorithm(leaf)
+	certificateKeyBits.WithLabelValues(domain, algorithm).Set(float64(bits))
+	certificateWeakKey.WithLabelValues(domain).Set(boolToFloat(weakKey(leaf) != ""))
+}
+
+func deleteCertificateInfo(domain string, leaf *x509.Certificate) {
+	certificateInfo.DeleteLabelValues(domain, leaf.Issuer.CommonName, serialNumber(leaf))
+	certificateSANs.DeleteLabelValues(domain)
+	algorithm, _ := keyAlgorithm(leaf)
+	certificateKeyBits.DeleteLabelValues(domain, algorithm)
+	certificateWeakKey.DeleteLabelValues(domain)
+}
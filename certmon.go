@@ -4,22 +4,219 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"log"
 	"math/rand"
-	"net/http"
+	"net"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ocsp"
 )
 
 type CertMon struct {
-	mutex       sync.Mutex
-	expirations map[string]time.Time
-	ctx         context.Context
+	mutex   sync.Mutex
+	domains map[string]*domainStatus
+	ctx     context.Context
+	opts    Options
+
+	// When the current sweep over all targets started, and which
+	// targets it has not checked yet.
+	sweepStart   time.Time
+	sweepPending map[string]bool
+}
+
+type Options struct {
+	Events *EventLog
+
+	// Thresholds in days before expiration at which to log an event.
+	Thresholds []int
+
+	// Certificates are expected to get renewed once their remaining
+	// validity falls below RenewalLeadTime. If a domain keeps serving the
+	// same certificate for RenewalStuckChecks checks within that window,
+	// its renewal is considered overdue. Zero disables the detection.
+	RenewalLeadTime    time.Duration
+	RenewalStuckChecks int
+
+	// If not nil, served certificates get compared with the ones
+	// obtained by the local ACME clients.
+	ACME *ACMEState
+
+	// Pairs of domains whose certificates get compared.
+	Pairs []Pair
+
+	// Whether to fetch the Strict-Transport-Security header after
+	// each successful check.
+	HSTS bool
+
+	// Whether deep scans also ask the OCSP responder of the CA whether
+	// leaf certificates were revoked, besides looking at the staple.
+	OCSPResponder bool
+
+	// Tracks the root certificates that chains anchor to.
+	Roots *RootTracker
+
+	// If not nil, tracks which chains lead to our own issuing CAs.
+	CAs *CATracker
+
+	// If not nil, monitors the freshness of revocation lists.
+	CRLs *CRLMonitor
+
+	// Verifies Certificate Transparency inclusion for targets that ask.
+	CT *CTVerifier
+
+	// DNS views for targets behind split-horizon DNS, by name.
+	Views map[string]*DNSView
+
+	// Thresholds for the remaining validity of stapled OCSP responses,
+	// sorted in descending order.
+	StapleThresholds []time.Duration
+
+	// If positive, chains also get verified as of this far in the future.
+	VerifyAhead time.Duration
+
+	// If not nil, snoozes are kept in sync with Alertmanager silences.
+	Alertmanager *Alertmanager
+
+	// How long to wait before checking a target again whose name
+	// does not resolve; zero means the usual interval.
+	UnresolvableBackoff time.Duration
+
+	// If not nil, collects the results of edge agents, which get
+	// shown on the status page.
+	Aggregator *Aggregator
+
+	// Size in bytes of the presented certificates above which to log
+	// an event; zero disables the warning.
+	ChainSizeWarning int
+
+	// If set, targets do not get checked periodically, but only by
+	// CheckAll.
+	Once bool
+
+	// If not nil, the results of every sweep get written to it.
+	Results *ResultWriter
+
+	// If not nil, looks up reverse DNS names and domain registrations.
+	Enricher *Enricher
+
+	// Bearer token that snoozing on the status page needs. If nil,
+	// the status page is read-only.
+	AdminToken []byte
+}
+
+// Status of a monitored domain, as of its most recent check.
+type domainStatus struct {
+	target     Target
+	expiration time.Time
+	leaf       *x509.Certificate
+	failing    bool
+
+	// Protocol that led to the handshake in the most recent check.
+	protocol string
+
+	// TLS version and cipher suite negotiated in the most recent
+	// successful check, as exported in certmon_tls_connection_info.
+	tlsVersion, cipherSuite string
+
+	// Provider serving the target, as exported in
+	// certmon_target_provider; empty before the first deep scan.
+	provider string
+
+	// Why the chain would not verify in the future, or nil.
+	aheadErr error
+
+	// IP addresses connected to in the most recent successful check,
+	// and the sorted addresses that the name resolved to, by port.
+	addresses map[int]string
+	resolved  map[int][]string
+
+	// Ports and addresses checked for a target with all_addresses=true.
+	allAddresses map[portAddress]bool
+
+	// Whether the name did not resolve in the most recent check, and
+	// when to try again.
+	unresolvable      bool
+	unresolvableUntil time.Time
+
+	// Certificates presented by the server in the most recent check
+	// that got as far as the handshake, leaf first.
+	chain []*x509.Certificate
+
+	// Smallest threshold in days that the remaining validity has fallen
+	// below, or zero.
+	crossed int
+
+	// SHA-256 fingerprint of the leaf certificate, and for how many
+	// checks within the renewal window it has stayed the same.
+	fingerprint    [32]byte
+	unchanged      int
+	renewalOverdue bool
+
+	// Whether the ports of the target serve different certificates.
+	portMismatch bool
+
+	// OCSP response stapled in the last successful check, or nil.
+	staple *ocsp.Response
+
+	// Smallest threshold that the remaining validity of the stapled
+	// OCSP response has fallen below, or zero.
+	stapleCrossed time.Duration
+
+	// Until when alerts for the target are snoozed, or the zero time.
+	snoozedUntil time.Time
+
+	// Most recent check errors, oldest first; at most errorHistorySize.
+	errors []CheckError
+
+	// Outcomes of recent checks, for computing availability.
+	availability availability
+
+	// Stops the periodic checks of the target; done gets closed once
+	// they have stopped, including any check in flight.
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Distinct certificates ever observed, in the order of first sight.
+	inventory []InventoryEntry
+
+	// Whether the served certificate is not valid for the domain name,
+	// which usually means that the wrong certificate got deployed.
+	hostnameMismatch bool
+
+	// Whether the presented chain is larger than Options.ChainSizeWarning.
+	largeChain bool
+
+	// Whether the stapled OCSP response, or the most recent one from
+	// the OCSP responder, says the certificate is revoked.
+	revoked bool
+
+	// Most recent response from the OCSP responder, or nil.
+	responder *ocsp.Response
+
+	// When the most recent successful deep scan ran.
+	deepScanned time.Time
+}
+
+// Number of check errors kept per target.
+const errorHistorySize = 20
+
+// An error encountered when checking a target.
+type CheckError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
 }
 
 var certExpirations = prometheus.NewGaugeVec(
@@ -33,112 +230,1192 @@ var certExpirations = prometheus.NewGaugeVec(
 	},
 )
 
-func NewCertMon(domains []string, ctx context.Context) *CertMon {
+var certNotBefore = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "tls_certificate_not_before_timestamp",
+		Help:      "Start of the validity period of the leaf certificate, in seconds since 1970-01-01 midnight UTC, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var certAge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "tls_certificate_age_seconds",
+		Help:      "Time since the start of the validity period of the leaf certificate, as of the most recent check, in seconds, by domain name. Small values mean a fresh rotation; negative ones, a certificate that is not valid yet.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var lifetimeElapsed = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "certificate_lifetime_elapsed_ratio",
+		Help:      "How much of the validity period of the leaf certificate has passed, from 0 at notBefore to 1 at notAfter, by domain name. Alerting on a ratio works alike for short-lived and long-lived certificates.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var staleDeployment = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "stale_deployment",
+		Help:      "Whether the most recently renewed certificate had less validity left than the target's min_fresh_days (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var portCheckSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "port_check_success",
+		Help:      "Whether the most recent check of a port succeeded (1) or failed (0), by domain name and port.",
+	},
+	[]string{
+		"domain",
+		"port",
+	},
+)
+
+var portCertExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "port_tls_certificate_expiration_timestamp",
+		Help:      "TLS certificate expiration dates, in seconds since 1970-01-01 midnight UTC, by domain name and port.",
+	},
+	[]string{
+		"domain",
+		"port",
+	},
+)
+
+var checkTargetIP = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "check_target_ip",
+		Help:      "Always 1, labeled with the IP address that the most recent successful check connected to, by domain name and port.",
+	},
+	[]string{
+		"domain",
+		"port",
+		"ip",
+	},
+)
+
+var tlsConnectionInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "tls_connection_info",
+		Help:      "Always 1, labeled with the TLS version and cipher suite negotiated in the most recent successful check, by domain name.",
+	},
+	[]string{
+		"domain",
+		"version",
+		"cipher",
+	},
+)
+
+var unresolvable = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "unresolvable",
+		Help:      "Whether the domain name did not resolve in the most recent check (1) or it did (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var snoozedUntil = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "snoozed_until_timestamp",
+		Help:      "Until when alerts were snoozed on the status page, in seconds since 1970-01-01 midnight UTC, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var checkSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "check_success",
+		Help:      "Whether the most recent TLS certificate check succeeded (1) or failed (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var lastCheck = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "last_check_timestamp",
+		Help:      "When the most recent TLS certificate check finished, in seconds since 1970-01-01 midnight UTC, by domain name. Alerting on its age catches stuck checks.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var lastSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "last_success_timestamp",
+		Help:      "When a TLS certificate check last succeeded, in seconds since 1970-01-01 midnight UTC, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var portMismatch = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "port_certificate_mismatch",
+		Help:      "Whether the ports of a host serve different leaf certificates (1) or the same one (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var hostnameMismatch = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "hostname_mismatch",
+		Help:      "Whether the served certificate is not valid for the domain name (1) or it is (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var tlsVersionSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "tls_version_handshake_success",
+		Help:      "Whether a handshake restricted to a single TLS version succeeded (1) or failed (0), by domain name and version.",
+	},
+	[]string{
+		"domain",
+		"version",
+	},
+)
+
+var renewalOverdue = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "renewal_overdue",
+		Help:      "Whether a domain keeps serving the same certificate although it should have been renewed (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+func NewCertMon(targets []Target, opts Options, ctx context.Context) *CertMon {
 	cm := &CertMon{
-		expirations: make(map[string]time.Time, len(domains)),
-		ctx:         ctx,
-	}
-	for _, domain := range domains {
-		cm.expirations[domain] = time.Time{}
-		ticker := time.NewTicker(10 * time.Second)
-		go func(dom string) {
-			for {
+		domains: make(map[string]*domainStatus, len(targets)),
+		ctx:     ctx,
+		opts:    opts,
+	}
+	cm.opts.Thresholds = append([]int(nil), opts.Thresholds...)
+	sort.Sort(sort.Reverse(sort.IntSlice(cm.opts.Thresholds)))
+
+	// Compare the configured domains with the ones known from the event log,
+	// so that restarting with the same configuration does not log anything.
+	events := opts.Events
+	known := events.KnownTargets()
+	for _, t := range targets {
+		if !known[t.Host] {
+			events.Record(Event{Type: EventTargetAdded, Domain: t.Host})
+		}
+		delete(known, t.Host)
+	}
+	for domain := range known {
+		events.Record(Event{Type: EventTargetRemoved, Domain: domain})
+	}
+
+	snoozes := events.Snoozes()
+	inventory := events.Inventory()
+	alerts := events.AlertStates()
+	for _, target := range targets {
+		cm.domains[target.Host] = &domainStatus{
+			target:    target,
+			inventory: inventory[target.Host],
+		}
+		if state, ok := alerts[target.Host]; ok {
+			cm.restoreAlertState(cm.domains[target.Host], state)
+		}
+		if until, ok := snoozes[target.Host]; ok && until.After(time.Now()) {
+			cm.domains[target.Host].snoozedUntil = until
+			snoozedUntil.WithLabelValues(target.Host).Set(float64(until.Unix()))
+		}
+		if !opts.Once {
+			cm.watch(target.Host)
+		}
+	}
+	cm.startSweep()
+	return cm
+}
+
+// Starts checking a domain periodically, until cm.ctx is done or the
+// domain gets removed. The caller must hold cm.mutex, unless there is
+// no concurrent access yet.
+func (cm *CertMon) watch(domain string) {
+	ctx, cancel := context.WithCancel(cm.ctx)
+	done := make(chan struct{})
+	cm.domains[domain].cancel = cancel
+	cm.domains[domain].done = done
+	interval := cm.domains[domain].target.CheckInterval()
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case scheduled := <-ticker.C:
+				// Sleep up to 5000 milliseconds, for jitter so we don't create a flood of concurrent connections.
+				checksQueued.Inc()
+				sleepTime := time.Duration(rand.Intn(5000)) * time.Millisecond
 				select {
-				case <-cm.ctx.Done():
+				case <-ctx.Done():
+					checksQueued.Dec()
+					return
+				case <-time.After(sleepTime):
+				}
+				checksQueued.Dec()
+				// If the previous check took longer than the interval,
+				// the tick has been waiting in the channel.
+				checkLag.Observe((time.Since(scheduled) - sleepTime).Seconds())
+				checksInFlight.Inc()
+				cm.check(domain)
+				checksInFlight.Dec()
+				if ctx.Err() != nil {
 					return
-				case <-ticker.C:
-					// Sleep up to 5000 milliseconds, for jitter so we don't create a flood of concurrent connections.
-					sleepTime := time.Duration(rand.Intn(5000)) * time.Millisecond
-					time.Sleep(sleepTime)
-					exp, _ := FindExpirationTime(dom)
-					certExpirations.WithLabelValues(dom).Set(float64(exp.Unix()))
-					cm.mutex.Lock()
-					cm.expirations[dom] = exp
-					cm.mutex.Unlock()
 				}
+				cm.checked(domain)
+
+				// The interval may have changed by syncing targets.
+				cm.mutex.Lock()
+				if status, ok := cm.domains[domain]; ok && status.target.CheckInterval() != interval {
+					interval = status.target.CheckInterval()
+					ticker.Reset(interval)
+				}
+				cm.mutex.Unlock()
 			}
-		}(domain)
+		}
+	}()
+}
+
+// Adds targets while running, and starts checking them. Returns for each
+// target whether it was added; targets whose host is monitored already
+// are left alone.
+func (cm *CertMon) AddTargets(targets []Target) []bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	inventory := cm.opts.Events.Inventory()
+	added := make([]bool, len(targets))
+	for i, target := range targets {
+		if _, ok := cm.domains[target.Host]; ok {
+			continue
+		}
+		cm.opts.Events.Record(Event{Type: EventTargetAdded, Domain: target.Host})
+		cm.domains[target.Host] = &domainStatus{
+			target:    target,
+			inventory: inventory[target.Host],
+		}
+		cm.watch(target.Host)
+		cm.sweepPending[target.Host] = true
+		added[i] = true
 	}
-	return cm
+	return added
+}
+
+// Stops checking the given domains, and removes their metrics. Returns
+// once checks in flight for these domains have finished, so they cannot
+// bring back the metrics. Returns for each domain whether it was
+// monitored.
+func (cm *CertMon) RemoveTargets(domains []string) []bool {
+	cm.mutex.Lock()
+	removed := make(map[string]*domainStatus, len(domains))
+	found := make([]bool, len(domains))
+	for i, domain := range domains {
+		status, ok := cm.domains[domain]
+		if !ok {
+			continue
+		}
+		found[i] = true
+		status.cancel()
+		delete(cm.domains, domain)
+		delete(cm.sweepPending, domain)
+		cm.opts.Events.Record(Event{Type: EventTargetRemoved, Domain: domain})
+		removed[domain] = status
+	}
+	cm.mutex.Unlock()
+
+	for _, status := range removed {
+		<-status.done
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	for domain, status := range removed {
+		// Added again while we were waiting.
+		if _, ok := cm.domains[domain]; ok {
+			continue
+		}
+		deleteMetrics(domain, status.target)
+		deleteAddressMetrics(domain, status.allAddresses)
+		for port, addr := range status.addresses {
+			checkTargetIP.DeleteLabelValues(domain, strconv.Itoa(port), addr)
+		}
+		if status.tlsVersion != "" {
+			tlsConnectionInfo.DeleteLabelValues(domain, status.tlsVersion, status.cipherSuite)
+		}
+		if status.provider != "" {
+			targetProvider.DeleteLabelValues(domain, status.provider)
+		}
+		deleteChainMetrics(domain, status.chain)
+		if cm.opts.CT != nil {
+			cm.opts.CT.Forget(domain)
+		}
+		if cm.opts.Roots != nil {
+			cm.opts.Roots.Forget(domain)
+		}
+		if cm.opts.CAs != nil {
+			cm.opts.CAs.Forget(domain)
+		}
+		if cm.opts.CRLs != nil {
+			cm.opts.CRLs.Forget(domain)
+		}
+	}
+	return found
+}
+
+// Makes the monitored targets match the given ones: new hosts get added,
+// hosts that are not listed anymore get removed, and the options of the
+// others get updated for their next check. Returns the sorted hosts
+// that got added and removed.
+func (cm *CertMon) SyncTargets(targets []Target) (added, removed []string) {
+	wanted := make(map[string]bool, len(targets))
+	var newTargets []Target
+	cm.mutex.Lock()
+	for _, t := range targets {
+		wanted[t.Host] = true
+		if status, ok := cm.domains[t.Host]; ok {
+			cm.deleteStaleMetrics(status, t)
+			status.target = t
+		} else {
+			newTargets = append(newTargets, t)
+		}
+	}
+	for domain := range cm.domains {
+		if !wanted[domain] {
+			removed = append(removed, domain)
+		}
+	}
+	cm.mutex.Unlock()
+
+	for i, ok := range cm.AddTargets(newTargets) {
+		if ok {
+			added = append(added, newTargets[i].Host)
+		}
+	}
+	cm.RemoveTargets(removed)
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
 }
 
-// Find the earliest expiration time in the TLS certificate chain for host.
-func FindExpirationTime(host string) (time.Time, error) {
-	conn, err := tls.Dial("tcp", host+":443", nil)
+// Syncs the targets with a reloaded configuration, and records the
+// reload in the event log. If the configuration could not be loaded,
+// err tells why, and the targets stay as they are.
+func (cm *CertMon) ReloadTargets(targets []Target, err error) {
 	if err != nil {
-		return time.Time{}, err
+		log.Printf("not reloading targets: %v", err)
+		cm.opts.Events.Record(Event{Type: EventConfigReloadFailed, Message: err.Error()})
+		return
 	}
+	added, removed := cm.SyncTargets(targets)
+	log.Printf("reloaded %d targets", len(targets))
+	cm.opts.Events.Record(Event{
+		Type:    EventConfigReloaded,
+		Message: fmt.Sprintf("%d targets, %d added, %d removed", len(targets), len(added), len(removed)),
+		Added:   added,
+		Removed: removed,
+	})
+}
 
-	if err = conn.VerifyHostname(host); err != nil {
-		return time.Time{}, err
+// Removes the per-domain metrics of a target that is not monitored anymore.
+func deleteMetrics(domain string, t Target) {
+	for _, g := range []*prometheus.GaugeVec{
+		certExpirations, checkSuccess, renewalOverdue, portMismatch,
+		hostnameMismatch, snoozedUntil, ocspStaplePresent,
+		ocspStapleNextUpdate, ocspStapleExpiring, httpProbeSuccess,
+		httpProbeStatusCode, chainValidAhead, staleDeployment,
+		acmeDeployed, acmeDeploymentLag, unresolvable, chainSize,
+		tlsVerificationOK, lifetimeElapsed, lastCheck, lastSuccess,
+		certNotBefore, certAge, certificateRevoked, ocspResponderSuccess,
+	} {
+		g.DeleteLabelValues(domain)
+	}
+	for _, v := range t.ProbeTLSVersions {
+		tlsVersionSuccess.DeleteLabelValues(domain, tlsVersionName(v))
+	}
+	for _, view := range t.Views {
+		viewCheckSuccess.DeleteLabelValues(domain, view)
+		viewCertExpiration.DeleteLabelValues(domain, view)
+	}
+	for _, name := range t.SNI {
+		sniCheckSuccess.DeleteLabelValues(domain, name)
+		sniCertExpiration.DeleteLabelValues(domain, name)
+	}
+	for _, port := range t.Ports {
+		portCheckSuccess.DeleteLabelValues(domain, strconv.Itoa(port))
+		portCertExpiration.DeleteLabelValues(domain, strconv.Itoa(port))
+	}
+	for _, v := range ipVersions {
+		deleteIPVersionMetrics(domain, v.name)
 	}
+	for _, w := range availabilityWindows {
+		availabilityRatio.DeleteLabelValues(domain, w.name)
+	}
+	checkRetries.DeleteLabelValues(domain)
+	for _, reason := range checkErrorReasons {
+		checkErrors.DeleteLabelValues(domain, reason)
+	}
+	for _, level := range validationLevels {
+		certificateValidation.DeleteLabelValues(domain, level)
+	}
+	for _, phase := range probePhases {
+		probeDuration.DeleteLabelValues(domain, phase)
+	}
+	deleteDNSSECMetrics(domain)
+	exportHSTS(domain, HSTSPolicy{}, errRemoved)
+}
 
-	exp := conn.ConnectionState().PeerCertificates[0].NotAfter
-	for _, cert := range conn.ConnectionState().PeerCertificates[1:] {
-		if cert.NotAfter.Before(exp) {
-			exp = cert.NotAfter
+// Removes the metrics that a target exported under its current options,
+// but won't anymore under the new ones. The caller must hold cm.mutex.
+func (cm *CertMon) deleteStaleMetrics(status *domainStatus, t Target) {
+	old, domain := status.target, status.target.Host
+	for _, v := range old.ProbeTLSVersions {
+		if !containsTLSVersion(t.ProbeTLSVersions, v) {
+			tlsVersionSuccess.DeleteLabelValues(domain, tlsVersionName(v))
+		}
+	}
+	for _, view := range old.Views {
+		if !contains(t.Views, view) {
+			viewCheckSuccess.DeleteLabelValues(domain, view)
+			viewCertExpiration.DeleteLabelValues(domain, view)
+		}
+	}
+	for _, name := range old.SNI {
+		if !contains(t.SNI, name) {
+			sniCheckSuccess.DeleteLabelValues(domain, name)
+			sniCertExpiration.DeleteLabelValues(domain, name)
+		}
+	}
+	for _, port := range old.Ports {
+		if !containsPort(t.Ports, port) {
+			portCheckSuccess.DeleteLabelValues(domain, strconv.Itoa(port))
+			portCertExpiration.DeleteLabelValues(domain, strconv.Itoa(port))
+		}
+	}
+	for port, addr := range status.addresses {
+		if !containsPort(t.Ports, port) {
+			checkTargetIP.DeleteLabelValues(domain, strconv.Itoa(port), addr)
+			delete(status.addresses, port)
+			delete(status.resolved, port)
+		}
+	}
+	for pa := range status.allAddresses {
+		if !t.AllAddresses || !containsPort(t.Ports, pa.port) {
+			deleteAddressMetrics(domain, map[portAddress]bool{pa: true})
+			delete(status.allAddresses, pa)
+		}
+	}
+	if !t.DNSSEC {
+		deleteDNSSECMetrics(domain)
+	}
+	if !t.DualStack {
+		for _, v := range ipVersions {
+			deleteIPVersionMetrics(domain, v.name)
 		}
 	}
+	if len(t.Ports) < 2 {
+		portMismatch.DeleteLabelValues(domain)
+	}
+	if t.HTTPPath == "" {
+		httpProbeSuccess.DeleteLabelValues(domain)
+		httpProbeStatusCode.DeleteLabelValues(domain)
+	}
+	if t.MinFreshDays == 0 {
+		staleDeployment.DeleteLabelValues(domain)
+	}
+	if !t.VerifyCT && cm.opts.CT != nil {
+		cm.opts.CT.Forget(domain)
+	}
+}
+
+// Exports the IP addresses that a check connected to, and records an
+// event when a port is now served from different addresses than before.
+// With round-robin DNS, the address connected to changes all the time,
+// so for names, the event is only recorded when the set of addresses
+// that the name resolves to changes.
+func (cm *CertMon) observeAddresses(domain string, addrs map[int]string, resolved map[int][]string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	status, ok := cm.domains[domain]
+	if !ok {
+		return
+	}
+	for port, addr := range addrs {
+		old, oldSet, set := status.addresses[port], status.resolved[port], resolved[port]
+		var message string
+		switch {
+		case old == "":
+		case set != nil || oldSet != nil:
+			if !equalStrings(set, oldSet) {
+				message = fmt.Sprintf("port %d: name resolves to %s instead of %s",
+					port, strings.Join(set, ", "), strings.Join(oldSet, ", "))
+			}
+		case old != addr:
+			message = fmt.Sprintf("port %d: connected to %s instead of %s", port, addr, old)
+		}
+		if message != "" {
+			cm.opts.Events.Record(Event{
+				Type:    EventAddressChanged,
+				Domain:  domain,
+				Message: message,
+			})
+		}
+		if old != addr {
+			portLabel := strconv.Itoa(port)
+			if old != "" {
+				checkTargetIP.DeleteLabelValues(domain, portLabel, old)
+			}
+			checkTargetIP.WithLabelValues(domain, portLabel, addr).Set(1)
+		}
+	}
+	for port, old := range status.addresses {
+		if _, ok := addrs[port]; !ok {
+			checkTargetIP.DeleteLabelValues(domain, strconv.Itoa(port), old)
+		}
+	}
+	status.addresses, status.resolved = addrs, resolved
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Exports the TLS version and cipher suite negotiated in a successful
+// check, replacing the series for the ones negotiated before. The caller
+// must hold cm.mutex.
+func observeConnection(domain string, status *domainStatus, result *CheckResult) {
+	version, cipher := tlsVersionName(result.Version), tls.CipherSuiteName(result.CipherSuite)
+	if status.tlsVersion != "" && (status.tlsVersion != version || status.cipherSuite != cipher) {
+		tlsConnectionInfo.DeleteLabelValues(domain, status.tlsVersion, status.cipherSuite)
+	}
+	tlsConnectionInfo.WithLabelValues(domain, version, cipher).Set(1)
+	status.tlsVersion, status.cipherSuite = version, cipher
+}
 
-	return exp, nil
+var errRemoved = errors.New("target removed")
+
+// Snoozes alerts for a domain until the given time, or lifts the snooze
+// if until is the zero time. The snooze gets recorded in the event log,
+// which makes it survive restarts. If configured, a matching Alertmanager
+// silence gets created or expired as well. The source tells who asked
+// for the snooze; it gets mentioned in the event log and the silence.
+// Callers must have authenticated the request.
+func (cm *CertMon) Snooze(domain string, until time.Time, source string) error {
+	if err := cm.snooze(domain, until, source); err != nil {
+		return err
+	}
+	if am := cm.opts.Alertmanager; am != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(cm.ctx, 30*time.Second)
+			defer cancel()
+			if err := am.Silence(ctx, domain, until, source); err != nil {
+				log.Printf("alertmanager silence for %s: %v", domain, err)
+			}
+		}()
+	}
+	return nil
 }
 
-// Serves a web page with the current status of this server.
-func (cm *CertMon) HandleStatus(w http.ResponseWriter, r *http.Request) {
+// Snoozes or unsnoozes a domain without touching Alertmanager. The
+// source, if not empty, gets mentioned in the event log.
+func (cm *CertMon) snooze(domain string, until time.Time, source string) error {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
-	domains := make([]string, 0, len(cm.expirations))
-	for dom, _ := range cm.expirations {
-		domains = append(domains, dom)
+	status, ok := cm.domains[domain]
+	if !ok {
+		return fmt.Errorf("unknown domain %q", domain)
+	}
+	status.snoozedUntil = until
+	e := Event{Type: EventSnoozed, Domain: domain}
+	if until.IsZero() {
+		snoozedUntil.DeleteLabelValues(domain)
+		e.Message = "snooze lifted"
+	} else {
+		snoozedUntil.WithLabelValues(domain).Set(float64(until.Unix()))
+		e.Message = "snoozed until " + until.Format(time.RFC3339)
+		e.SnoozedUntil = &until
+	}
+	if source != "" {
+		e.Message += " by " + source
+	}
+	return cm.opts.Events.Record(e)
+}
+
+// Returns until when a domain is snoozed, or the zero time if it is
+// not snoozed or not monitored.
+func (cm *CertMon) snoozeEnd(domain string) time.Time {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	if status, ok := cm.domains[domain]; ok && status.snoozedUntil.After(time.Now()) {
+		return status.snoozedUntil
 	}
+	return time.Time{}
+}
 
-	// Sort by expiration date; if equal, use domain name as secondary key.
-	sort.Slice(domains, func(i, j int) bool {
-		exp_i := cm.expirations[domains[i]]
-		exp_j := cm.expirations[domains[j]]
-		if exp_i != exp_j {
-			return exp_i.Before(exp_j)
-		} else {
-			return domains[i] < domains[j]
+// Checks the certificates of a domain on all its ports, and updates
+// its status.
+func (cm *CertMon) check(domain string) {
+	cm.mutex.Lock()
+	status, ok := cm.domains[domain]
+	var target Target
+	backoff, deep := false, false
+	if ok {
+		target = status.target
+		backoff = time.Now().Before(status.unresolvableUntil)
+		deep = time.Since(status.deepScanned) >= target.DeepScanInterval()
+	}
+	cm.mutex.Unlock()
+	if !ok || backoff {
+		return
+	}
+	defer lastCheck.WithLabelValues(domain).SetToCurrentTime()
+
+	for _, name := range target.Views {
+		cm.opts.Views[name].Check(domain, target)
+	}
+	checkSNI(domain, target)
+	if target.DNSSEC {
+		checkDNSSEC(domain, target)
+	}
+	if target.AllAddresses {
+		cm.checkAllAddresses(domain, target)
+	}
+	if target.DualStack {
+		checkDualStack(domain, target)
+	}
+
+	var result *CheckResult
+	var err error
+	mismatch := false
+	addrs := make(map[int]string, len(target.Ports))
+	resolved := make(map[int][]string, len(target.Ports))
+	for _, port := range target.Ports {
+		r, portErr := cm.checkPortWithRetries(domain, target, port)
+		portLabel := strconv.Itoa(port)
+		portCheckSuccess.WithLabelValues(domain, portLabel).Set(boolToFloat(portErr == nil))
+		if portErr != nil {
+			if len(target.Ports) > 1 {
+				portErr = fmt.Errorf("port %d: %w", port, portErr)
+			}
+			if err == nil {
+				err = portErr
+			}
+			continue
 		}
-	})
+		portCertExpiration.WithLabelValues(domain, portLabel).Set(float64(r.Expiration.Unix()))
+		observeProbeDuration(domain, r.Durations)
+		if r.Address != "" {
+			addrs[port] = r.Address
+		}
+		if r.Resolved != nil {
+			resolved[port] = r.Resolved
+		}
+		if result == nil {
+			result = r
+			continue
+		}
+		if !bytes.Equal(r.Chain[0].Raw, result.Chain[0].Raw) {
+			mismatch = true
+		}
+		if r.Expiration.Before(result.Expiration) {
+			result.Expiration = r.Expiration
+		}
+	}
+	if err != nil {
+		// Keep the expiration series absent (or at its last
+		// known value) rather than exporting the zero time.
+		checkSuccess.WithLabelValues(domain).Set(0)
+		if target.HTTPPath != "" {
+			httpProbeSuccess.WithLabelValues(domain).Set(0)
+		}
+		var hostErr x509.HostnameError
+		if errors.As(err, &hostErr) {
+			hostnameMismatch.WithLabelValues(domain).Set(1)
+			certExpirations.WithLabelValues(domain).Set(float64(hostErr.Certificate.NotAfter.Unix()))
+		}
+		if isVerificationError(err) {
+			tlsVerificationOK.WithLabelValues(domain).Set(0)
+		}
+		// Leaf certificates that are not valid yet fail verification,
+		// but their age is what tells why.
+		var invalid x509.CertificateInvalidError
+		if errors.As(err, &invalid) && invalid.Cert != nil && !invalid.Cert.IsCA {
+			exportCertificateAge(domain, invalid.Cert)
+		}
+		checkErrors.WithLabelValues(domain, checkErrorReason(err)).Inc()
+		cm.fail(domain, err)
+		return
+	}
+
+	// Insecure targets skip verification in the handshake, so find
+	// out separately whether they would have passed.
+	var verifyErr error
+	if target.Insecure {
+		result.Verified, verifyErr = target.verify(result.Chain)
+	}
+	var hostErr x509.HostnameError
+	tlsVerificationOK.WithLabelValues(domain).Set(boolToFloat(verifyErr == nil))
+	checkSuccess.WithLabelValues(domain).Set(1)
+	lastSuccess.WithLabelValues(domain).SetToCurrentTime()
+	hostnameMismatch.WithLabelValues(domain).Set(boolToFloat(errors.As(verifyErr, &hostErr)))
+	cm.observeAddresses(domain, addrs, resolved)
+	certExpirations.WithLabelValues(domain).Set(float64(result.Expiration.Unix()))
+	lifetimeElapsed.WithLabelValues(domain).Set(lifetimeElapsedRatio(result.Chain[0], time.Now()))
+	exportCertificateAge(domain, result.Chain[0])
+	exportValidationLevel(domain, result.Chain[0])
+	if len(target.Ports) > 1 {
+		portMismatch.WithLabelValues(domain).Set(boolToFloat(mismatch))
+	}
+	if cm.opts.ACME != nil {
+		cm.opts.ACME.Correlate(domain, result.Chain[0])
+	}
+	if cm.opts.Roots != nil {
+		cm.opts.Roots.Observe(domain, result)
+	}
+	if cm.opts.CAs != nil {
+		cm.opts.CAs.Observe(domain, result)
+	}
+	if cm.opts.CRLs != nil {
+		cm.opts.CRLs.Observe(domain, result)
+	}
+	if deep {
+		cm.deepScan(domain, target, result)
+	}
+	var aheadErr error
+	if cm.opts.VerifyAhead > 0 {
+		aheadErr = VerifyAhead(target.Host, result.Chain, target.RootCAs(), cm.opts.VerifyAhead)
+		chainValidAhead.WithLabelValues(domain).Set(boolToFloat(aheadErr == nil))
+	}
+	if target.HTTPPath != "" {
+		status, err := ProbeHTTP(target)
+		exportHTTPProbe(domain, target.HTTPStatus, status, err)
+	}
+	cm.update(domain, result, mismatch, aheadErr, deep)
+}
+
+// Runs the expensive parts of a check, which need further connections
+// or external services, after a successful handshake.
+func (cm *CertMon) deepScan(domain string, target Target, result *CheckResult) {
+	for _, version := range target.ProbeTLSVersions {
+		config := target.TLSConfig()
+		config.MinVersion, config.MaxVersion = version, version
+		_, err := target.checkPort(target.Ports[0], config)
+		tlsVersionSuccess.WithLabelValues(domain, tlsVersionName(version)).Set(boolToFloat(err == nil))
+	}
+	if target.VerifyCT && cm.opts.CT != nil {
+		cm.opts.CT.Observe(domain, result)
+	}
+	if cm.opts.HSTS {
+		policy, err := FetchHSTS(target)
+		exportHSTS(domain, policy, err)
+	}
+	if cm.opts.OCSPResponder {
+		resp, err := QueryResponder(result.Chain, target.CheckTimeout())
+		if err != nil {
+			log.Printf("%s: OCSP responder: %v", domain, err)
+		}
+		ocspResponderSuccess.WithLabelValues(domain).Set(boolToFloat(err == nil))
+		result.Responder = resp
+	}
+	cm.observeProvider(domain, target, result.Chain[0])
+}
+
+func exportCertificateAge(domain string, leaf *x509.Certificate) {
+	certNotBefore.WithLabelValues(domain).Set(float64(leaf.NotBefore.Unix()))
+	certAge.WithLabelValues(domain).Set(time.Since(leaf.NotBefore).Seconds())
+}
+
+// Returns how much of the validity period of a certificate has passed
+// at time now, clamped to the range from 0 to 1.
+func lifetimeElapsedRatio(cert *x509.Certificate, now time.Time) float64 {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime <= 0 {
+		return 1
+	}
+	ratio := float64(now.Sub(cert.NotBefore)) / float64(lifetime)
+	if ratio < 0 {
+		return 0
+	}
+	if ratio > 1 {
+		return 1
+	}
+	return ratio
+}
+
+// Records the result of a successful check, which was a deep scan if
+// deep is true, and logs renewals and threshold crossings.
+func (cm *CertMon) update(domain string, result *CheckResult, mismatch bool, aheadErr error, deep bool) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	events := cm.opts.Events
+	status, ok := cm.domains[domain]
+	if !ok {
+		return
+	}
+	if status.failing {
+		events.Record(Event{Type: EventCheckRecovered, Domain: domain})
+	}
+	observeAvailability(domain, status, true)
+	status.failing = false
+	if deep {
+		status.deepScanned = time.Now()
+	}
+	status.hostnameMismatch = false
+	status.unresolvable = false
+	unresolvable.WithLabelValues(domain).Set(0)
+
+	if mismatch && !status.portMismatch {
+		events.Record(Event{
+			Type:    EventPortMismatch,
+			Domain:  domain,
+			Message: "ports serve different certificates",
+		})
+	}
+	status.portMismatch = mismatch
+
+	old, exp := status.expiration, result.Expiration
+	oldLeaf, leaf := status.leaf, result.Chain[0]
+	status.expiration = exp
+	status.leaf = leaf
+	setChain(domain, status, result.Chain)
+	cm.observeChainSize(domain, status, result.Chain)
+	status.staple = result.Staple
+	status.protocol = result.Protocol
+	status.aheadErr = aheadErr
+	observeConnection(domain, status, result)
+	for _, p := range cm.opts.Pairs {
+		if p.Domain == domain || p.Peer == domain {
+			a, b := cm.domains[p.Domain], cm.domains[p.Peer]
+			if a != nil && b != nil && a.leaf != nil && b.leaf != nil {
+				p.exportMetrics(a.leaf, b.leaf)
+			}
+		}
+	}
+	if !old.IsZero() && exp.After(old) {
+		events.Record(Event{
+			Type:   EventRenewalDetected,
+			Domain: domain,
+			Message: fmt.Sprintf("expiration moved from %s to %s",
+				old.Format(time.RFC3339), exp.Format(time.RFC3339)),
+			OldExpiration: &old,
+			NewExpiration: &exp,
+		})
+	}
+
+	// Services that deploy certificates from a stale cache renew in
+	// name only. This looks at the leaf, since an intermediate that
+	// expires sooner would hide its renewal from the chain expiration.
+	min := status.target.MinFreshDays
+	if min > 0 && oldLeaf != nil && !bytes.Equal(oldLeaf.Raw, leaf.Raw) && leaf.NotAfter.After(oldLeaf.NotAfter) {
+		days := int(time.Until(leaf.NotAfter).Hours() / 24)
+		stale := days < min
+		if stale {
+			events.Record(Event{
+				Type:    EventStaleDeployment,
+				Domain:  domain,
+				Message: fmt.Sprintf("renewed certificate has only %d days of validity left, expected at least %d", days, min),
+			})
+		}
+		staleDeployment.WithLabelValues(domain).Set(boolToFloat(stale))
+	}
+
+	remaining := time.Until(exp)
+	crossed := 0
+	for _, days := range cm.opts.Thresholds {
+		if remaining < time.Duration(days)*24*time.Hour {
+			crossed = days
+		}
+	}
+	if crossed != 0 && (status.crossed == 0 || crossed < status.crossed) {
+		events.Record(Event{
+			Type:    EventThresholdCrossed,
+			Domain:  domain,
+			Message: fmt.Sprintf(thresholdMessage, crossed),
+		})
+	}
+	status.crossed = crossed
+	status.stapleCrossed = cm.observeStaple(domain, result, status.stapleCrossed)
 
-	fmt.Fprintf(w, "%s",
-		`<html>
-<head>
-<link href='https://tools-static.wmflabs.org/fontcdn/css?family=Roboto+Slab:400,700' rel='stylesheet' type='text/css'/>
-<style>
-* {
-  font-family: 'Roboto Slab', serif;
+	fingerprint := sha256.Sum256(result.Chain[0].Raw)
+	if fingerprint != status.fingerprint {
+		status.fingerprint = fingerprint
+		status.unchanged = 0
+		cm.inventorize(domain, status, result.Chain[0])
+	}
+	if result.Responder != nil {
+		status.responder = result.Responder
+	}
+	revokedAt, source := revocation(status.leaf, result.Staple, status.responder)
+	revoked := source != ""
+	if revoked && !status.revoked {
+		events.Record(Event{
+			Type:    EventRevoked,
+			Domain:  domain,
+			Message: source + " says the certificate was revoked at " + revokedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	certificateRevoked.WithLabelValues(domain).Set(boolToFloat(revoked))
+	status.revoked = revoked
+	if cm.opts.RenewalLeadTime > 0 && remaining < cm.opts.RenewalLeadTime {
+		status.unchanged += 1
+	} else {
+		status.unchanged = 0
+	}
+	overdue := cm.opts.RenewalLeadTime > 0 && status.unchanged >= cm.opts.RenewalStuckChecks
+	if overdue && !status.renewalOverdue {
+		events.Record(Event{
+			Type:   EventRenewalOverdue,
+			Domain: domain,
+			Message: fmt.Sprintf("same certificate served for %d checks within %d days of expiration",
+				status.unchanged, int(cm.opts.RenewalLeadTime.Hours()/24)),
+		})
+	}
+	status.renewalOverdue = overdue
+	renewalOverdue.WithLabelValues(domain).Set(boolToFloat(overdue))
 }
-h1 {
-  color: #0066ff;
-  margin-left: 1em;
-  margin-top: 1em;
+
+// Records a failed check, logging an event if the domain was not failing
+// already. A certificate that is not valid for the domain is classified
+// separately from other failures, since it usually means that the wrong
+// certificate got deployed; it still gets shown, as its names tell which
+// deployment went wrong.
+func (cm *CertMon) fail(domain string, err error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	status, ok := cm.domains[domain]
+	if !ok {
+		return
+	}
+	observeAvailability(domain, status, false)
+
+	// Names that do not exist are unlikely to appear within the next
+	// minutes, so check them less often, and keep them apart from
+	// other check errors.
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		if !status.unresolvable {
+			cm.opts.Events.Record(Event{Type: EventUnresolvable, Domain: domain, Message: err.Error()})
+		}
+		status.unresolvable = true
+		status.unresolvableUntil = time.Now().Add(cm.opts.UnresolvableBackoff)
+		status.hostnameMismatch = false
+		status.failing = true
+		unresolvable.WithLabelValues(domain).Set(1)
+		return
+	}
+	wasUnresolvable := status.unresolvable
+	status.unresolvable = false
+	unresolvable.WithLabelValues(domain).Set(0)
+
+	var hostErr x509.HostnameError
+	if errors.As(err, &hostErr) {
+		if !status.hostnameMismatch {
+			cm.opts.Events.Record(Event{Type: EventHostnameMismatch, Domain: domain, Message: err.Error()})
+		}
+		status.hostnameMismatch = true
+		status.leaf = hostErr.Certificate
+		setChain(domain, status, []*x509.Certificate{hostErr.Certificate})
+		status.expiration = hostErr.Certificate.NotAfter
+	} else {
+		if !status.failing || status.hostnameMismatch || wasUnresolvable {
+			cm.opts.Events.Record(Event{Type: EventCheckFailed, Domain: domain, Message: err.Error()})
+		}
+		status.hostnameMismatch = false
+	}
+	status.failing = true
+
+	status.errors = append(status.errors, CheckError{Time: time.Now().UTC(), Error: err.Error()})
+	if n := len(status.errors); n > errorHistorySize {
+		status.errors = append([]CheckError(nil), status.errors[n-errorHistorySize:]...)
+	}
+}
+
+// Returns the most recent check errors for a domain, newest first.
+func (cm *CertMon) Errors(domain string) ([]CheckError, bool) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	status, ok := cm.domains[domain]
+	if !ok {
+		return nil, false
+	}
+	result := make([]CheckError, 0, len(status.errors))
+	for i := len(status.errors) - 1; i >= 0; i-- {
+		result = append(result, status.errors[i])
+	}
+	return result, true
 }
-p {
-  margin-left: 5em;
+
+type CheckResult struct {
+	// Earliest expiration time in the certificate chain.
+	Expiration time.Time
+
+	// Certificates presented by the server, leaf first.
+	Chain []*x509.Certificate
+
+	// Chains from the leaf to a trusted root, as built during verification.
+	Verified [][]*x509.Certificate
+
+	// OCSP response stapled by the server, or nil if there was none
+	// or it could not be parsed.
+	Staple *ocsp.Response
+
+	// OCSP response from the responder of the CA, if a deep scan
+	// asked for one and got it.
+	Responder *ocsp.Response
+
+	// Protocol that led to the handshake, such as "tls" or "smtp".
+	Protocol string
+
+	// IP address that the check connected to.
+	Address string
+
+	// Addresses that the name resolved to, sorted; nil if the check
+	// connected to an IP address or through a proxy.
+	Resolved []string
+
+	// Negotiated TLS version and cipher suite.
+	Version, CipherSuite uint16
+
+	// How long looking up the name, connecting and the handshake took.
+	Durations PhaseDurations
 }
-th {
-  text-align: left;
+
+// Fetches the TLS certificate chain for host on port, reaching the
+// handshake with protocol, and finds its earliest expiration time.
+func CheckCertificate(host string, port int, protocol string, config *tls.Config, timeout time.Duration) (*CheckResult, error) {
+	return checkCertificateAt(net.DefaultResolver, proxyFor(host, port), host, host, port, protocol, config, timeout, timeout)
 }
-</style>
-</head>
-<body><h1>CertMon: Monitoring TLS Certificates</h1>
-<p>Every 30 seconds, this job checks the expiration dates of TLS certificates.
-It exposes these dates as <a href="/metrics">metrics</a> for monitoring with <a href="https://prometheus.io/">Prometheus</a>.</p>
 
-<p>Source code: <a href="https://github.com/brawer/certmon">https://github.com/brawer/certmon</a></p>
+// Like CheckCertificate, but connects to dialHost instead of host,
+// such as one of the addresses that host resolves to, looking it up
+// with resolver if it is a name. If proxy is not nil, the connection
+// goes through it, and the proxy looks up the name. Establishing the
+// connection may take up to connectTimeout, and reaching the handshake
+// up to timeout.
+func checkCertificateAt(resolver *net.Resolver, proxy *url.URL, host, dialHost string, port int, protocol string, config *tls.Config, connectTimeout, timeout time.Duration) (*CheckResult, error) {
+	// Resolve the name ourselves, so we know which address we
+	// connected to. Like net.Dial, try the next address if the
+	// connection cannot be established.
+	var durations PhaseDurations
+	addrs := []string{dialHost}
+	if net.ParseIP(dialHost) == nil && proxy == nil {
+		countLookup()
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resolved, err := resolver.LookupHost(ctx, dialHost)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		addrs = resolved
+		durations.DNS = time.Since(start)
+	}
+	dial := proxyDialer(proxy)
+	if connectTimeout < timeout {
+		dialTimeout := dial
+		dial = func(addr string, _ time.Duration) (net.Conn, error) {
+			return dialTimeout(addr, connectTimeout)
+		}
+	}
+	dial = countedDialer(timedDialer(dial, &durations.Connect))
+	var state tls.ConnectionState
+	var used, addr string
+	var err error
+	start := time.Now()
+	for _, addr = range addrs {
+		state, used, err = handshake(dial, protocol, host, addr, port, config, timeout)
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) || opErr.Op != "dial" {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	durations.Handshake = time.Since(start) - durations.Connect
 
-<p><table>
-<tr><th>Domain</th><th>Certificate expires</th></tr>
-`)
-	for _, domain := range domains {
-		exp := cm.expirations[domain]
-		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td></tr>\n",
-			domain, exp.Format(time.RFC3339))
+	chain := state.PeerCertificates
+	exp := chain[0].NotAfter
+	for _, cert := range chain[1:] {
+		if cert.NotAfter.Before(exp) {
+			exp = cert.NotAfter
+		}
 	}
 
-	fmt.Fprintf(w, "%s", "</table></p></body></html>\n")
+	result := &CheckResult{
+		Expiration: exp,
+		Chain:      chain,
+		Verified:   state.VerifiedChains,
+		Protocol:   used,
+		Address:    addr,
+		Durations:  durations,
+	}
+	result.Version, result.CipherSuite = state.Version, state.CipherSuite
+	if net.ParseIP(dialHost) == nil && proxy == nil {
+		result.Resolved = append([]string(nil), addrs...)
+		sort.Strings(result.Resolved)
+	}
+	if state.OCSPResponse != nil {
+		if staple, err := ParseStaple(state.OCSPResponse, chain); err == nil {
+			result.Staple = staple
+		}
+	}
+	return result, nil
 }
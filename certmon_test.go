@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestLifetimeElapsedRatio(t *testing.T) {
+	notBefore := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(90 * 24 * time.Hour)
+	for _, tc := range []struct {
+		notBefore, notAfter, now time.Time
+		want                     float64
+	}{
+		{notBefore, notAfter, notBefore.Add(-time.Hour), 0},
+		{notBefore, notAfter, notBefore, 0},
+		{notBefore, notAfter, notBefore.Add(45 * 24 * time.Hour), 0.5},
+		{notBefore, notAfter, notAfter, 1},
+		{notBefore, notAfter, notAfter.Add(time.Hour), 1},
+		{notBefore, notBefore, notBefore.Add(-time.Hour), 1},
+		{notBefore, notBefore, notBefore, 1},
+		{notAfter, notBefore, notBefore, 1},
+	} {
+		cert := &x509.Certificate{NotBefore: tc.notBefore, NotAfter: tc.notAfter}
+		if got := lifetimeElapsedRatio(cert, tc.now); got != tc.want {
+			t.Errorf("lifetimeElapsedRatio(%v..%v, %v) = %v, want %v",
+				tc.notBefore, tc.notAfter, tc.now, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var chainCertExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "certificate_expiration_timestamp",
+		Help:      "Expiration dates of every certificate that the server presented, in seconds since 1970-01-01 midnight UTC, by domain name, subject, SHA-256 fingerprint and whether the certificate is the leaf. Unlike certmon_tls_certificate_expiration_timestamp, this tells which certificate of the chain expires.",
+	},
+	[]string{
+		"domain",
+		"subject",
+		"fingerprint",
+		"is_leaf",
+	},
+)
+
+func chainCertLabels(domain string, chain []*x509.Certificate, i int) []string {
+	fingerprint := sha256.Sum256(chain[i].Raw)
+	return []string{domain, chain[i].Subject.String(), hex.EncodeToString(fingerprint[:]), strconv.FormatBool(i == 0)}
+}
+
+// Replaces the presented chain of a target, and exports the expiration
+// of each certificate in it, the identity of the leaf, and whether some
+// certificate has a weak signature. Series for certificates that are
+// not presented anymore get removed. The caller must hold cm.mutex.
+func setChain(domain string, status *domainStatus, chain []*x509.Certificate) {
+	deleteChainMetrics(domain, status.chain)
+	for i, cert := range chain {
+		chainCertExpiration.WithLabelValues(chainCertLabels(domain, chain, i)...).Set(float64(cert.NotAfter.Unix()))
+	}
+	exportCertificateInfo(domain, chain[0])
+	weakSignature.WithLabelValues(domain).Set(boolToFloat(len(weakSignatures(chain)) > 0))
+	status.chain = chain
+}
+
+func deleteChainMetrics(domain string, chain []*x509.Certificate) {
+	if len(chain) > 0 {
+		deleteCertificateInfo(domain, chain[0])
+		weakSignature.DeleteLabelValues(domain)
+	}
+	for i := range chain {
+		chainCertExpiration.DeleteLabelValues(chainCertLabels(domain, chain, i)...)
+	}
+}
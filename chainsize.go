@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var chainSize = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "tls_chain_size_bytes",
+		Help:      "Total size of the DER-encoded certificates that the server presented in the handshake, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Returns the total size of the certificates in a chain, as sent in
+// the handshake.
+func chainBytes(chain []*x509.Certificate) int {
+	size := 0
+	for _, cert := range chain {
+		size += len(cert.Raw)
+	}
+	return size
+}
+
+// Exports the size of the presented chain, and logs an event when it
+// grows beyond the size given by -chain-size-warning. Large chains cost
+// clients extra round trips, which hurts on mobile networks. The caller
+// must hold cm.mutex.
+func (cm *CertMon) observeChainSize(domain string, status *domainStatus, chain []*x509.Certificate) {
+	size := chainBytes(chain)
+	chainSize.WithLabelValues(domain).Set(float64(size))
+	limit := cm.opts.ChainSizeWarning
+	large := limit > 0 && size > limit
+	if large && !status.largeChain {
+		cm.opts.Events.Record(Event{
+			Type:    EventLargeChain,
+			Domain:  domain,
+			Message: fmt.Sprintf("server presents %d certificates with %d bytes, more than %d", len(chain), size, limit),
+		})
+	}
+	status.largeChain = large
+}
@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Targets whose state changed since a cursor or point in time, for
+// external systems that keep in sync with certmon by polling.
+type Changes struct {
+	// Cursor for the next request, as in ?since=<cursor>.
+	Cursor string `json:"cursor"`
+
+	// Whether the cursor was not known, such as after a restart with
+	// an event log in memory, in which case all targets are listed.
+	Reset bool `json:"reset,omitempty"`
+
+	Targets []TargetChange `json:"targets"`
+}
+
+type TargetChange struct {
+	Domain string `json:"domain"`
+
+	// "ok", "failing", "unknown", or "removed" for targets that are
+	// no longer monitored.
+	Status     string     `json:"status"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	// Types of the events that changed the state, oldest first; not
+	// filled in when all targets are listed.
+	Events []string `json:"events,omitempty"`
+}
+
+// Returns the events after position cursor in the log, or at or after
+// since if cursor is negative, and the position of the end of the log.
+// If the cursor lies beyond the end, ok is false.
+func (el *EventLog) changes(cursor int, since time.Time) (events []Event, end int, ok bool) {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	end = el.next
+	if cursor > end {
+		return nil, end, false
+	}
+	if cursor >= 0 {
+		i := sort.Search(len(el.events), func(i int) bool { return el.events[i].seq >= cursor })
+		return append([]Event(nil), el.events[i:]...), end, true
+	}
+	for _, e := range el.events {
+		if !e.Time.Before(since) {
+			events = append(events, e)
+		}
+	}
+	return events, end, true
+}
+
+// Serves /api/v1/changes?since=<cursor>, or since=<time> in RFC 3339
+// format, listing the targets whose state changed since then according
+// to the event log. Without since, all targets are listed. Either way,
+// the response carries a cursor for the next poll.
+func (cm *CertMon) HandleChanges(w http.ResponseWriter, r *http.Request) {
+	cursor, since := -1, time.Time{}
+	if s := r.URL.Query().Get("since"); s != "" {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			since = t
+		} else if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			cursor = n
+		} else {
+			http.Error(w, "bad value for since, expected a cursor or RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	events, end, ok := cm.opts.Events.changes(cursor, since)
+	all := !ok || r.URL.Query().Get("since") == ""
+	if all {
+		events = nil
+	}
+
+	changed := make(map[string][]string)
+	for _, e := range events {
+		if e.Domain != "" {
+			changed[e.Domain] = append(changed[e.Domain], e.Type)
+		}
+	}
+
+	cm.mutex.Lock()
+	if all {
+		for domain := range cm.domains {
+			if _, ok := changed[domain]; !ok {
+				changed[domain] = nil
+			}
+		}
+	}
+	result := Changes{Cursor: strconv.Itoa(end), Reset: !ok, Targets: make([]TargetChange, 0, len(changed))}
+	for domain, types := range changed {
+		c := TargetChange{Domain: domain, Status: "removed", Events: types}
+		if status, ok := cm.domains[domain]; ok {
+			c.Status = status.state()
+			if !status.expiration.IsZero() {
+				exp := status.expiration.UTC()
+				c.Expiration = &exp
+			}
+			if status.failing && len(status.errors) > 0 {
+				c.Error = status.errors[len(status.errors)-1].Error
+			}
+		}
+		result.Targets = append(result.Targets, c)
+	}
+	cm.mutex.Unlock()
+	sort.Slice(result.Targets, func(i, j int) bool {
+		return result.Targets[i].Domain < result.Targets[j].Domain
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var clientCertExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "client_certificate_expiration_timestamp",
+		Help:      "Expiration dates of the client certificates that certmon itself uses, in seconds since 1970-01-01 midnight UTC, by name.",
+	},
+	[]string{
+		"name",
+	},
+)
+
+// Keeps track of the client certificates that certmon depends on,
+// so that its own credentials do not expire unnoticed.
+type ClientCertRegistry struct {
+	mutex sync.Mutex
+	paths map[string]string
+}
+
+func NewClientCertRegistry() *ClientCertRegistry {
+	return &ClientCertRegistry{paths: make(map[string]string)}
+}
+
+// Registers a comma-separated list of certificate files, each optionally
+// prefixed by a name and "=", as in "probe=/etc/certmon/client.pem".
+// Without a name, the file name is used.
+func (reg *ClientCertRegistry) RegisterList(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, path := "", entry
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			name, path = entry[:i], entry[i+1:]
+		}
+		if name == "" {
+			name = clientCertName(path)
+		}
+		if err := reg.Register(name, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the name for a client certificate file, as exported in
+// certmon_client_certificate_expiration_timestamp.
+func clientCertName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// Loads a client certificate for presenting to a target, and exports
+// its expiration under the name of its file.
+func loadClientCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %v", err)
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		clientCertExpiration.WithLabelValues(clientCertName(certFile)).Set(float64(leaf.NotAfter.Unix()))
+	}
+	return &cert, nil
+}
+
+// Registers a client certificate file under name, and exports the
+// expiration of its first certificate.
+func (reg *ClientCertRegistry) Register(name, path string) error {
+	certs, err := ReadCertificateFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	reg.mutex.Lock()
+	reg.paths[name] = path
+	reg.mutex.Unlock()
+	clientCertExpiration.WithLabelValues(name).Set(float64(certs[0].NotAfter.Unix()))
+	return nil
+}
+
+// Re-reads the registered files, since credentials get rotated on disk.
+func (reg *ClientCertRegistry) Reload() {
+	reg.mutex.Lock()
+	names := make([]string, 0, len(reg.paths))
+	for name := range reg.paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = reg.paths[name]
+	}
+	reg.mutex.Unlock()
+
+	for i, name := range names {
+		if err := reg.Register(name, paths[i]); err != nil {
+			log.Printf("client certificate %s: %v", name, err)
+		}
+	}
+}
+
+// Reloads the registered files once per interval, until ctx is done.
+func (reg *ClientCertRegistry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reg.Reload()
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration file given with -config, as an alternative to listing
+// targets in the -hosts flag. Example:
+//
+//	targets:
+//	  - host: example.org
+//	  - host: mail.example.org
+//	    ports: [25, 587]
+//	    protocol: smtp
+//	    interval: 5m
+//	    timeout: 10s
+//	    labels:
+//	      team: mail
+//
+// Besides host, port (or ports) and labels, an entry takes the same
+// options as a target in -hosts, such as min_tls or notes. Entries
+// without a port get checked at the usual port of their protocol, such
+// as 25 for smtp.
+type Config struct {
+	Targets []ConfigTarget `yaml:"targets"`
+}
+
+type ConfigTarget struct {
+	Host    string            `yaml:"host"`
+	Port    int               `yaml:"port"`
+	Ports   []int             `yaml:"ports"`
+	Labels  map[string]string `yaml:"labels"`
+	Options map[string]string `yaml:",inline"`
+}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Reads a configuration file, and returns its targets.
+func ReadConfig(path string) ([]Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+
+	targets := make([]Target, 0, len(config.Targets))
+	seen := make(map[string]bool, len(config.Targets))
+	for _, c := range config.Targets {
+		t, err := c.target()
+		if err != nil {
+			return nil, err
+		}
+		if seen[t.Host] {
+			return nil, fmt.Errorf("%s is listed twice", t.Host)
+		}
+		seen[t.Host] = true
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// Re-reads the configuration file once per interval, and reloads the
+// targets of cm if the file has changed, until ctx is done. This lets
+// the file be a mounted Kubernetes ConfigMap, which gets updated in
+// place. The load function reads and checks the targets, as on SIGHUP.
+func WatchConfig(ctx context.Context, cm *CertMon, path string, load func() ([]Target, error), interval time.Duration) {
+	last, _ := os.ReadFile(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("reading %s: %v", path, err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		cm.ReloadTargets(load())
+	}
+}
+
+func (c *ConfigTarget) target() (Target, error) {
+	if c.Host == "" {
+		return Target{}, fmt.Errorf("target without host")
+	}
+	t := Target{Host: c.Host, Ports: c.Ports}
+	if c.Port != 0 {
+		t.Ports = append([]int{c.Port}, t.Ports...)
+	}
+	for _, port := range t.Ports {
+		if port <= 0 || port > 65535 {
+			return Target{}, fmt.Errorf("%s: bad port %d", c.Host, port)
+		}
+	}
+
+	options := make(url.Values, len(c.Options))
+	for key, value := range c.Options {
+		options.Set(key, value)
+	}
+	if err := t.parseOptions(options.Encode()); err != nil {
+		return Target{}, fmt.Errorf("%s: %v", c.Host, err)
+	}
+	if len(t.Ports) == 0 {
+		// As with a scheme in -hosts, the protocol implies the port.
+		port, ok := defaultPorts[t.Protocol]
+		if !ok {
+			port = 443
+		}
+		t.Ports = []int{port}
+	}
+
+	for name, value := range c.Labels {
+		if !labelNameRegexp.MatchString(name) || name == "domain" || name[0] == '_' {
+			return Target{}, fmt.Errorf("%s: bad label name %q", c.Host, name)
+		}
+		if !utf8.ValidString(value) {
+			return Target{}, fmt.Errorf("%s: value of label %s is not valid UTF-8", c.Host, name)
+		}
+	}
+	t.Labels = c.Labels
+	return t, nil
+}
+
+// Exports certmon_target_info with the labels of each target from the
+// -config file. Since every target can have different labels, this is
+// an unchecked collector, which describes no metrics upfront.
+type TargetInfoCollector struct {
+	cm *CertMon
+}
+
+func NewTargetInfoCollector(cm *CertMon) *TargetInfoCollector {
+	return &TargetInfoCollector{cm: cm}
+}
+
+func (c *TargetInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c *TargetInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cm.mutex.Lock()
+	defer c.cm.mutex.Unlock()
+
+	for domain, status := range c.cm.domains {
+		labels := status.target.Labels
+		if len(labels) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(labels)+1)
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]string, 0, len(names)+1)
+		for _, name := range names {
+			values = append(values, labels[name])
+		}
+		names = append(names, "domain")
+		values = append(values, domain)
+
+		desc := prometheus.NewDesc("certmon_target_info",
+			"Always 1, labeled with the labels of the target in the configuration file, by domain name.",
+			names, nil)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+	}
+}
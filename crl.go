@@ -0,0 +1,317 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var crlFetchSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "crl_fetch_success",
+		Help:      "Whether the most recent download of a certificate revocation list succeeded (1) or failed (0), by URL.",
+	},
+	[]string{
+		"url",
+	},
+)
+
+var crlSignatureValid = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "crl_signature_valid",
+		Help:      "Whether the signature of a certificate revocation list verified against the issuer in a presented chain (1) or not (0), by URL. CRLs whose signature does not verify are not checked for revocations.",
+	},
+	[]string{
+		"url",
+	},
+)
+
+var crlThisUpdate = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "crl_this_update_timestamp",
+		Help:      "The thisUpdate time of a certificate revocation list, in seconds since 1970-01-01 midnight UTC, by URL.",
+	},
+	[]string{
+		"url",
+	},
+)
+
+var crlNextUpdate = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "crl_next_update_timestamp",
+		Help:      "The nextUpdate time of a certificate revocation list, after which strict validators reject it as stale, in seconds since 1970-01-01 midnight UTC, by URL.",
+	},
+	[]string{
+		"url",
+	},
+)
+
+var crlSize = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "crl_size_bytes",
+		Help:      "Size of a certificate revocation list, in bytes, by URL.",
+	},
+	[]string{
+		"url",
+	},
+)
+
+var crlRevoked = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "crl_revoked",
+		Help:      "Whether a certificate revocation list lists a certificate that the server presented as revoked (1) or not (0), by domain name. Only for chains whose distribution points are monitored.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Largest CRL that we are willing to download.
+const maxCRLSize = 128 << 20
+
+// Periodically downloads certificate revocation lists, either from
+// configured URLs or from the distribution points listed in monitored
+// certificates, and exports how fresh they are and whether they list
+// any of the presented certificates.
+type CRLMonitor struct {
+	auto bool
+
+	mutex sync.Mutex
+	urls  map[string]bool
+
+	// Certificates presented by each domain, and the distribution
+	// points whose CRL lists one of them as revoked.
+	chains    map[string][]*x509.Certificate
+	revokedBy map[string]map[string]bool
+
+	// Distribution points of newly presented certificates, which get
+	// downloaded without waiting for the interval.
+	stale map[string]bool
+
+	// When each CRL was last downloaded; only accessed by Run.
+	fetched map[string]time.Time
+}
+
+func NewCRLMonitor(urls []string, auto bool) *CRLMonitor {
+	m := &CRLMonitor{
+		auto:      auto,
+		urls:      make(map[string]bool, len(urls)),
+		chains:    make(map[string][]*x509.Certificate),
+		revokedBy: make(map[string]map[string]bool),
+		stale:     make(map[string]bool),
+		fetched:   make(map[string]time.Time, len(urls)),
+	}
+	for _, u := range urls {
+		m.urls[u] = true
+	}
+	return m
+}
+
+// Picks up the CRL distribution points of a checked chain, if automatic
+// discovery is enabled, and remembers the chain for checking whether the
+// monitored CRLs list it. When the chain changes, its CRLs get
+// downloaded again within a minute.
+func (m *CRLMonitor) Observe(domain string, result *CheckResult) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if old := m.chains[domain]; len(old) > 0 && bytes.Equal(old[0].Raw, result.Chain[0].Raw) {
+		return
+	}
+	m.chains[domain] = result.Chain
+	delete(m.revokedBy, domain)
+	crlRevoked.WithLabelValues(domain).Set(0)
+	for _, cert := range result.Chain {
+		for _, u := range cert.CRLDistributionPoints {
+			if m.auto {
+				m.urls[u] = true
+			}
+			if m.urls[u] {
+				m.stale[u] = true
+			}
+		}
+	}
+}
+
+// Stops checking the chain of a domain that is not monitored anymore.
+func (m *CRLMonitor) Forget(domain string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.chains, domain)
+	delete(m.revokedBy, domain)
+	crlRevoked.DeleteLabelValues(domain)
+}
+
+func (m *CRLMonitor) URLs() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	urls := make([]string, 0, len(m.urls))
+	for u := range m.urls {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+var crlClient = &http.Client{Timeout: time.Minute}
+
+// Downloads and parses a certificate revocation list. Both DER and
+// PEM encoding are accepted. Returns the list and its size in bytes.
+func FetchCRL(url string) (*x509.RevocationList, int, error) {
+	resp, err := crlClient.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: status %d", url, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) > maxCRLSize {
+		return nil, 0, fmt.Errorf("%s: CRL larger than %d bytes", url, maxCRLSize)
+	}
+
+	der := data
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		der = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, 0, err
+	}
+	return crl, len(data), nil
+}
+
+// Returns whether the CRL at url is to be downloaded before its interval
+// is up, and clears the flag.
+func (m *CRLMonitor) takeStale(url string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stale := m.stale[url]
+	delete(m.stale, url)
+	return stale
+}
+
+// Downloads the CRLs that have not been fetched within interval.
+func (m *CRLMonitor) fetchDue(events *EventLog, interval time.Duration) {
+	for _, url := range m.URLs() {
+		if !m.takeStale(url) && time.Since(m.fetched[url]) < interval {
+			continue
+		}
+		m.fetched[url] = time.Now()
+		crl, size, err := FetchCRL(url)
+		crlFetchSuccess.WithLabelValues(url).Set(boolToFloat(err == nil))
+		if err != nil {
+			continue
+		}
+		crlThisUpdate.WithLabelValues(url).Set(float64(crl.ThisUpdate.Unix()))
+		if crl.NextUpdate.IsZero() {
+			crlNextUpdate.DeleteLabelValues(url)
+		} else {
+			crlNextUpdate.WithLabelValues(url).Set(float64(crl.NextUpdate.Unix()))
+		}
+		crlSize.WithLabelValues(url).Set(float64(size))
+		m.checkRevocations(events, url, crl)
+	}
+}
+
+// Looks up the presented certificates that point to url in its CRL,
+// exports for every domain whether one of its certificates is listed,
+// and logs an event when a domain's chain gets found revoked. CRLs often
+// get served over plain HTTP, so a CRL only counts for a certificate if
+// its signature verifies against the next certificate in the chain.
+func (m *CRLMonitor) checkRevocations(events *EventLog, url string, crl *x509.RevocationList) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var verified, unverified int
+	for domain, chain := range m.chains {
+		var revoked *x509.Certificate
+		var revokedAt time.Time
+		checked := false
+		for i, cert := range chain {
+			if !contains(cert.CRLDistributionPoints, url) || !bytes.Equal(cert.RawIssuer, crl.RawIssuer) {
+				continue
+			}
+			if i+1 >= len(chain) || crl.CheckSignatureFrom(chain[i+1]) != nil {
+				unverified += 1
+				continue
+			}
+			verified += 1
+			checked = true
+			for _, r := range crl.RevokedCertificates {
+				if r.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					revoked, revokedAt = cert, r.RevocationTime
+					break
+				}
+			}
+		}
+		if !checked {
+			continue
+		}
+
+		by := m.revokedBy[domain]
+		if revoked == nil {
+			delete(by, url)
+		} else if !by[url] {
+			if len(by) == 0 {
+				events.Record(Event{
+					Type:    EventRevoked,
+					Domain:  domain,
+					Message: fmt.Sprintf("CRL %s says that %s was revoked at %s", url, revoked.Subject, revokedAt.UTC().Format(time.RFC3339)),
+				})
+			}
+			if by == nil {
+				by = make(map[string]bool)
+				m.revokedBy[domain] = by
+			}
+			by[url] = true
+		}
+		crlRevoked.WithLabelValues(domain).Set(boolToFloat(len(by) > 0))
+	}
+	switch {
+	case verified > 0:
+		crlSignatureValid.WithLabelValues(url).Set(1)
+	case unverified > 0:
+		log.Printf("CRL %s: signature does not verify against the issuer in any presented chain", url)
+		crlSignatureValid.WithLabelValues(url).Set(0)
+	default:
+		crlSignatureValid.DeleteLabelValues(url)
+	}
+}
+
+// Downloads all known CRLs once per interval, until ctx is done.
+// Newly discovered distribution points, and those of newly presented
+// certificates, get fetched within a minute.
+func (m *CRLMonitor) Run(ctx context.Context, events *EventLog, interval time.Duration) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		m.fetchDue(events, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testCRLURL = "http://crl.example.org/ca.crl"
+
+// Returns a CA certificate, its key, and a leaf issued by it that points
+// to testCRLURL.
+func testCRLChain(t *testing.T) (*x509.Certificate, crypto.Signer, *x509.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		Subject:               pkix.Name{CommonName: "example.org"},
+		DNSNames:              []string{"example.org"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		CRLDistributionPoints: []string{testCRLURL},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, caKey, leaf
+}
+
+// Returns a CRL for issuer that revokes serial, signed with key.
+func testCRL(t *testing.T, issuer *x509.Certificate, key crypto.Signer, serial int64) *x509.RevocationList {
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now,
+		NextUpdate: now.Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: big.NewInt(serial), RevocationTime: now},
+		},
+	}, issuer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
+
+func TestCRLRevocation(t *testing.T) {
+	ca, caKey, leaf := testCRLChain(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A CRL with the right issuer name, but signed by someone else,
+	// as a spoofing attacker could serve it.
+	forgerCA := *ca
+	forgerCA.PublicKey = otherKey.Public()
+
+	for _, tc := range []struct {
+		name      string
+		chain     []*x509.Certificate
+		crl       *x509.RevocationList
+		revoked   float64
+		signature float64
+	}{
+		{"revoked", []*x509.Certificate{leaf, ca}, testCRL(t, ca, caKey, 42), 1, 1},
+		{"not revoked", []*x509.Certificate{leaf, ca}, testCRL(t, ca, caKey, 7), 0, 1},
+		{"forged", []*x509.Certificate{leaf, ca}, testCRL(t, &forgerCA, otherKey, 42), 0, 0},
+		{"issuer missing", []*x509.Certificate{leaf}, testCRL(t, ca, caKey, 42), 0, 0},
+	} {
+		events, _ := NewEventLog(nil)
+		m := NewCRLMonitor([]string{testCRLURL}, false)
+		m.Observe("example.org", &CheckResult{Chain: tc.chain})
+		m.checkRevocations(events, testCRLURL, tc.crl)
+		if got := testutil.ToFloat64(crlRevoked.WithLabelValues("example.org")); got != tc.revoked {
+			t.Errorf("%s: got certmon_crl_revoked %v, want %v", tc.name, got, tc.revoked)
+		}
+		if got := testutil.ToFloat64(crlSignatureValid.WithLabelValues(testCRLURL)); got != tc.signature {
+			t.Errorf("%s: got certmon_crl_signature_valid %v, want %v", tc.name, got, tc.signature)
+		}
+		if got := len(events.Query("example.org", EventRevoked, time.Time{})); got != int(tc.revoked) {
+			t.Errorf("%s: got %d revoked events, want %v", tc.name, got, tc.revoked)
+		}
+		m.Forget("example.org")
+	}
+}
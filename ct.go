@@ -0,0 +1,504 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+var ctInclusionVerified = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ct_inclusion_verified",
+		Help:      "Whether an embedded SCT has a valid signature and a valid inclusion proof against the log's current signed tree head (1) or not (0), by domain name and log.",
+	},
+	[]string{
+		"domain",
+		"log",
+	},
+)
+
+// Default list of Certificate Transparency logs, as maintained by Google.
+const defaultCTLogList = "https://www.gstatic.com/ct/log_list/v3/log_list.json"
+
+// Extension carrying the embedded SCTs, from RFC 6962 section 3.3.
+var sctListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// A signed certificate timestamp, from RFC 6962 section 3.2.
+type SCT struct {
+	LogID      [32]byte
+	Timestamp  uint64
+	Extensions []byte
+	HashAlg    uint8
+	SigAlg     uint8
+	Signature  []byte
+}
+
+// A Certificate Transparency log, as found in the log list.
+type CTLog struct {
+	ID  [32]byte
+	URL string
+	MMD time.Duration
+	Key crypto.PublicKey
+
+	// Whether the log implements the static CT API, which has no
+	// endpoint for fetching inclusion proofs by hash.
+	Tiled bool
+}
+
+// Periodically verifies that the SCTs embedded in the certificates of
+// high-value targets actually refer to entries of the logs, by fetching
+// inclusion proofs against the logs' current signed tree heads. This
+// detects bogus SCTs, and logs that present different views.
+type CTVerifier struct {
+	listURL  string
+	interval time.Duration
+	client   *http.Client
+
+	mutex    sync.Mutex
+	logs     map[[32]byte]*CTLog
+	verified map[string]time.Time
+
+	// Log labels of the exported metrics, by domain.
+	exported map[string]map[string]bool
+}
+
+func NewCTVerifier(listURL string, interval time.Duration) *CTVerifier {
+	return &CTVerifier{
+		listURL:  listURL,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		verified: make(map[string]time.Time),
+		exported: make(map[string]map[string]bool),
+	}
+}
+
+// Fetches the log list, unless it has been fetched already.
+func (v *CTVerifier) loadLogs() (map[[32]byte]*CTLog, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.logs != nil {
+		return v.logs, nil
+	}
+
+	resp, err := v.client.Get(v.listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %d", v.listURL, resp.StatusCode)
+	}
+	type logEntry struct {
+		LogID         string `json:"log_id"`
+		Key           string `json:"key"`
+		URL           string `json:"url"`
+		SubmissionURL string `json:"submission_url"`
+		MMD           int    `json:"mmd"`
+	}
+	var list struct {
+		Operators []struct {
+			Logs      []logEntry `json:"logs"`
+			TiledLogs []logEntry `json:"tiled_logs"`
+		} `json:"operators"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	logs := make(map[[32]byte]*CTLog)
+	for _, op := range list.Operators {
+		entries := append(op.Logs, op.TiledLogs...)
+		for i, l := range entries {
+			id, err := base64.StdEncoding.DecodeString(l.LogID)
+			if err != nil || len(id) != 32 {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(l.Key)
+			if err != nil {
+				continue
+			}
+			key, err := x509.ParsePKIXPublicKey(der)
+			if err != nil {
+				continue
+			}
+			ctLog := &CTLog{
+				URL:   strings.TrimSuffix(l.URL+l.SubmissionURL, "/"),
+				MMD:   time.Duration(l.MMD) * time.Second,
+				Key:   key,
+				Tiled: i >= len(op.Logs),
+			}
+			copy(ctLog.ID[:], id)
+			logs[ctLog.ID] = ctLog
+		}
+	}
+	v.logs = logs
+	return logs, nil
+}
+
+// Verifies the embedded SCTs of a checked chain, if this has not been
+// done within the interval, and exports the results.
+func (v *CTVerifier) Observe(domain string, result *CheckResult) {
+	v.mutex.Lock()
+	due := time.Since(v.verified[domain]) >= v.interval
+	if due {
+		v.verified[domain] = time.Now()
+	}
+	v.mutex.Unlock()
+	if !due || len(result.Chain) < 2 {
+		return
+	}
+
+	leaf, issuer := result.Chain[0], result.Chain[1]
+	scts, err := EmbeddedSCTs(leaf)
+	if err != nil {
+		log.Printf("%s: embedded SCTs: %v", domain, err)
+		return
+	}
+	if len(scts) == 0 {
+		return
+	}
+	logs, err := v.loadLogs()
+	if err != nil {
+		log.Printf("CT log list: %v", err)
+		return
+	}
+	entry, err := precertEntry(leaf, issuer)
+	if err != nil {
+		log.Printf("%s: %v", domain, err)
+		return
+	}
+
+	for _, sct := range scts {
+		ctLog := logs[sct.LogID]
+		if ctLog == nil {
+			// An SCT from a log nobody knows about is as good as bogus.
+			label := base64.StdEncoding.EncodeToString(sct.LogID[:])
+			v.export(domain, label, false)
+			continue
+		}
+		// Logs need to incorporate entries only within their maximum
+		// merge delay, so younger SCTs cannot be verified yet.
+		issued := time.UnixMilli(int64(sct.Timestamp))
+		if time.Since(issued) < ctLog.MMD || ctLog.Tiled {
+			continue
+		}
+		err := v.verify(ctLog, sct, entry)
+		var fetchErr *ctFetchError
+		if errors.As(err, &fetchErr) {
+			log.Printf("%s: %v", domain, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("%s: SCT of %s: %v", domain, ctLog.URL, err)
+		}
+		v.export(domain, ctLog.URL, err == nil)
+	}
+}
+
+func (v *CTVerifier) export(domain, label string, verified bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.exported[domain] == nil {
+		v.exported[domain] = make(map[string]bool)
+	}
+	v.exported[domain][label] = true
+	ctInclusionVerified.WithLabelValues(domain, label).Set(boolToFloat(verified))
+}
+
+// Removes the metrics of a domain that is not verified anymore.
+func (v *CTVerifier) Forget(domain string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for label := range v.exported[domain] {
+		ctInclusionVerified.DeleteLabelValues(domain, label)
+	}
+	delete(v.exported, domain)
+	delete(v.verified, domain)
+}
+
+// Errors in talking to a log, which say nothing about the SCT itself.
+type ctFetchError struct {
+	err error
+}
+
+func (e *ctFetchError) Error() string { return e.err.Error() }
+
+func (v *CTVerifier) get(ctLog *CTLog, path string, out interface{}) error {
+	resp, err := v.client.Get(ctLog.URL + path)
+	if err != nil {
+		return &ctFetchError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Logs answer 400 when they do not know the requested entry.
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s: status %d", path, resp.StatusCode)
+		}
+		return &ctFetchError{fmt.Errorf("%s%s: status %d", ctLog.URL, path, resp.StatusCode)}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return &ctFetchError{err}
+	}
+	return nil
+}
+
+// Checks the signature of an SCT, fetches the current signed tree head
+// of its log and an inclusion proof for the entry, and verifies both.
+func (v *CTVerifier) verify(ctLog *CTLog, sct *SCT, entry []byte) error {
+	// The signed data of an SCT and the Merkle tree leaf share their
+	// layout, apart from what the first two bytes mean; both are zero.
+	var leaf bytes.Buffer
+	leaf.Write([]byte{0, 0})
+	binary.Write(&leaf, binary.BigEndian, sct.Timestamp)
+	leaf.Write(entry)
+	binary.Write(&leaf, binary.BigEndian, uint16(len(sct.Extensions)))
+	leaf.Write(sct.Extensions)
+	if err := verifySignature(ctLog.Key, sct.HashAlg, sct.SigAlg, leaf.Bytes(), sct.Signature); err != nil {
+		return fmt.Errorf("bad SCT signature: %v", err)
+	}
+
+	var sth struct {
+		TreeSize  uint64 `json:"tree_size"`
+		Timestamp uint64 `json:"timestamp"`
+		RootHash  []byte `json:"sha256_root_hash"`
+		Signature []byte `json:"tree_head_signature"`
+	}
+	if err := v.get(ctLog, "/ct/v1/get-sth", &sth); err != nil {
+		return err
+	}
+	if len(sth.RootHash) != sha256.Size {
+		return &ctFetchError{fmt.Errorf("%s: bad tree head", ctLog.URL)}
+	}
+	var signed bytes.Buffer
+	signed.Write([]byte{0, 1})
+	binary.Write(&signed, binary.BigEndian, sth.Timestamp)
+	binary.Write(&signed, binary.BigEndian, sth.TreeSize)
+	signed.Write(sth.RootHash)
+	hashAlg, sigAlg, sig, err := parseDigitallySigned(sth.Signature)
+	if err != nil {
+		return fmt.Errorf("bad tree head signature: %v", err)
+	}
+	if err := verifySignature(ctLog.Key, hashAlg, sigAlg, signed.Bytes(), sig); err != nil {
+		return fmt.Errorf("bad tree head signature: %v", err)
+	}
+
+	leafHash := sha256.Sum256(append([]byte{0}, leaf.Bytes()...))
+	var proof struct {
+		LeafIndex uint64   `json:"leaf_index"`
+		AuditPath [][]byte `json:"audit_path"`
+	}
+	query := fmt.Sprintf("/ct/v1/get-proof-by-hash?hash=%s&tree_size=%d",
+		url.QueryEscape(base64.StdEncoding.EncodeToString(leafHash[:])), sth.TreeSize)
+	if err := v.get(ctLog, query, &proof); err != nil {
+		return err
+	}
+	if !VerifyInclusion(leafHash[:], proof.LeafIndex, sth.TreeSize, proof.AuditPath, sth.RootHash) {
+		return errors.New("inclusion proof does not match tree head")
+	}
+	return nil
+}
+
+// Verifies a Merkle audit path, following RFC 9162 section 2.1.3.2.
+func VerifyInclusion(leafHash []byte, index, size uint64, path [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = hashChildren(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = hashChildren(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+func hashChildren(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Parses a DigitallySigned struct of RFC 5246 section 4.7.
+func parseDigitallySigned(data []byte) (hashAlg, sigAlg uint8, sig []byte, err error) {
+	s := cryptobyte.String(data)
+	var body cryptobyte.String
+	if !s.ReadUint8(&hashAlg) || !s.ReadUint8(&sigAlg) || !s.ReadUint16LengthPrefixed(&body) || !s.Empty() {
+		return 0, 0, nil, errors.New("malformed signature")
+	}
+	return hashAlg, sigAlg, body, nil
+}
+
+func verifySignature(key crypto.PublicKey, hashAlg, sigAlg uint8, data, sig []byte) error {
+	if hashAlg != 4 {
+		return fmt.Errorf("unsupported hash algorithm %d", hashAlg)
+	}
+	digest := sha256.Sum256(data)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if sigAlg != 3 || !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return errors.New("verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if sigAlg != 1 {
+			return errors.New("verification failed")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// Returns the SCTs embedded in a certificate.
+func EmbeddedSCTs(cert *x509.Certificate) ([]*SCT, error) {
+	var raw []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(sctListOID) {
+			if _, err := asn1.Unmarshal(ext.Value, &raw); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	var scts []*SCT
+	s := cryptobyte.String(raw)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) {
+		return nil, errors.New("malformed SCT list")
+	}
+	for !list.Empty() {
+		var item cryptobyte.String
+		var version uint8
+		var logID []byte
+		var ext, sig cryptobyte.String
+		sct := &SCT{}
+		if !list.ReadUint16LengthPrefixed(&item) ||
+			!item.ReadUint8(&version) ||
+			!item.ReadBytes(&logID, 32) ||
+			!item.ReadUint64(&sct.Timestamp) ||
+			!item.ReadUint16LengthPrefixed(&ext) ||
+			!item.ReadUint8(&sct.HashAlg) ||
+			!item.ReadUint8(&sct.SigAlg) ||
+			!item.ReadUint16LengthPrefixed(&sig) {
+			return nil, errors.New("malformed SCT")
+		}
+		if version != 0 {
+			continue
+		}
+		copy(sct.LogID[:], logID)
+		sct.Extensions, sct.Signature = ext, sig
+		scts = append(scts, sct)
+	}
+	return scts, nil
+}
+
+// Returns the precert_entry that the logs signed, from RFC 6962
+// section 3.2: entry type, issuer key hash, and the TBS certificate
+// without the SCT extension.
+func precertEntry(leaf, issuer *x509.Certificate) ([]byte, error) {
+	tbs, err := removeSCTExtension(leaf.RawTBSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	keyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	var b cryptobyte.Builder
+	b.AddUint16(1) // precert_entry
+	b.AddBytes(keyHash[:])
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(tbs)
+	})
+	return b.Bytes()
+}
+
+func removeSCTExtension(rawTBS []byte) ([]byte, error) {
+	input := cryptobyte.String(rawTBS)
+	var tbs cryptobyte.String
+	if !input.ReadASN1(&tbs, cbasn1.SEQUENCE) {
+		return nil, errors.New("malformed TBS certificate")
+	}
+	extensionsTag := cbasn1.Tag(3).Constructed().ContextSpecific()
+	malformed := false
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !tbs.Empty() {
+			var elem cryptobyte.String
+			var tag cbasn1.Tag
+			if !tbs.ReadAnyASN1Element(&elem, &tag) {
+				malformed = true
+				return
+			}
+			if tag != extensionsTag {
+				b.AddBytes(elem)
+				continue
+			}
+			var outer, exts cryptobyte.String
+			if !elem.ReadASN1(&outer, tag) || !outer.ReadASN1(&exts, cbasn1.SEQUENCE) {
+				malformed = true
+				return
+			}
+			b.AddASN1(tag, func(b *cryptobyte.Builder) {
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !exts.Empty() {
+						var ext, body cryptobyte.String
+						var oid asn1.ObjectIdentifier
+						if !exts.ReadASN1Element(&ext, cbasn1.SEQUENCE) {
+							malformed = true
+							return
+						}
+						e := ext
+						if !e.ReadASN1(&body, cbasn1.SEQUENCE) || !body.ReadASN1ObjectIdentifier(&oid) {
+							malformed = true
+							return
+						}
+						if !oid.Equal(sctListOID) {
+							b.AddBytes(ext)
+						}
+					}
+				})
+			})
+		}
+	})
+	if malformed {
+		return nil, errors.New("malformed TBS certificate")
+	}
+	return b.Bytes()
+}
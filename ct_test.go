@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Leaves of the test tree in RFC 6962 and RFC 9162 implementations,
+// such as certificate-transparency-go.
+var merkleTestLeaves = []string{
+	"", "00", "10", "2021", "3031", "40414243",
+	"5051525354555657", "606162636465666768696a6b6c6d6e6f",
+}
+
+// Root hashes of the test tree for sizes 1 to 8.
+var merkleTestRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func merkleLeafHash(t *testing.T, i int) []byte {
+	h := sha256.Sum256(append([]byte{0}, unhex(t, merkleTestLeaves[i])...))
+	return h[:]
+}
+
+// Returns the root hash of leaves[lo:hi], as defined in RFC 9162
+// section 2.1.1.
+func merkleRoot(t *testing.T, lo, hi int) []byte {
+	if hi-lo == 1 {
+		return merkleLeafHash(t, lo)
+	}
+	k := 1
+	for k*2 < hi-lo {
+		k *= 2
+	}
+	return hashChildren(merkleRoot(t, lo, lo+k), merkleRoot(t, lo+k, hi))
+}
+
+// Returns the audit path for leaf m in leaves[lo:hi], as defined in
+// RFC 9162 section 2.1.3.1.
+func merklePath(t *testing.T, m, lo, hi int) [][]byte {
+	if hi-lo == 1 {
+		return nil
+	}
+	k := 1
+	for k*2 < hi-lo {
+		k *= 2
+	}
+	if m < k {
+		return append(merklePath(t, m, lo, lo+k), merkleRoot(t, lo+k, hi))
+	}
+	return append(merklePath(t, m-k, lo+k, hi), merkleRoot(t, lo, lo+k))
+}
+
+func TestMerkleTestVectors(t *testing.T) {
+	for size := 1; size <= len(merkleTestLeaves); size++ {
+		if got := hex.EncodeToString(merkleRoot(t, 0, size)); got != merkleTestRoots[size-1] {
+			t.Errorf("root of size %d: got %s, want %s", size, got, merkleTestRoots[size-1])
+		}
+	}
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	for size := 1; size <= len(merkleTestLeaves); size++ {
+		root := unhex(t, merkleTestRoots[size-1])
+		for index := 0; index < size; index++ {
+			leaf := merkleLeafHash(t, index)
+			path := merklePath(t, index, 0, size)
+			if !VerifyInclusion(leaf, uint64(index), uint64(size), path, root) {
+				t.Errorf("leaf %d of %d: valid proof rejected", index, size)
+			}
+			for i := range path {
+				tampered := append([][]byte(nil), path...)
+				tampered[i] = append([]byte(nil), path[i]...)
+				tampered[i][0] ^= 1
+				if VerifyInclusion(leaf, uint64(index), uint64(size), tampered, root) {
+					t.Errorf("leaf %d of %d: proof with tampered element %d accepted", index, size, i)
+				}
+			}
+			if len(path) > 0 && VerifyInclusion(leaf, uint64(index), uint64(size), path[:len(path)-1], root) {
+				t.Errorf("leaf %d of %d: truncated proof accepted", index, size)
+			}
+			if VerifyInclusion(leaf, uint64(index), uint64(size), append(path, root), root) {
+				t.Errorf("leaf %d of %d: extended proof accepted", index, size)
+			}
+			if size > 1 && VerifyInclusion(leaf, uint64((index+1)%size), uint64(size), path, root) {
+				t.Errorf("leaf %d of %d: proof accepted for index %d", index, size, (index+1)%size)
+			}
+		}
+		if VerifyInclusion(merkleLeafHash(t, 0), uint64(size), uint64(size), nil, root) {
+			t.Errorf("size %d: index beyond size accepted", size)
+		}
+	}
+}
+
+// Audit paths as published with the test vectors, for checking the
+// reference implementation above.
+func TestVerifyInclusionKnownProofs(t *testing.T) {
+	for _, tc := range []struct {
+		index, size uint64
+		path        []string
+	}{
+		{0, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{5, 8, []string{
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 3, []string{
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		}},
+		{1, 5, []string{
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+		{7, 8, []string{
+			"b08693ec2e721597130641e8211e7eedccb4c26413963eee6c1e2ed16ffb1a5f",
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+	} {
+		var path [][]byte
+		for _, p := range tc.path {
+			path = append(path, unhex(t, p))
+		}
+		leaf := merkleLeafHash(t, int(tc.index))
+		root := unhex(t, merkleTestRoots[tc.size-1])
+		if !VerifyInclusion(leaf, tc.index, tc.size, path, root) {
+			t.Errorf("leaf %d of %d: published proof rejected", tc.index, tc.size)
+		}
+	}
+}
+
+func TestRemoveSCTExtension(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.org"},
+		DNSNames:     []string{"example.org"},
+		NotBefore:    time.Unix(1700000000, 0),
+		NotAfter:     time.Unix(1710000000, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	precert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.ExtraExtensions = []pkix.Extension{{Id: sctListOID, Value: []byte{0x04, 0x02, 0x00, 0x00}}}
+	der, err = x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := removeSCTExtension(cert.RawTBSCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, precert.RawTBSCertificate) {
+		t.Errorf("got TBS %x, want %x", got, precert.RawTBSCertificate)
+	}
+	if _, err := removeSCTExtension(cert.RawTBSCertificate[:len(cert.RawTBSCertificate)-3]); err == nil {
+		t.Errorf("truncated TBS accepted")
+	}
+}
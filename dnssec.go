@@ -0,0 +1,263 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dnssecSignatureExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "dnssec_signature_expiration_timestamp",
+		Help:      "Earliest expiration of the DNSSEC signatures (RRSIG records) over the records that the name of a target resolves through, in seconds since 1970-01-01 midnight UTC, by domain name and record type.",
+	},
+	[]string{
+		"domain",
+		"type",
+	},
+)
+
+var dnssecSigned = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "dnssec_signed",
+		Help:      "Whether the address records of a target came with DNSSEC signatures in the most recent check (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Record types whose signatures get exported, as they can occur in the
+// answer to a query for addresses.
+var dnssecTypes = map[uint16]string{
+	1:  "A",
+	5:  "CNAME",
+	28: "AAAA",
+	39: "DNAME",
+}
+
+const dnsTypeRRSIG = 46
+
+// DNS servers given by -resolver, or nil for those in /etc/resolv.conf.
+var defaultDNSServers []string
+
+// Returns the DNS server to ask about a target.
+func dnsServerFor(t *Target) string {
+	if len(t.Resolvers) > 0 {
+		return t.Resolvers[0]
+	}
+	if len(defaultDNSServers) > 0 {
+		return defaultDNSServers[0]
+	}
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+				return withDNSPort(fields[1])
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// Looks up the address records of a target with DNSSEC signatures, and
+// exports when the earliest signature for each record type expires.
+// Expired signatures make validating resolvers fail to resolve the
+// name, so the signatures get asked for with checking disabled.
+func checkDNSSEC(domain string, target Target) {
+	if net.ParseIP(target.Host) != nil {
+		return
+	}
+	server := dnsServerFor(&target)
+	expirations := make(map[uint16]time.Time)
+	for _, qtype := range []uint16{1, 28} {
+		sigs, err := querySignatures(server, target.Host, qtype, target.CheckTimeout())
+		if err != nil {
+			log.Printf("%s: DNSSEC: %v", domain, err)
+			return
+		}
+		for covered, exp := range sigs {
+			if old, ok := expirations[covered]; !ok || exp.Before(old) {
+				expirations[covered] = exp
+			}
+		}
+	}
+	dnssecSigned.WithLabelValues(domain).Set(boolToFloat(len(expirations) > 0))
+	for t, name := range dnssecTypes {
+		if exp, ok := expirations[t]; ok {
+			dnssecSignatureExpiration.WithLabelValues(domain, name).Set(float64(exp.Unix()))
+		} else {
+			dnssecSignatureExpiration.DeleteLabelValues(domain, name)
+		}
+	}
+}
+
+func deleteDNSSECMetrics(domain string) {
+	dnssecSigned.DeleteLabelValues(domain)
+	for _, name := range dnssecTypes {
+		dnssecSignatureExpiration.DeleteLabelValues(domain, name)
+	}
+}
+
+// Returns a DNS query for name and qtype, asking for DNSSEC records
+// (the DO bit in an EDNS0 OPT record) with checking disabled.
+func dnssecQuery(id uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0110) // recursion desired, checking disabled
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+	binary.BigEndian.PutUint16(msg[10:], 1)     // one additional record
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // IN
+
+	// An OPT record for the root name, with the UDP payload size in
+	// the class and the DNSSEC OK bit in the TTL.
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 41)
+	msg = binary.BigEndian.AppendUint16(msg, 1232)
+	return append(msg, 0, 0, 0x80, 0, 0, 0)
+}
+
+// Asks server for the records of name and qtype, and returns the
+// expiration of the earliest signature for each covered record type.
+// Truncated answers get asked for again over TCP.
+func querySignatures(server, name string, qtype uint16, timeout time.Duration) (map[uint16]time.Time, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query := dnssecQuery(id, name, qtype)
+	msg, err := exchangeDNS("udp", server, query, timeout)
+	if err == nil && len(msg) > 2 && msg[2]&0x02 != 0 {
+		msg, err = exchangeDNS("tcp", server, query, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDNSResponse(msg, id); err != nil {
+		return nil, err
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0, 3: // no error, name does not exist
+	default:
+		return nil, fmt.Errorf("DNS response code %d for %s", rcode, name)
+	}
+	return parseSignatures(msg)
+}
+
+func exchangeDNS(network, server string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, msg)
+	return msg, err
+}
+
+var errBadDNSMessage = errors.New("malformed DNS response")
+
+// Returns the offset after the possibly compressed name at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += n + 1
+		}
+	}
+	return 0, errBadDNSMessage
+}
+
+// Returns the expiration of the earliest RRSIG record in the answer
+// section of msg for each covered record type.
+func parseSignatures(msg []byte) (map[uint16]time.Time, error) {
+	if len(msg) < 12 {
+		return nil, errBadDNSMessage
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	result := make(map[uint16]time.Time)
+	for i := 0; i < answers; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errBadDNSMessage
+		}
+		rrtype := binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, errBadDNSMessage
+		}
+		rdata := msg[off : off+length]
+		off += length
+		if rrtype != dnsTypeRRSIG || len(rdata) < 18 {
+			continue
+		}
+		covered := binary.BigEndian.Uint16(rdata[0:])
+		exp := rrsigTime(binary.BigEndian.Uint32(rdata[8:]), time.Now())
+		if old, ok := result[covered]; !ok || exp.Before(old) {
+			result[covered] = exp
+		}
+	}
+	return result, nil
+}
+
+// Converts a time in an RRSIG record, which counts seconds since 1970
+// modulo 2^32, to the time closest to now (RFC 4034 section 3.1.5).
+func rrsigTime(t uint32, now time.Time) time.Time {
+	secs := now.Unix() + int64(int32(t-uint32(now.Unix())))
+	return time.Unix(secs, 0).UTC()
+}
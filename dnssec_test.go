@@ -0,0 +1,138 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Builds DNS responses in the shape that validating resolvers send,
+// with the owner names of answers compressed to the question name.
+type dnsResponseBuilder struct {
+	msg        []byte
+	answers    uint16
+	answersEnd int
+}
+
+func newDNSResponse(name string, qtype uint16) *dnsResponseBuilder {
+	b := &dnsResponseBuilder{msg: dnssecQuery(0x1234, name, qtype)}
+	b.msg = b.msg[:len(b.msg)-11] // no OPT record yet
+	binary.BigEndian.PutUint16(b.msg[2:], 0x8190)
+	binary.BigEndian.PutUint16(b.msg[10:], 0)
+	return b
+}
+
+func (b *dnsResponseBuilder) answer(name []byte, rrtype uint16, rdata []byte) {
+	b.msg = append(b.msg, name...)
+	b.msg = binary.BigEndian.AppendUint16(b.msg, rrtype)
+	b.msg = binary.BigEndian.AppendUint16(b.msg, 1)
+	b.msg = binary.BigEndian.AppendUint32(b.msg, 300)
+	b.msg = binary.BigEndian.AppendUint16(b.msg, uint16(len(rdata)))
+	b.msg = append(b.msg, rdata...)
+	b.answers += 1
+	binary.BigEndian.PutUint16(b.msg[6:], b.answers)
+	b.answersEnd = len(b.msg)
+}
+
+func (b *dnsResponseBuilder) rrsig(name []byte, covered uint16, expiration time.Time) {
+	rdata := binary.BigEndian.AppendUint16(nil, covered)
+	rdata = append(rdata, 13, 2)                      // ECDSAP256SHA256, two labels
+	rdata = binary.BigEndian.AppendUint32(rdata, 300) // original TTL
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(expiration.Unix()))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(expiration.Add(-14*24*time.Hour).Unix()))
+	rdata = binary.BigEndian.AppendUint16(rdata, 12345) // key tag
+	rdata = append(rdata, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r', 'g', 0)
+	rdata = append(rdata, make([]byte, 64)...) // signature
+	b.answer(name, dnsTypeRRSIG, rdata)
+}
+
+// Appends the OPT record that resolvers echo in the additional section.
+func (b *dnsResponseBuilder) opt() []byte {
+	binary.BigEndian.PutUint16(b.msg[10:], 1)
+	return append(b.msg, 0, 0, 41, 0x04, 0xd0, 0, 0, 0x80, 0, 0, 0)
+}
+
+var questionName = []byte{0xc0, 12}
+
+func TestParseSignatures(t *testing.T) {
+	soon := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second).UTC()
+	later := soon.Add(7 * 24 * time.Hour)
+
+	signed := newDNSResponse("example.org", 1)
+	signed.answer(questionName, 1, []byte{192, 0, 2, 1})
+	signed.rrsig(questionName, 1, later)
+	signed.rrsig(questionName, 1, soon)
+
+	// www.example.org is a CNAME for example.org, which comes as
+	// an uncompressed name.
+	cname := newDNSResponse("www.example.org", 1)
+	target := []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r', 'g', 0}
+	cname.answer(questionName, 5, []byte{0xc0, 16})
+	cname.rrsig(questionName, 5, later)
+	cname.answer(target, 1, []byte{192, 0, 2, 1})
+	cname.rrsig(target, 1, soon)
+
+	unsigned := newDNSResponse("example.org", 1)
+	unsigned.answer(questionName, 1, []byte{192, 0, 2, 1})
+
+	short := newDNSResponse("example.org", 1)
+	short.answer(questionName, dnsTypeRRSIG, []byte{0, 1, 13, 2})
+
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		want map[uint16]time.Time
+	}{
+		{"signed", signed.opt(), map[uint16]time.Time{1: soon}},
+		{"cname", cname.opt(), map[uint16]time.Time{1: soon, 5: later}},
+		{"unsigned", unsigned.opt(), map[uint16]time.Time{}},
+		{"short rrsig", short.opt(), map[uint16]time.Time{}},
+	} {
+		got, err := parseSignatures(tc.msg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+		for covered, exp := range tc.want {
+			if !got[covered].Equal(exp) {
+				t.Errorf("%s: type %d: got %v, want %v", tc.name, covered, got[covered], exp)
+			}
+		}
+	}
+
+	// Messages cut off before the end of the answers must fail, not
+	// panic or report partial results.
+	for _, b := range []*dnsResponseBuilder{signed, cname} {
+		for n := 0; n < b.answersEnd; n++ {
+			if got, err := parseSignatures(b.msg[:n]); err == nil {
+				t.Errorf("message truncated to %d bytes: got %v, want error", n, got)
+			}
+		}
+	}
+}
+
+func TestRRSIGTime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	wrap := time.Unix(1<<32, 0).UTC() // 2106-02-07T06:28:16Z
+	for _, tc := range []struct {
+		now, want time.Time
+	}{
+		{now, now},
+		{now, now.Add(30 * 24 * time.Hour)},
+		{now, now.Add(-30 * 24 * time.Hour)},
+		{now, now.Add(60 * 365 * 24 * time.Hour)},
+		{wrap.Add(-24 * time.Hour), wrap.Add(24 * time.Hour)},
+		{wrap.Add(24 * time.Hour), wrap.Add(-24 * time.Hour)},
+		{wrap.Add(24 * time.Hour), wrap.Add(30 * 24 * time.Hour)},
+	} {
+		if got := rrsigTime(uint32(tc.want.Unix()), tc.now); !got.Equal(tc.want) {
+			t.Errorf("rrsigTime(%d, %v) = %v, want %v", uint32(tc.want.Unix()), tc.now, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Returns a DNS query for the name servers of the root zone, which any
+// resolver can answer from its priming data.
+func dnsQuery(id uint16) []byte {
+	msg := make([]byte, 12, 17)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+	return append(msg, 0, 0, 2, 0, 1)           // ". IN NS"
+}
+
+// Checks that msg is a response to the query with the given ID. Any
+// response code is fine, since a resolver refusing the query still
+// shows that it speaks DNS.
+func checkDNSResponse(msg []byte, id uint16) error {
+	if len(msg) < 12 {
+		return fmt.Errorf("DNS response too short")
+	}
+	if binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return fmt.Errorf("not a response to the DNS query")
+	}
+	return nil
+}
+
+// Performs a TLS handshake with a DNS-over-TLS resolver, and checks that
+// it answers a query over the connection.
+func dnsOverTLS(dial dialFunc, addr string, config *tls.Config, timeout time.Duration) (tls.ConnectionState, error) {
+	config = config.Clone()
+	config.NextProtos = []string{"dot"}
+	conn, err := dialTLS(dial, addr, config, timeout)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	state := conn.ConnectionState()
+
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsQuery(id)
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return state, fmt.Errorf("DNS query: %w", err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return state, fmt.Errorf("DNS query: %w", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return state, fmt.Errorf("DNS query: %w", err)
+	}
+	return state, checkDNSResponse(msg, id)
+}
+
+// Performs a TLS handshake with a DNS-over-HTTPS resolver, and checks
+// that it answers a query at /dns-query, the path suggested by RFC 8484.
+func dnsOverHTTPS(dial dialFunc, addr string, config *tls.Config, timeout time.Duration) (tls.ConnectionState, error) {
+	config = config.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	conn, err := dialTLS(dial, addr, config, timeout)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	state := conn.ConnectionState()
+
+	id := uint16(rand.Intn(1 << 16))
+	req, err := http.NewRequest(http.MethodGet, "https://"+config.ServerName+"/dns-query?dns="+
+		base64.RawURLEncoding.EncodeToString(dnsQuery(id)), nil)
+	if err != nil {
+		return state, err
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return state, fmt.Errorf("DNS query: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return state, fmt.Errorf("DNS query: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("DNS query: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/dns-message") {
+		return state, fmt.Errorf("DNS query: unexpected content type %q", ct)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return state, fmt.Errorf("DNS query: %w", err)
+	}
+	return state, checkDNSResponse(msg, id)
+}
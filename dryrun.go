@@ -0,0 +1,267 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme"
+)
+
+// Directory of the Let's Encrypt staging environment, whose certificates
+// are not trusted by browsers and whose rate limits are generous.
+const letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+var acmeDryRunSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "acme_dry_run_success",
+		Help:      "Whether the most recent end-to-end renewal dry run succeeded (1) or failed (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var acmeDryRunTimestamp = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "acme_dry_run_timestamp",
+		Help:      "When the most recent end-to-end renewal dry run finished, in seconds since 1970-01-01 midnight UTC, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Publishes and removes the TXT records for DNS-01 challenges.
+type DNSProvider interface {
+	// Creates a TXT record with value at fqdn, such as
+	// "_acme-challenge.example.org.", and returns once it is visible
+	// to the ACME server.
+	Present(ctx context.Context, fqdn, value string) error
+
+	// Removes the TXT record again.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// Constructors for DNS providers, by name. The argument is whatever
+// follows the name in the -acme-dry-run-dns flag.
+var dnsProviders = map[string]func(arg string) (DNSProvider, error){
+	"exec": newExecDNSProvider,
+}
+
+// Parses a DNS provider specification, such as "exec:/usr/local/bin/dns-hook".
+func ParseDNSProvider(spec string) (DNSProvider, error) {
+	name, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	newProvider, ok := dnsProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown DNS provider %q", name)
+	}
+	return newProvider(arg)
+}
+
+// Runs an external command as "<command> present|cleanup <fqdn> <value>",
+// in the style of the manual hooks of other ACME clients. The command is
+// expected to wait for the record to propagate before exiting.
+type execDNSProvider struct {
+	command string
+}
+
+func newExecDNSProvider(command string) (DNSProvider, error) {
+	if command == "" {
+		return nil, fmt.Errorf("exec DNS provider needs a command")
+	}
+	return &execDNSProvider{command: command}, nil
+}
+
+func (p *execDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", p.command, action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// Parses external account binding credentials in the form
+// "<key id>:<base64url-encoded MAC key>", as handed out by CAs
+// that require an existing customer account.
+func ParseExternalAccountBinding(s string) (*acme.ExternalAccountBinding, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("expected keyid:key")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[i+1:], "="))
+	if err != nil {
+		return nil, err
+	}
+	return &acme.ExternalAccountBinding{KID: s[:i], Key: key}, nil
+}
+
+// Periodically obtains a certificate for selected domains from an ACME
+// server, usually a staging environment, solving DNS-01 challenges
+// through a DNS provider. This verifies that the renewal pipeline still
+// works end to end, not just that the current certificate is valid.
+type RenewalDryRun struct {
+	domains  []string
+	provider DNSProvider
+	eab      *acme.ExternalAccountBinding
+	client   *acme.Client
+
+	// Whether the account key has been registered; only accessed by Run.
+	registered bool
+}
+
+func NewRenewalDryRun(directoryURL string, domains []string, provider DNSProvider, eab *acme.ExternalAccountBinding) (*RenewalDryRun, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &RenewalDryRun{
+		domains:  domains,
+		provider: provider,
+		eab:      eab,
+		client:   &acme.Client{Key: key, DirectoryURL: directoryURL},
+	}, nil
+}
+
+func (d *RenewalDryRun) register(ctx context.Context) error {
+	if d.registered {
+		return nil
+	}
+	_, err := d.client.Register(ctx, &acme.Account{ExternalAccountBinding: d.eab}, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	d.registered = true
+	return nil
+}
+
+// Obtains a certificate for domain, and revokes it right away.
+func (d *RenewalDryRun) Check(ctx context.Context, domain string) error {
+	if err := d.register(ctx); err != nil {
+		return fmt.Errorf("registering account: %w", err)
+	}
+
+	client := d.client
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		if err := d.solve(ctx, authz); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, false)
+	if err != nil {
+		return err
+	}
+
+	// The certificate only served as proof; don't leave it lying around.
+	if err := client.RevokeCert(ctx, key, der[0], acme.CRLReasonCessationOfOperation); err != nil {
+		log.Printf("dry run %s: revoking certificate: %v", domain, err)
+	}
+	return nil
+}
+
+func (d *RenewalDryRun) solve(ctx context.Context, authz *acme.Authorization) error {
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s: no dns-01 challenge offered", authz.Identifier.Value)
+	}
+
+	value, err := d.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+	if err := d.provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := d.provider.CleanUp(ctx, fqdn, value); err != nil {
+			log.Printf("dry run %s: %v", authz.Identifier.Value, err)
+		}
+	}()
+
+	if _, err := d.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = d.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// Runs a dry run for each domain once per interval, until ctx is done.
+func (d *RenewalDryRun) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, domain := range d.domains {
+			checkCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+			err := d.Check(checkCtx, domain)
+			cancel()
+			if err != nil {
+				log.Printf("dry run %s: %v", domain, err)
+			}
+			acmeDryRunSuccess.WithLabelValues(domain).Set(boolToFloat(err == nil))
+			acmeDryRunTimestamp.WithLabelValues(domain).Set(float64(time.Now().Unix()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
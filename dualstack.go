@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ipVersionCheckSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ip_version_check_success",
+		Help:      "Whether the most recent check over IPv4 or IPv6 succeeded (1) or failed (0), by domain name and IP version.",
+	},
+	[]string{
+		"domain",
+		"ip_version",
+	},
+)
+
+var ipVersionCertExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ip_version_tls_certificate_expiration_timestamp",
+		Help:      "TLS certificate expiration dates served over IPv4 or IPv6, in seconds since 1970-01-01 midnight UTC, by domain name and IP version.",
+	},
+	[]string{
+		"domain",
+		"ip_version",
+	},
+)
+
+var ipVersionHandshakeDuration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ip_version_handshake_duration_seconds",
+		Help:      "Time to connect and complete the TLS handshake in the most recent check over IPv4 or IPv6, by domain name and IP version.",
+	},
+	[]string{
+		"domain",
+		"ip_version",
+	},
+)
+
+// IP versions, with the networks for looking them up.
+var ipVersions = []struct{ name, network string }{
+	{"4", "ip4"},
+	{"6", "ip6"},
+}
+
+// Checks the certificate of a target on its first port over IPv4 and
+// IPv6 separately, since a stale certificate on one of them goes unseen
+// by clients that happen to prefer the other. Versions for which the
+// name has no addresses are not exported.
+func checkDualStack(domain string, target Target) {
+	if net.ParseIP(target.Host) != nil {
+		return
+	}
+	for _, v := range ipVersions {
+		countLookup()
+		ctx, cancel := context.WithTimeout(context.Background(), target.CheckTimeout())
+		ips, _ := target.DNSResolver().LookupIP(ctx, v.network, target.Host)
+		cancel()
+		if len(ips) == 0 {
+			// Failures to resolve the name at all get reported
+			// by the main check.
+			deleteIPVersionMetrics(domain, v.name)
+			continue
+		}
+		var result *CheckResult
+		var err error
+		start := time.Now()
+		for _, ip := range ips {
+			result, err = checkCertificateAt(net.DefaultResolver, target.ProxyURL(target.Ports[0]), target.Host, ip.String(), target.Ports[0], target.Protocol, target.TLSConfig(), target.CheckConnectTimeout(), target.CheckTimeout())
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) || opErr.Op != "dial" {
+				break
+			}
+		}
+		ipVersionCheckSuccess.WithLabelValues(domain, v.name).Set(boolToFloat(err == nil))
+		if err != nil {
+			log.Printf("%s: IPv%s: %v", domain, v.name, err)
+			ipVersionCertExpiration.DeleteLabelValues(domain, v.name)
+			ipVersionHandshakeDuration.DeleteLabelValues(domain, v.name)
+			continue
+		}
+		ipVersionHandshakeDuration.WithLabelValues(domain, v.name).Set(time.Since(start).Seconds())
+		ipVersionCertExpiration.WithLabelValues(domain, v.name).Set(float64(result.Expiration.Unix()))
+	}
+}
+
+func deleteIPVersionMetrics(domain, version string) {
+	ipVersionCheckSuccess.DeleteLabelValues(domain, version)
+	ipVersionCertExpiration.DeleteLabelValues(domain, version)
+	ipVersionHandshakeDuration.DeleteLabelValues(domain, version)
+}
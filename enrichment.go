@@ -0,0 +1,398 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var registrationExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "domain_registration_expiration_timestamp",
+		Help:      "When the registration of the domain name that a target belongs to expires according to RDAP, in seconds since 1970-01-01 midnight UTC, by domain name of the target.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Where IANA publishes which RDAP servers are responsible for which
+// top-level domains, as specified in RFC 9224.
+const rdapBootstrapURL = "https://data.iana.org/rdap/dns.json"
+
+var rdapClient = &http.Client{Timeout: 30 * time.Second}
+
+var errNotRegistered = errors.New("not registered")
+
+// Registration of a domain name, as published by its registry over RDAP.
+type Registration struct {
+	// The registered domain, such as "example.co.uk" for a target
+	// named "www.example.co.uk".
+	Domain     string
+	Registrar  string
+	Expiration time.Time
+}
+
+// Enriches the targets with data from outside their TLS servers: the
+// reverse DNS names of the addresses they were reached at, and the
+// registration of their domain names, since registrations lapse too.
+type Enricher struct {
+	interval time.Duration
+
+	// Days before the expiration of a registration at which to log
+	// an event, largest first.
+	thresholds []int
+
+	mutex sync.Mutex
+
+	// RDAP base URLs by top-level domain, from the IANA bootstrap file.
+	servers map[string]string
+
+	// Registrations by target domain, and reverse DNS names by address.
+	registrations map[string]*Registration
+	names         map[string][]string
+
+	// When the registration of each target domain, and the names of
+	// each address, were last looked up, successfully or not.
+	domainsLookedUp map[string]time.Time
+	addrsLookedUp   map[string]time.Time
+
+	// Smallest threshold crossed by each registered domain, in days.
+	crossed map[string]int
+}
+
+// Creates an enricher that looks up the data for each target and
+// address once per interval, and logs an event when a registration
+// expires in less than one of the thresholds, given in days.
+func NewEnricher(interval time.Duration, thresholds []int) *Enricher {
+	thresholds = append([]int(nil), thresholds...)
+	sort.Sort(sort.Reverse(sort.IntSlice(thresholds)))
+	return &Enricher{
+		interval:        interval,
+		thresholds:      thresholds,
+		crossed:         make(map[string]int),
+		registrations:   make(map[string]*Registration),
+		names:           make(map[string][]string),
+		domainsLookedUp: make(map[string]time.Time),
+		addrsLookedUp:   make(map[string]time.Time),
+	}
+}
+
+// Looks up new targets and addresses every minute, and refreshes the
+// data once per interval, until ctx is done.
+func (e *Enricher) Run(ctx context.Context, cm *CertMon) {
+	// Do not log threshold crossings again that were logged before
+	// a restart.
+	events := cm.opts.Events
+	e.mutex.Lock()
+	for _, ev := range events.Query("", EventRegistrationThresholdCrossed, time.Time{}) {
+		var domain string
+		var days int
+		if _, err := fmt.Sscanf(ev.Message, registrationThresholdMessage, &domain, &days); err == nil {
+			e.crossed[domain] = days
+		}
+	}
+	e.mutex.Unlock()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		e.enrich(ctx, events, cm.connectedAddresses())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the monitored domains, with the addresses that their most
+// recent successful checks connected to.
+func (cm *CertMon) connectedAddresses() map[string][]string {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	result := make(map[string][]string, len(cm.domains))
+	for domain, status := range cm.domains {
+		addrs := make([]string, 0, len(status.addresses))
+		for _, addr := range status.addresses {
+			addrs = append(addrs, addr)
+		}
+		result[domain] = addrs
+	}
+	return result
+}
+
+// Returns whether the data for key is due for a lookup, and if so,
+// notes that it is being looked up now.
+func (e *Enricher) due(lookedUp map[string]time.Time, key string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if time.Since(lookedUp[key]) < e.interval {
+		return false
+	}
+	lookedUp[key] = time.Now()
+	return true
+}
+
+func (e *Enricher) enrich(ctx context.Context, events *EventLog, targets map[string][]string) {
+	// Subdomains of the same registered domain are common, so ask
+	// the registry only once for every name.
+	found := make(map[string]*Registration)
+	for domain, addrs := range targets {
+		for _, addr := range addrs {
+			if e.due(e.addrsLookedUp, addr) {
+				names, _ := net.DefaultResolver.LookupAddr(ctx, addr)
+				e.mutex.Lock()
+				e.names[addr] = names
+				e.mutex.Unlock()
+			}
+		}
+		// Single-label names, such as localhost, cannot be registered.
+		if net.ParseIP(domain) != nil || !strings.Contains(domain, ".") || !e.due(e.domainsLookedUp, domain) {
+			continue
+		}
+		reg, err := e.lookupRegistration(ctx, domain, found)
+		if err != nil {
+			log.Printf("%s: RDAP: %v", domain, err)
+			continue
+		}
+		e.mutex.Lock()
+		e.registrations[domain] = reg
+		if !reg.Expiration.IsZero() {
+			registrationExpiration.WithLabelValues(domain).Set(float64(reg.Expiration.Unix()))
+			e.observeExpiration(events, reg)
+		} else {
+			registrationExpiration.DeleteLabelValues(domain)
+		}
+		e.mutex.Unlock()
+	}
+
+	// Forget removed targets.
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for domain := range e.domainsLookedUp {
+		if _, ok := targets[domain]; !ok {
+			delete(e.domainsLookedUp, domain)
+			delete(e.registrations, domain)
+			registrationExpiration.DeleteLabelValues(domain)
+		}
+	}
+}
+
+// Logs an event when the remaining time of a registration falls below
+// a smaller threshold than before. Targets that share a registered
+// domain share its threshold crossings, so each gets logged only once.
+// A renewal resets the crossings. The caller must hold e.mutex.
+func (e *Enricher) observeExpiration(events *EventLog, reg *Registration) {
+	remaining := time.Until(reg.Expiration)
+	crossed := 0
+	for _, days := range e.thresholds {
+		if remaining < time.Duration(days)*24*time.Hour {
+			crossed = days
+		}
+	}
+	previous := e.crossed[reg.Domain]
+	if crossed != 0 && (previous == 0 || crossed < previous) {
+		events.Record(Event{
+			Type:    EventRegistrationThresholdCrossed,
+			Domain:  reg.Domain,
+			Message: fmt.Sprintf(registrationThresholdMessage, reg.Domain, crossed),
+		})
+	}
+	e.crossed[reg.Domain] = crossed
+}
+
+// Returns the registration of the domain name that a target belongs
+// to. Without a list of public suffixes, the registered domain is the
+// longest parent of the name that the registry knows about.
+func (e *Enricher) lookupRegistration(ctx context.Context, name string, found map[string]*Registration) (*Registration, error) {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	if len(labels) < 2 {
+		return nil, errNotRegistered
+	}
+	server, err := e.rdapServer(ctx, labels[len(labels)-1])
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(labels)-1; i++ {
+		candidate := strings.Join(labels[i:], ".")
+		reg, ok := found[candidate]
+		if !ok {
+			reg, err = queryRDAP(ctx, server, candidate)
+			if err != nil && err != errNotRegistered {
+				return nil, err
+			}
+			found[candidate] = reg
+		}
+		if reg != nil {
+			return reg, nil
+		}
+	}
+	return nil, errNotRegistered
+}
+
+// Returns the base URL of the RDAP server for a top-level domain,
+// fetching the IANA bootstrap file the first time.
+func (e *Enricher) rdapServer(ctx context.Context, tld string) (string, error) {
+	e.mutex.Lock()
+	servers := e.servers
+	e.mutex.Unlock()
+	if servers == nil {
+		var err error
+		if servers, err = fetchRDAPBootstrap(ctx); err != nil {
+			return "", err
+		}
+		e.mutex.Lock()
+		e.servers = servers
+		e.mutex.Unlock()
+	}
+	server, ok := servers[tld]
+	if !ok {
+		return "", fmt.Errorf("no RDAP server for .%s", tld)
+	}
+	return server, nil
+}
+
+func fetchRDAPBootstrap(ctx context.Context) (map[string]string, error) {
+	var bootstrap struct {
+		Services [][][]string `json:"services"`
+	}
+	if err := getRDAP(ctx, rdapBootstrapURL, &bootstrap); err != nil {
+		return nil, err
+	}
+	servers := make(map[string]string)
+	for _, service := range bootstrap.Services {
+		if len(service) != 2 || len(service[1]) == 0 {
+			continue
+		}
+		// Prefer HTTPS if a registry lists several URLs.
+		url := service[1][0]
+		for _, u := range service[1] {
+			if strings.HasPrefix(u, "https:") {
+				url = u
+				break
+			}
+		}
+		if !strings.HasSuffix(url, "/") {
+			url += "/"
+		}
+		for _, tld := range service[0] {
+			servers[strings.ToLower(tld)] = url
+		}
+	}
+	return servers, nil
+}
+
+// Asks an RDAP server about a domain name. Returns errNotRegistered
+// if the server does not know the name.
+func queryRDAP(ctx context.Context, server, domain string) (*Registration, error) {
+	var resp struct {
+		LDHName string `json:"ldhName"`
+		Events  []struct {
+			Action string    `json:"eventAction"`
+			Date   time.Time `json:"eventDate"`
+		} `json:"events"`
+		Entities []struct {
+			Roles []string        `json:"roles"`
+			VCard json.RawMessage `json:"vcardArray"`
+		} `json:"entities"`
+	}
+	if err := getRDAP(ctx, server+"domain/"+domain, &resp); err != nil {
+		return nil, err
+	}
+	reg := &Registration{Domain: strings.ToLower(resp.LDHName)}
+	if reg.Domain == "" {
+		reg.Domain = domain
+	}
+	for _, event := range resp.Events {
+		if event.Action == "expiration" {
+			reg.Expiration = event.Date
+		}
+	}
+	for _, entity := range resp.Entities {
+		if contains(entity.Roles, "registrar") {
+			reg.Registrar = vcardName(entity.VCard)
+		}
+	}
+	return reg, nil
+}
+
+func getRDAP(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+	resp, err := rdapClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotRegistered
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Returns the formatted name in a jCard (RFC 7095), which looks like
+// ["vcard", [["version", {}, "text", "4.0"], ["fn", {}, "text", "Name"]]].
+func vcardName(data json.RawMessage) string {
+	var card []interface{}
+	if json.Unmarshal(data, &card) != nil || len(card) != 2 {
+		return ""
+	}
+	props, _ := card[1].([]interface{})
+	for _, p := range props {
+		prop, _ := p.([]interface{})
+		if len(prop) == 4 && prop[0] == "fn" {
+			name, _ := prop[3].(string)
+			return name
+		}
+	}
+	return ""
+}
+
+// Returns the registration of the domain name of a target, or nil if
+// it is not known.
+func (e *Enricher) Registration(domain string) *Registration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.registrations[domain]
+}
+
+// Returns the reverse DNS names of addresses, sorted and without
+// duplicates.
+func (e *Enricher) ReverseNames(addrs []string) []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	seen := make(map[string]bool)
+	var result []string
+	for _, addr := range addrs {
+		for _, name := range e.names[addr] {
+			name = strings.TrimSuffix(name, ".")
+			if !seen[name] {
+				seen[name] = true
+				result = append(result, name)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,261 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Types of events recorded in the event log.
+const (
+	EventTargetAdded      = "target_added"
+	EventTargetRemoved    = "target_removed"
+	EventThresholdCrossed = "threshold_crossed"
+	EventRenewalDetected  = "renewal_detected"
+	EventRenewalOverdue   = "renewal_overdue"
+	EventCheckFailed      = "check_failed"
+	EventCheckRecovered   = "check_recovered"
+	EventPortMismatch     = "port_mismatch"
+	EventHostnameMismatch = "hostname_mismatch"
+	EventStaleDeployment  = "stale_deployment"
+	EventSnoozed          = "snoozed"
+	EventAddressChanged   = "address_changed"
+	EventUnresolvable     = "unresolvable"
+	EventLargeChain       = "large_chain"
+	EventIssuerChanged    = "issuer_changed"
+	EventWeakKey          = "weak_key"
+	EventRevoked          = "revoked"
+	EventCARevoked        = "ca_revoked"
+
+	EventCertificateObserved = "certificate_observed"
+	EventValidationChanged   = "validation_changed"
+	EventConfigReloaded      = "config_reloaded"
+	EventConfigReloadFailed  = "config_reload_failed"
+
+	EventStapleThresholdCrossed       = "ocsp_staple_threshold_crossed"
+	EventRegistrationThresholdCrossed = "registration_threshold_crossed"
+)
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Domain  string    `json:"domain,omitempty"`
+	Message string    `json:"message,omitempty"`
+
+	// For renewals, the expiration times of the old and new certificate.
+	OldExpiration *time.Time `json:"old_expiration,omitempty"`
+	NewExpiration *time.Time `json:"new_expiration,omitempty"`
+
+	// For snoozes, until when the target is snoozed; nil if a snooze
+	// was lifted.
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty"`
+
+	// For observations, the certificate seen for the first time.
+	Certificate *ObservedCertificate `json:"certificate,omitempty"`
+
+	// For configuration reloads, the hosts that got added and removed.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+
+	// Position in the log, counting events that were dropped from
+	// memory, for the cursors of /api/v1/changes.
+	seq int
+}
+
+// Events that no state gets replayed from, and of which only the most
+// recent maxTransientEvents are kept in memory. The store keeps them all.
+var transientEvents = map[string]bool{
+	EventAddressChanged: true,
+}
+
+const maxTransientEvents = 10000
+
+// An append-only log of things that happened to the monitored targets.
+// If the log has a store, events get appended to it, and earlier events
+// are read back at startup.
+type EventLog struct {
+	mutex     sync.Mutex
+	events    []Event
+	store     EventStore
+	forwarder *SyslogForwarder
+
+	// Position of the next event, and the number of transient events
+	// in memory.
+	next, transient int
+}
+
+// Creates an event log backed by store, which may be nil for keeping
+// events in memory only.
+func NewEventLog(store EventStore) (*EventLog, error) {
+	el := &EventLog{store: store}
+	if store == nil {
+		return el, nil
+	}
+	events, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		el.add(e)
+	}
+	return el, nil
+}
+
+// Appends an event to the in-memory log, dropping the oldest transient
+// event if there are too many. The caller must hold el.mutex, or not
+// have shared the log yet.
+func (el *EventLog) add(e Event) {
+	e.seq = el.next
+	el.next += 1
+	el.events = append(el.events, e)
+	if !transientEvents[e.Type] {
+		return
+	}
+	el.transient += 1
+	if el.transient <= maxTransientEvents {
+		return
+	}
+	for i := range el.events {
+		if transientEvents[el.events[i].Type] {
+			el.events = append(el.events[:i], el.events[i+1:]...)
+			el.transient -= 1
+			return
+		}
+	}
+}
+
+// Forwards the security-relevant events recorded from now on to a SIEM.
+func (el *EventLog) SetForwarder(f *SyslogForwarder) {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	el.forwarder = f
+}
+
+// Appends an event to the log. If the event has no time, it gets
+// stamped with the current time.
+func (el *EventLog) Record(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	el.mutex.Lock()
+	forwarder := el.forwarder
+	el.mutex.Unlock()
+	if forwarder != nil {
+		if err := forwarder.Forward(e); err != nil {
+			log.Printf("forwarding %s event to syslog: %v", e.Type, err)
+		}
+	}
+
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	el.add(e)
+	if el.store == nil {
+		return nil
+	}
+	return el.store.Append(e)
+}
+
+// Stops appending events to the store, and closes it if it needs
+// closing. Events recorded afterwards only stay in memory.
+func (el *EventLog) Close() error {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	store := el.store
+	el.store = nil
+	if c, ok := store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Returns the logged events matching domain and type, at or after since.
+// Empty strings and the zero time match everything.
+func (el *EventLog) Query(domain, eventType string, since time.Time) []Event {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	result := make([]Event, 0)
+	for _, e := range el.events {
+		if domain != "" && e.Domain != domain {
+			continue
+		}
+		if eventType != "" && e.Type != eventType {
+			continue
+		}
+		if e.Time.Before(since) {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// Returns the set of domains that were added, and not removed afterwards,
+// according to the logged events.
+func (el *EventLog) KnownTargets() map[string]bool {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	known := make(map[string]bool)
+	for _, e := range el.events {
+		switch e.Type {
+		case EventTargetAdded:
+			known[e.Domain] = true
+		case EventTargetRemoved:
+			delete(known, e.Domain)
+		}
+	}
+	return known
+}
+
+// Returns until when each domain is snoozed, according to the most
+// recent snooze event for it. Lifted snoozes are left out.
+func (el *EventLog) Snoozes() map[string]time.Time {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	snoozes := make(map[string]time.Time)
+	for _, e := range el.events {
+		if e.Type != EventSnoozed {
+			continue
+		}
+		if e.SnoozedUntil != nil {
+			snoozes[e.Domain] = *e.SnoozedUntil
+		} else {
+			delete(snoozes, e.Domain)
+		}
+	}
+	return snoozes
+}
+
+// Serves the event log as JSON, optionally filtered by the query
+// parameters domain, type and since (in RFC 3339 format).
+func (el *EventLog) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "bad value for since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	events := el.Query(q.Get("domain"), q.Get("type"), since)
+	w.Header().Set("Content-Type", "application/json")
+	if q.Get("download") != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="certmon-events.json"`)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(events)
+}
@@ -0,0 +1,170 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var fileCertExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "file_certificate_expiration_timestamp",
+		Help:      "Expiration dates of certificates stored in files, in seconds since 1970-01-01 midnight UTC, by path, subject common name and purpose.",
+	},
+	[]string{
+		"path",
+		"subject",
+		"purpose",
+	},
+)
+
+var purposeExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "purpose_earliest_expiration_timestamp",
+		Help:      "Earliest expiration date among the certificates stored in files, in seconds since 1970-01-01 midnight UTC, by purpose.",
+	},
+	[]string{
+		"purpose",
+	},
+)
+
+var extKeyUsagePurposes = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "serverAuth",
+	x509.ExtKeyUsageClientAuth:      "clientAuth",
+	x509.ExtKeyUsageCodeSigning:     "codeSigning",
+	x509.ExtKeyUsageEmailProtection: "emailProtection",
+	x509.ExtKeyUsageTimeStamping:    "timeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+// Classifies a certificate by its extended key usages. Certificate
+// authorities are reported as "ca", and certificates without extended
+// key usage as "unspecified".
+func CertificatePurposes(cert *x509.Certificate) []string {
+	if cert.IsCA {
+		return []string{"ca"}
+	}
+	var purposes []string
+	for _, usage := range cert.ExtKeyUsage {
+		if p, ok := extKeyUsagePurposes[usage]; ok {
+			purposes = append(purposes, p)
+		}
+	}
+	if len(purposes) == 0 {
+		purposes = append(purposes, "unspecified")
+	}
+	return purposes
+}
+
+// Reads all certificates from a file, which may contain a sequence of
+// PEM blocks or a single DER-encoded certificate.
+func ReadCertificateFile(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// Monitors certificates that live on disk, such as S/MIME or code
+// signing certificates that never get served on a TLS listener.
+type FileSource struct {
+	patterns []string
+}
+
+func NewFileSource(patterns []string) *FileSource {
+	return &FileSource{patterns: patterns}
+}
+
+// Reads all files matching the glob patterns, and exports the
+// expiration dates of the certificates found.
+func (fs *FileSource) Scan() {
+	type entry struct {
+		path, subject, purpose string
+		expiration             time.Time
+	}
+	var entries []entry
+	earliest := make(map[string]time.Time)
+	for _, pattern := range fs.patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("bad file pattern %q: %v", pattern, err)
+			continue
+		}
+		for _, path := range paths {
+			certs, err := ReadCertificateFile(path)
+			if err != nil {
+				log.Printf("reading certificates: %s: %v", path, err)
+				continue
+			}
+			for _, cert := range certs {
+				for _, purpose := range CertificatePurposes(cert) {
+					entries = append(entries, entry{path, cert.Subject.CommonName, purpose, cert.NotAfter})
+					if e, ok := earliest[purpose]; !ok || cert.NotAfter.Before(e) {
+						earliest[purpose] = cert.NotAfter
+					}
+				}
+			}
+		}
+	}
+
+	// Files may have disappeared since the last scan.
+	fileCertExpiration.Reset()
+	purposeExpiration.Reset()
+	for _, e := range entries {
+		fileCertExpiration.WithLabelValues(e.path, e.subject, e.purpose).Set(float64(e.expiration.Unix()))
+	}
+	for purpose, exp := range earliest {
+		purposeExpiration.WithLabelValues(purpose).Set(float64(exp.Unix()))
+	}
+}
+
+// Scans the files once per interval, until ctx is done.
+func (fs *FileSource) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fs.Scan()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
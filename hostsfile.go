@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reads additional targets from a file, one specification per line,
+// and keeps the monitored targets in sync when the file changes. This
+// suits Kubernetes, where a ConfigMap mounted as a volume gets updated
+// in place, without needing a sidecar to restart certmon.
+type HostsFile struct {
+	path   string
+	static string
+	views  map[string]*DNSView
+
+	// Contents of the file when the targets were last read.
+	mutex sync.Mutex
+	data  []byte
+}
+
+// Creates a hosts file watcher; static holds the targets of the
+// -hosts flag, which always remain monitored.
+func NewHostsFile(path, static string, views map[string]*DNSView) *HostsFile {
+	return &HostsFile{path: path, static: static, views: views}
+}
+
+// Reads the file and returns all targets, including the static ones.
+// Empty lines and lines starting with "#" are ignored.
+func (hf *HostsFile) Targets() ([]Target, error) {
+	data, err := os.ReadFile(hf.path)
+	if err != nil {
+		return nil, err
+	}
+	hf.mutex.Lock()
+	hf.data = data
+	hf.mutex.Unlock()
+	specs := []string{hf.static}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			specs = append(specs, line)
+		}
+	}
+	targets, err := ParseTargets(strings.Join(specs, ","))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkViews(targets, hf.views); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// Re-reads the file once per interval, and syncs the targets of cm if
+// the file has changed, until ctx is done. If the file cannot be read
+// or parsed, the targets stay as they are.
+func (hf *HostsFile) Run(ctx context.Context, cm *CertMon, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(hf.path)
+		if err != nil {
+			log.Printf("reading %s: %v", hf.path, err)
+			continue
+		}
+		hf.mutex.Lock()
+		unchanged := bytes.Equal(data, hf.data)
+		hf.mutex.Unlock()
+		if unchanged {
+			continue
+		}
+		targets, err := hf.Targets()
+		if err != nil {
+			err = fmt.Errorf("%s: %v", hf.path, err)
+		}
+		cm.ReloadTargets(targets, err)
+	}
+}
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var hstsEnabled = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "hsts_enabled",
+		Help:      "Whether the server sends a Strict-Transport-Security header with a positive max-age (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var hstsMaxAge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "hsts_max_age_seconds",
+		Help:      "The max-age directive of the Strict-Transport-Security header, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var hstsIncludeSubdomains = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "hsts_include_subdomains",
+		Help:      "Whether the Strict-Transport-Security header has the includeSubDomains directive (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var hstsPreload = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "hsts_preload",
+		Help:      "Whether the Strict-Transport-Security header has the preload directive (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+type HSTSPolicy struct {
+	Present           bool
+	MaxAge            time.Duration
+	IncludeSubdomains bool
+	Preload           bool
+}
+
+// Parses the value of a Strict-Transport-Security header, as specified
+// in RFC 6797, section 6.1.
+func ParseHSTS(header string) HSTSPolicy {
+	var p HSTSPolicy
+	if strings.TrimSpace(header) == "" {
+		return p
+	}
+	p.Present = true
+	for _, directive := range strings.Split(header, ";") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		switch strings.ToLower(name) {
+		case "max-age":
+			if secs, err := strconv.ParseInt(value, 10, 64); err == nil && secs >= 0 {
+				p.MaxAge = time.Duration(secs) * time.Second
+			}
+		case "includesubdomains":
+			p.IncludeSubdomains = true
+		case "preload":
+			p.Preload = true
+		}
+	}
+	return p
+}
+
+// Sends a HEAD request to the root of a target on its first port, and
+// parses the Strict-Transport-Security header of the response.
+func FetchHSTS(t Target) (HSTSPolicy, error) {
+	req, err := t.httpRequest(http.MethodHead, "/")
+	if err != nil {
+		return HSTSPolicy{}, err
+	}
+	// Browsers take the header from the response itself, which is why
+	// the client does not follow redirects.
+	client := t.httpClient(10 * time.Second)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return HSTSPolicy{}, err
+	}
+	resp.Body.Close()
+	return ParseHSTS(resp.Header.Get("Strict-Transport-Security")), nil
+}
+
+func exportHSTS(domain string, p HSTSPolicy, err error) {
+	if err != nil {
+		hstsEnabled.DeleteLabelValues(domain)
+		hstsMaxAge.DeleteLabelValues(domain)
+		hstsIncludeSubdomains.DeleteLabelValues(domain)
+		hstsPreload.DeleteLabelValues(domain)
+		return
+	}
+	hstsEnabled.WithLabelValues(domain).Set(boolToFloat(p.Present && p.MaxAge > 0))
+	hstsMaxAge.WithLabelValues(domain).Set(p.MaxAge.Seconds())
+	hstsIncludeSubdomains.WithLabelValues(domain).Set(boolToFloat(p.IncludeSubdomains))
+	hstsPreload.WithLabelValues(domain).Set(boolToFloat(p.Preload))
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var httpProbeSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "http_probe_success",
+		Help:      "Whether the HTTP request after the handshake returned the expected status code (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var httpProbeStatusCode = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "http_probe_status_code",
+		Help:      "Status code returned by the HTTP request after the handshake, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Sends a GET request for the target's HTTP path to its first port,
+// and returns the status code. Redirects are not followed, so that
+// they can be expected too.
+func ProbeHTTP(t Target) (int, error) {
+	req, err := t.httpRequest(http.MethodGet, t.HTTPPath)
+	if err != nil {
+		return 0, err
+	}
+	client := t.httpClient(10 * time.Second)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	return resp.StatusCode, nil
+}
+
+// Returns an HTTP client for requests to the first port of a target,
+// which connects like the certificate checks do: with the TLS settings,
+// resolver and proxy of the target. Redirects are not followed.
+func (t *Target) httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: t.TLSConfig(),
+			DialContext:     countedDialContext((&net.Dialer{Resolver: t.DNSResolver(), Timeout: t.CheckConnectTimeout()}).DialContext),
+			Proxy:           http.ProxyURL(t.ProxyURL(t.Ports[0])),
+
+			// With a custom TLS configuration, HTTP/2 needs to be
+			// asked for, which is only safe when offering it.
+			ForceAttemptHTTP2: contains(t.ALPNProtocols(), "h2"),
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Returns a request for path on the first port of a target, for the
+// server name of the target if it is set.
+func (t *Target) httpRequest(method, path string) (*http.Request, error) {
+	host := t.Host
+	if t.Ports[0] != 443 {
+		host = net.JoinHostPort(t.Host, strconv.Itoa(t.Ports[0]))
+	}
+	req, err := http.NewRequest(method, "https://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.ServerName != "" {
+		req.Host = t.ServerName
+	}
+	if ua := t.HTTPUserAgent(); ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	return req, nil
+}
+
+func exportHTTPProbe(domain string, expected, status int, err error) {
+	if err != nil {
+		httpProbeSuccess.WithLabelValues(domain).Set(0)
+		httpProbeStatusCode.DeleteLabelValues(domain)
+		return
+	}
+	httpProbeSuccess.WithLabelValues(domain).Set(boolToFloat(status == expected))
+	httpProbeStatusCode.WithLabelValues(domain).Set(float64(status))
+}
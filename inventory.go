@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// A certificate that was served for a target at some point.
+type ObservedCertificate struct {
+	Fingerprint string    `json:"fingerprint"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+
+	// The validation level asserted by the certificate policies, such
+	// as "EV"; empty if there was none, or for certificates observed
+	// before certmon recorded it.
+	Validation string `json:"validation,omitempty"`
+}
+
+// An entry in the certificate inventory of a target.
+type InventoryEntry struct {
+	ObservedCertificate
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+func observeCertificate(cert *x509.Certificate) *ObservedCertificate {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &ObservedCertificate{
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Validation:  validationLevel(cert),
+	}
+}
+
+// Returns the distinct certificates ever observed for each domain,
+// in the order they were first seen.
+func (el *EventLog) Inventory() map[string][]InventoryEntry {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	inventory := make(map[string][]InventoryEntry)
+	for _, e := range el.events {
+		if e.Type == EventCertificateObserved && e.Certificate != nil {
+			inventory[e.Domain] = append(inventory[e.Domain],
+				InventoryEntry{*e.Certificate, e.Time})
+		}
+	}
+	return inventory
+}
+
+// Adds the leaf certificate of a check to the inventory of a domain,
+// logging an event if it was not seen before. The caller must hold
+// cm.mutex.
+func (cm *CertMon) inventorize(domain string, status *domainStatus, leaf *x509.Certificate) {
+	cert := observeCertificate(leaf)
+	for _, entry := range status.inventory {
+		if entry.Fingerprint == cert.Fingerprint {
+			return
+		}
+	}
+	e := Event{
+		Time:        time.Now().UTC(),
+		Type:        EventCertificateObserved,
+		Domain:      domain,
+		Message:     "first seen certificate " + cert.Fingerprint,
+		Certificate: cert,
+	}
+	previous := status.inventory
+	status.inventory = append(status.inventory, InventoryEntry{*cert, e.Time})
+	cm.opts.Events.Record(e)
+
+	if n := len(previous); n > 0 && previous[n-1].Issuer != cert.Issuer {
+		cm.opts.Events.Record(Event{
+			Type:    EventIssuerChanged,
+			Domain:  domain,
+			Message: fmt.Sprintf("issuer changed from %q to %q", previous[n-1].Issuer, cert.Issuer),
+		})
+	}
+	if n := len(previous); n > 0 && previous[n-1].Validation != "" && previous[n-1].Validation != cert.Validation {
+		cm.opts.Events.Record(Event{
+			Type:    EventValidationChanged,
+			Domain:  domain,
+			Message: fmt.Sprintf("validation level changed from %s to %s", previous[n-1].Validation, validationName(cert.Validation)),
+		})
+	}
+	if weak := weakKey(leaf); weak != "" {
+		cm.opts.Events.Record(Event{
+			Type:    EventWeakKey,
+			Domain:  domain,
+			Message: "certificate " + cert.Fingerprint + " has a weak key: " + weak,
+		})
+	}
+}
+
+// Returns the certificates ever observed for a domain, newest first.
+func (cm *CertMon) Inventory(domain string) ([]InventoryEntry, bool) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	status, ok := cm.domains[domain]
+	if !ok {
+		return nil, false
+	}
+	result := make([]InventoryEntry, 0, len(status.inventory))
+	for i := len(status.inventory) - 1; i >= 0; i-- {
+		result = append(result, status.inventory[i])
+	}
+	return result, true
+}
@@ -0,0 +1,184 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/csv"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Number of monitored certificates that share some property,
+// such as their issuing CA.
+type Tally struct {
+	Value string
+	Count int
+}
+
+// How the monitored certificates are distributed across issuers,
+// key types, validity lengths and validation levels.
+type IssuerDistribution struct {
+	Total    int
+	Issuers  []Tally
+	KeyTypes []Tally
+	Validity []Tally
+
+	// Validation levels asserted by the certificate policies.
+	Validation []Tally
+}
+
+// Describes the public key of a certificate, such as "RSA-2048"
+// or "ECDSA-P-256".
+func keyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// Minimum sizes of RSA and elliptic curve keys, set by -min-rsa-bits
+// and -min-ec-bits.
+var minRSABits, minECBits = 2048, 256
+
+// Describes the public key of a certificate if it is too weak by current
+// standards, as in "RSA-1024", or returns an empty string.
+func weakKey(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSABits {
+			return keyType(cert)
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize < minECBits {
+			return keyType(cert)
+		}
+	case *dsa.PublicKey:
+		return keyType(cert)
+	}
+	return ""
+}
+
+// Returns the validity period of a certificate in whole days,
+// as in "90 days".
+func validityLength(cert *x509.Certificate) string {
+	days := int(cert.NotAfter.Sub(cert.NotBefore).Hours()/24 + 0.5)
+	return fmt.Sprintf("%d days", days)
+}
+
+func tally(counts map[string]int) []Tally {
+	result := make([]Tally, 0, len(counts))
+	for value, count := range counts {
+		result = append(result, Tally{Value: value, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Value < result[j].Value
+	})
+	return result
+}
+
+// Summarizes the leaf certificates seen in the most recent checks.
+func (cm *CertMon) IssuerDistribution() *IssuerDistribution {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	issuers := make(map[string]int)
+	keyTypes := make(map[string]int)
+	validity := make(map[string]int)
+	validation := make(map[string]int)
+	total := 0
+	for _, status := range cm.domains {
+		if status.leaf == nil {
+			continue
+		}
+		total += 1
+		issuers[issuerName(status.leaf)] += 1
+		keyTypes[keyType(status.leaf)] += 1
+		validity[validityLength(status.leaf)] += 1
+		validation[validationName(validationLevel(status.leaf))] += 1
+	}
+	return &IssuerDistribution{
+		Total:      total,
+		Issuers:    tally(issuers),
+		KeyTypes:   tally(keyTypes),
+		Validity:   tally(validity),
+		Validation: tally(validation),
+	}
+}
+
+type tallySection struct {
+	name    string
+	tallies []Tally
+}
+
+func (d *IssuerDistribution) sections() []tallySection {
+	return []tallySection{
+		{"Issuer", d.Issuers},
+		{"Key type", d.KeyTypes},
+		{"Validity", d.Validity},
+		{"Validation", d.Validation},
+	}
+}
+
+func (d *IssuerDistribution) WriteHTML(w io.Writer) error {
+	fmt.Fprintf(w, "%s", htmlHead+"<body><h1>CertMon: Issuer Distribution</h1>\n")
+	fmt.Fprintf(w, "<p>%d certificates</p>\n", d.Total)
+	for _, s := range d.sections() {
+		fmt.Fprintf(w, "<h2>%s</h2>\n<p><table>\n<tr><th>%s</th><th>Certificates</th><th>Share</th></tr>\n",
+			s.name, s.name)
+		for _, t := range s.tallies {
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td><td>%.0f%%</td></tr>\n",
+				html.EscapeString(t.Value), t.Count, 100*float64(t.Count)/float64(d.Total))
+		}
+		fmt.Fprintf(w, "%s", "</table></p>\n")
+	}
+	_, err := fmt.Fprintf(w, "%s", "</body></html>\n")
+	return err
+}
+
+// Writes the distribution as CSV, one row per dimension and value.
+func (d *IssuerDistribution) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"dimension", "value", "count"})
+	for _, s := range d.sections() {
+		for _, t := range s.tallies {
+			out.Write([]string{s.name, t.Value, strconv.Itoa(t.Count)})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Serves a summary of how many monitored certificates come from each
+// CA, key type, validity length and validation level, at
+// /issuers?format=html|csv.
+func (cm *CertMon) HandleIssuers(w http.ResponseWriter, r *http.Request) {
+	d := cm.IssuerDistribution()
+	switch r.URL.Query().Get("format") {
+	case "", "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		d.WriteHTML(w)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		d.WriteCSV(w)
+	default:
+		http.Error(w, "unknown format", http.StatusBadRequest)
+	}
+}
@@ -5,21 +5,160 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme"
 )
 
 func main() {
 	var portFlag = flag.Int("port", 0, "port for serving HTTP requests")
-	var domainsFlag = flag.String("hosts", "codesearch.wmcloud.org,query.wikidata.org,toolforge.org,wmcloud.org", "comma-separated list of internet domains whose TLS certificate expiration dates we monitor")
+	var domainsFlag = flag.String("hosts", "codesearch.wmcloud.org,query.wikidata.org,toolforge.org,wmcloud.org", "comma-separated list of internet domains whose TLS certificate expiration dates we monitor, optionally with ports and options such as example.org:443/8443?min_tls=1.2")
+	var thresholdsFlag = flag.String("thresholds", "30,14,7,1", "comma-separated list of days before expiration at which to log a threshold crossing")
+	var eventLogFlag = flag.String("event-log", "", "where to persist the event log: a file path, sqlite:<path>, bolt:<path> or a postgres:// URL; if empty, events are kept in memory only")
+	var nearMissFlag = flag.Int("near-miss-days", 7, "renewals with fewer days of remaining validity are reported as near-misses")
+	var reportDirFlag = flag.String("report-dir", "", "directory for writing weekly and monthly reports; if empty, reports are only served over HTTP")
+	var renewalLeadFlag = flag.Int("renewal-lead-days", 0, "days before expiration by which certificates are expected to get renewed; 0 disables the detection of overdue renewals")
+	var renewalChecksFlag = flag.Int("renewal-stuck-checks", 10, "number of checks within the renewal lead time after which an unchanged certificate counts as overdue for renewal")
+	var acmeDirsFlag = flag.String("acme-dirs", "", "comma-separated list of directories where ACME clients such as certbot, lego or acme.sh store certificates, for checking that renewed certificates get deployed")
+	var pairsFlag = flag.String("pairs", "", "comma-separated list of domain=peer pairs, such as staging.example.org=example.org, whose certificates are expected to come from the same authority and cover the same names")
+	var hstsFlag = flag.Bool("hsts", false, "after each successful check, send an HTTP HEAD request and export the Strict-Transport-Security policy")
+	var mtaSTSFlag = flag.String("mta-sts", "", "comma-separated list of mail domains whose MTA-STS policy we monitor")
+	var rootStoresFlag = flag.String("root-stores", "", "comma-separated list of PEM files with trusted root certificates, such as the bundles of operating systems or browsers; if empty, chains are anchored in the system roots")
+	var rootWindowFlag = flag.Int("root-expiry-window-days", 365, "warn about chains anchoring to root certificates that expire within this many days")
+	var issuingCAsFlag = flag.String("issuing-cas", "", "comma-separated list of issuing CAs of a private PKI to track, given as PEM files or sha256:<hex> fingerprints, optionally prefixed by name=")
+	var caRevocationIntervalFlag = flag.Duration("ca-revocation-interval", time.Hour, "how often to check whether the CAs given by -issuing-cas have been revoked by their parent CA")
+	var crlsFlag = flag.String("crls", "", "comma-separated list of URLs of certificate revocation lists whose freshness we monitor")
+	var crlAutoFlag = flag.Bool("crl-auto", false, "also monitor the CRL distribution points listed in checked certificates")
+	var crlIntervalFlag = flag.Duration("crl-interval", time.Hour, "how often to download each certificate revocation list")
+	var certFilesFlag = flag.String("cert-files", "", "comma-separated list of glob patterns for certificate files on disk, such as S/MIME or code signing certificates, whose expiration dates we monitor by purpose")
+	var clientCertsFlag = flag.String("client-certs", "", "comma-separated list of client certificate files used by certmon, optionally prefixed by name=, whose own expiration dates we monitor")
+	var stapleThresholdsFlag = flag.String("ocsp-staple-thresholds", "72h,24h", "comma-separated list of durations; log an event when the remaining validity of a stapled OCSP response falls below one of them")
+	var dryRunFlag = flag.String("acme-dry-run", "", "comma-separated list of domains for which to regularly obtain a throwaway certificate, verifying the renewal pipeline end to end")
+	var dryRunDirFlag = flag.String("acme-dry-run-directory", letsEncryptStagingURL, "ACME directory URL for dry runs")
+	var dryRunDNSFlag = flag.String("acme-dry-run-dns", "", "DNS provider for solving DNS-01 challenges in dry runs, such as exec:/usr/local/bin/dns-hook")
+	var dryRunEABFlag = flag.String("acme-dry-run-eab", "", "external account binding for dry runs, as keyid:base64url-key")
+	var dryRunIntervalFlag = flag.Duration("acme-dry-run-interval", 24*time.Hour, "how often to run the renewal dry run for each domain")
+	var dnsViewsFlag = flag.String("dns-views", "", "comma-separated list of name=resolver DNS views, such as internal=10.0.0.53,external=8.8.8.8, for targets with a views option")
+	var verifyAheadFlag = flag.Duration("verify-ahead", 30*24*time.Hour, "also verify chains as of this far in the future, to detect intermediates and roots that expire before the leaf; 0 disables")
+	var hostsFileFlag = flag.String("hosts-file", "", "file with additional targets, one per line in the syntax of -hosts, such as a mounted Kubernetes ConfigMap; changes are picked up within a minute")
+	var ctLogListFlag = flag.String("ct-log-list", defaultCTLogList, "URL of the list of Certificate Transparency logs, in the v3 JSON format")
+	var ctIntervalFlag = flag.Duration("ct-interval", 6*time.Hour, "how often to verify the inclusion of embedded SCTs for targets with verify_ct=true")
+	var publicDomainsFlag = flag.String("public-domains", "", "comma-separated list of domains whose status is served without internal details at /public/status.json, for public status pages")
+	var alertmanagerFlag = flag.String("alertmanager", "", "base URL of a Prometheus Alertmanager, such as http://alertmanager:9093, whose silences are kept in sync with snoozes; certmon only creates silences for snoozes that carry the admin token")
+	var alertmanagerIntervalFlag = flag.Duration("alertmanager-interval", time.Minute, "how often to fetch silences from Alertmanager")
+	var resolverFlag = flag.String("resolver", "", "comma-separated list of DNS servers, such as 10.0.0.53:53, to use for all lookups instead of those in /etc/resolv.conf; targets can override it with their resolver option")
+	var proxyFlag = flag.String("proxy", "", "URL of an HTTP or SOCKS5 proxy, such as http://proxy.example.org:3128 or socks5://localhost:1080, through which to reach the targets; if empty, HTTPS_PROXY and NO_PROXY apply; targets can override it with their proxy option")
+	var caFileFlag = flag.String("ca-file", "", "PEM file with root certificates, such as the root of a private PKI, to trust in addition to the system roots; targets can replace the roots with their ca_file option")
+	var chainSizeWarningFlag = flag.Int("chain-size-warning", 4096, "log an event when the certificates presented in a handshake take more than this many bytes; 0 disables the warning")
+	var configFlag = flag.String("config", "", "YAML file with the targets to monitor and their settings, such as ports, check interval, timeout and labels; replaces -hosts, and gets reloaded on SIGHUP and when it changes, such as a mounted Kubernetes ConfigMap; changes are picked up within a minute")
+	var timeoutFlag = flag.Duration("timeout", defaultCheckTimeout, "how long to wait for reaching the TLS handshake with a target, including establishing the connection; targets can override it with their timeout option")
+	var connectTimeoutFlag = flag.Duration("connect-timeout", 0, "how long to wait for establishing a connection to a target or its proxy; 0 means the same as -timeout; targets can override it with their connect_timeout option")
+	var attemptsFlag = flag.Int("attempts", defaultAttempts, "how often to attempt the handshake with a target before its check fails, retrying with exponential backoff after failures that may be transient; targets can override it with their attempts option")
+	var retryDelayFlag = flag.Duration("retry-delay", retryDelay, "delay before the first retry of a failed handshake, doubling with every further retry, with random jitter")
+	var maxConnectionsFlag = flag.Int("max-connections", 0, "how many connections checks may have open at the same time, for small machines; further checks wait for a free slot within their timeout; 0 means no limit")
+	var deepIntervalFlag = flag.Duration("deep-interval", 0, "how often to run the expensive parts of checks, such as probing TLS versions, verifying CT inclusion and fetching HSTS policies; 0 means at every check; targets can override it with their deep_interval option")
+	var unresolvableBackoffFlag = flag.Duration("unresolvable-backoff", time.Hour, "how long to wait before checking a target again whose name does not exist in DNS")
+	var adminTokenFileFlag = flag.String("admin-token-file", "", "file with a bearer token that enables the admin API at /api/domains, which adds and removes targets at runtime, the batch import at /api/v1/targets:batch, and snoozing on the status page; without it, none of these is available")
+	var aggregateFlag = flag.Bool("aggregate", false, "accept results pushed by edge certmons at /api/v1/agents/<name>, and export them labeled by agent; needs -agents-file or -admin-token-file for authenticating the pushes")
+	var pushURLFlag = flag.String("push-url", "", "base URL of a central certmon running with -aggregate, to which this certmon pushes its results")
+	var agentNameFlag = flag.String("agent-name", "", "name under which results get pushed to the central certmon; defaults to the host name")
+	var pushIntervalFlag = flag.Duration("push-interval", time.Minute, "how often to push results to the central certmon")
+	var pushTokenFileFlag = flag.String("push-token-file", "", "file with the bearer token for pushing to the central certmon, which is its -admin-token-file or the token_file of this agent in its -agents-file")
+	var pushCertFileFlag = flag.String("push-cert-file", "", "PEM file with a TLS client certificate to present when pushing to the central certmon; needs -push-key-file")
+	var pushKeyFileFlag = flag.String("push-key-file", "", "PEM file with the private key for -push-cert-file")
+	var agentsFileFlag = flag.String("agents-file", "", "YAML file listing the agents that may push to this aggregator, how each authenticates, and which domains each may report on; overrides -admin-token-file for /api/v1/agents")
+	var tlsCertFileFlag = flag.String("tls-cert-file", "", "PEM file with a certificate for serving HTTPS instead of HTTP; needs -tls-key-file")
+	var tlsKeyFileFlag = flag.String("tls-key-file", "", "PEM file with the private key for -tls-cert-file")
+	var tlsClientCAFileFlag = flag.String("tls-client-ca-file", "", "PEM file with the CA certificates for verifying client certificates of pushing agents, when serving HTTPS")
+	var onceFlag = flag.Bool("once", false, "check every target once, deliver the results to -once-output, -push-url or -pushgateway, and exit with status 1 if some check failed; for running from cron instead of as a daemon")
+	var onceOutputFlag = flag.String("once-output", "", "with -once, file for writing the results as JSON; - means standard output")
+	var onceConcurrencyFlag = flag.Int("once-concurrency", 10, "with -once, how many targets to check at the same time")
+	var pushgatewayFlag = flag.String("pushgateway", "", "with -once, URL of a Prometheus Pushgateway, such as http://pushgateway:9091, to which to push the metrics")
+	var syslogFlag = flag.String("syslog", "", "URL of a syslog server, such as udp://siem.example.org:514, to which to forward security-relevant events such as issuer changes, hostname mismatches, weak keys and revocations, in the Common Event Format")
+	var enrichFlag = flag.Bool("enrich", false, "look up the reverse DNS names of the addresses that targets were reached at, and the registrar and expiration of their domain registrations over RDAP")
+	var enrichIntervalFlag = flag.Duration("enrich-interval", 24*time.Hour, "with -enrich, how often to refresh reverse DNS names and domain registrations")
+	var registrationThresholdsFlag = flag.String("registration-thresholds", "60,30,14,7", "with -enrich, comma-separated list of days before the expiration of a domain registration at which to log a threshold crossing")
+	var alpnFlag = flag.String("alpn", "", "comma-separated list of application protocols, such as h2,http/1.1, to offer in handshakes like browsers do; targets can override it with their alpn option")
+	var userAgentFlag = flag.String("user-agent", "", "User-Agent header for the HTTP requests that follow handshakes, such as for -hsts and http_path; targets can override it with their user_agent option")
+	var ocspResponderFlag = flag.Bool("ocsp-responder", false, "in deep scans, also ask the OCSP responder of the CA whether leaf certificates were revoked, rather than only looking at stapled responses")
+	var minRSABitsFlag = flag.Int("min-rsa-bits", minRSABits, "RSA keys with fewer bits get reported as weak")
+	var minECBitsFlag = flag.Int("min-ec-bits", minECBits, "elliptic curve keys on curves with fewer bits get reported as weak")
+	var resultsFileFlag = flag.String("results-file", "", "file to which to append the results of every sweep over all targets as newline-delimited JSON, for log pipelines; - means standard output")
 	flag.Parse()
 
+	if *resolverFlag != "" {
+		servers, err := ParseDNSServers(*resolverFlag, ",")
+		if err != nil {
+			log.Fatalf("bad -resolver: %v", err)
+		}
+		net.DefaultResolver = NewResolver(servers)
+		defaultDNSServers = servers
+	}
+
+	if *timeoutFlag <= 0 || *connectTimeoutFlag < 0 {
+		log.Fatal("-timeout must be positive, and -connect-timeout must not be negative")
+	}
+	defaultCheckTimeout = *timeoutFlag
+	defaultConnectTimeout = *connectTimeoutFlag
+	if *attemptsFlag < 1 || *retryDelayFlag < 0 {
+		log.Fatal("-attempts must be at least 1, and -retry-delay must not be negative")
+	}
+	defaultAttempts = *attemptsFlag
+	retryDelay = *retryDelayFlag
+	if *deepIntervalFlag < 0 {
+		log.Fatal("-deep-interval must not be negative")
+	}
+	defaultDeepInterval = *deepIntervalFlag
+	minRSABits, minECBits = *minRSABitsFlag, *minECBitsFlag
+	for _, proto := range strings.Split(*alpnFlag, ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			defaultALPN = append(defaultALPN, proto)
+		}
+	}
+	defaultUserAgent = *userAgentFlag
+	if *maxConnectionsFlag < 0 {
+		log.Fatal("-max-connections must not be negative")
+	}
+	if *maxConnectionsFlag > 0 {
+		connectionSlots = make(chan struct{}, *maxConnectionsFlag)
+	}
+
+	if *proxyFlag != "" {
+		proxy, err := parseProxy(*proxyFlag)
+		if err != nil {
+			log.Fatalf("bad -proxy: %v", err)
+		}
+		defaultProxy = proxy
+	}
+
+	if *caFileFlag != "" {
+		roots, err := systemRootsWith(*caFileFlag)
+		if err != nil {
+			log.Fatalf("bad -ca-file: %v", err)
+		}
+		defaultRootCAs = roots
+	}
+
+	// "certmon selftest" checks local servers with known defects,
+	// for validating a deployment.
+	if flag.Arg(0) == "selftest" {
+		os.Exit(RunSelfTest())
+	}
+
 	port := *portFlag
 	if port == 0 {
 		port, _ = strconv.Atoi(os.Getenv("PORT"))
@@ -28,9 +167,399 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	certmon := NewCertMon(strings.Split(*domainsFlag, ","), ctx)
-	prometheus.MustRegister(certExpirations)
+	thresholds, err := parseDays(*thresholdsFlag)
+	if err != nil {
+		log.Fatalf("bad -thresholds: %v", err)
+	}
+
+	stapleThresholds, err := ParseDurations(*stapleThresholdsFlag)
+	if err != nil {
+		log.Fatalf("bad -ocsp-staple-thresholds: %v", err)
+	}
+
+	store, err := OpenEventStore(*eventLogFlag)
+	if err != nil {
+		log.Fatalf("bad -event-log: %v", err)
+	}
+	events, err := NewEventLog(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *syslogFlag != "" {
+		forwarder, err := NewSyslogForwarder(*syslogFlag)
+		if err != nil {
+			log.Fatalf("bad -syslog: %v", err)
+		}
+		events.SetForwarder(forwarder)
+	}
+
+	opts := Options{
+		Events:              events,
+		Thresholds:          thresholds,
+		RenewalLeadTime:     time.Duration(*renewalLeadFlag) * 24 * time.Hour,
+		RenewalStuckChecks:  *renewalChecksFlag,
+		HSTS:                *hstsFlag,
+		OCSPResponder:       *ocspResponderFlag,
+		StapleThresholds:    stapleThresholds,
+		VerifyAhead:         *verifyAheadFlag,
+		CT:                  NewCTVerifier(*ctLogListFlag, *ctIntervalFlag),
+		UnresolvableBackoff: *unresolvableBackoffFlag,
+		ChainSizeWarning:    *chainSizeWarningFlag,
+		Once:                *onceFlag,
+	}
+	if *adminTokenFileFlag != "" {
+		if opts.AdminToken, err = ReadAdminToken(*adminTokenFileFlag); err != nil {
+			log.Fatalf("bad -admin-token-file: %v", err)
+		}
+	}
+	if *resultsFileFlag != "" {
+		opts.Results = NewResultWriter(*resultsFileFlag)
+	}
+	if *enrichFlag {
+		thresholds, err := parseDays(*registrationThresholdsFlag)
+		if err != nil {
+			log.Fatalf("bad -registration-thresholds: %v", err)
+		}
+		opts.Enricher = NewEnricher(*enrichIntervalFlag, thresholds)
+	}
+	if *alertmanagerFlag != "" {
+		opts.Alertmanager = NewAlertmanager(*alertmanagerFlag)
+	}
+	if *aggregateFlag {
+		if *agentsFileFlag == "" && *adminTokenFileFlag == "" {
+			log.Fatal("-aggregate needs -agents-file or -admin-token-file, so that pushes get authenticated")
+		}
+		var policies map[string]*AgentPolicy
+		if *agentsFileFlag != "" {
+			if policies, err = ReadAgentPolicies(*agentsFileFlag); err != nil {
+				log.Fatalf("bad -agents-file: %v", err)
+			}
+		}
+		opts.Aggregator = NewAggregator(policies)
+	}
+	var rootStores []*RootStore
+	for _, path := range strings.Split(*rootStoresFlag, ",") {
+		if path == "" {
+			continue
+		}
+		store, err := LoadRootStore(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rootStores = append(rootStores, store)
+	}
+	opts.Roots = NewRootTracker(rootStores, time.Duration(*rootWindowFlag)*24*time.Hour)
+	if *issuingCAsFlag != "" {
+		cas, err := ParseIssuingCAs(*issuingCAsFlag)
+		if err != nil {
+			log.Fatalf("bad -issuing-cas: %v", err)
+		}
+		opts.CAs = NewCATracker(cas)
+		go opts.CAs.Run(ctx, events, *caRevocationIntervalFlag)
+		http.HandleFunc("/cas", opts.CAs.HandleCAs)
+	}
+	if *crlsFlag != "" || *crlAutoFlag {
+		var urls []string
+		for _, u := range strings.Split(*crlsFlag, ",") {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+		opts.CRLs = NewCRLMonitor(urls, *crlAutoFlag)
+		go opts.CRLs.Run(ctx, events, *crlIntervalFlag)
+	}
+	if *acmeDirsFlag != "" {
+		opts.ACME = NewACMEState(strings.Split(*acmeDirsFlag, ","))
+	}
+	opts.Views, err = ParseDNSViews(*dnsViewsFlag)
+	if err != nil {
+		log.Fatalf("bad -dns-views: %v", err)
+	}
+	if *configFlag != "" && *hostsFileFlag != "" {
+		log.Fatal("-config and -hosts-file cannot be combined")
+	}
+	var hostsFile *HostsFile
+	if *hostsFileFlag != "" {
+		hostsFile = NewHostsFile(*hostsFileFlag, *domainsFlag, opts.Views)
+	}
+
+	// Reads the targets from wherever they are configured; called again
+	// on SIGHUP.
+	loadTargets := func() ([]Target, error) {
+		var targets []Target
+		var err error
+		switch {
+		case *configFlag != "":
+			targets, err = ReadConfig(*configFlag)
+		case hostsFile != nil:
+			targets, err = hostsFile.Targets()
+		default:
+			targets, err = ParseTargets(*domainsFlag)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := checkViews(targets, opts.Views); err != nil {
+			return nil, err
+		}
+		return targets, nil
+	}
+	targets, err := loadTargets()
+	if err != nil {
+		log.Fatalf("bad targets: %v", err)
+	}
+	hosts := make([]string, 0, len(targets))
+	for _, t := range targets {
+		hosts = append(hosts, t.Host)
+	}
+
+	opts.Pairs, err = ParsePairs(*pairsFlag)
+	if err != nil {
+		log.Fatalf("bad -pairs: %v", err)
+	}
+	for _, p := range opts.Pairs {
+		for _, d := range []string{p.Domain, p.Peer} {
+			if !contains(hosts, d) {
+				log.Fatalf("bad -pairs: %s is not in -hosts", d)
+			}
+		}
+	}
+
+	certmon := NewCertMon(targets, opts, ctx)
+	if hostsFile != nil {
+		go hostsFile.Run(ctx, certmon, time.Minute)
+	}
+	if *configFlag != "" {
+		go WatchConfig(ctx, certmon, *configFlag, loadTargets, time.Minute)
+	}
+	if opts.Alertmanager != nil {
+		go opts.Alertmanager.Run(ctx, certmon, *alertmanagerIntervalFlag)
+	}
+	if opts.Enricher != nil {
+		go opts.Enricher.Run(ctx, certmon)
+	}
+	var pusher *Pusher
+	if *pushURLFlag != "" {
+		agent := *agentNameFlag
+		if agent == "" {
+			if agent, err = os.Hostname(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var token []byte
+		if *pushTokenFileFlag != "" {
+			if token, err = ReadAdminToken(*pushTokenFileFlag); err != nil {
+				log.Fatalf("bad -push-token-file: %v", err)
+			}
+		}
+		var cert *tls.Certificate
+		if *pushCertFileFlag != "" {
+			c, err := tls.LoadX509KeyPair(*pushCertFileFlag, *pushKeyFileFlag)
+			if err != nil {
+				log.Fatalf("bad -push-cert-file: %v", err)
+			}
+			cert = &c
+		}
+		pusher = NewPusher(*pushURLFlag, agent, token, cert)
+		if !*onceFlag {
+			go pusher.Run(ctx, certmon, *pushIntervalFlag)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			certmon.ReloadTargets(loadTargets())
+		}
+	}()
+	prometheus.MustRegister(certExpirations, checkSuccess, renewalOverdue, snoozedUntil, acmeDeployed, acmeDeploymentLag,
+		pairIssuerMismatch, pairSANMismatch, portMismatch, hostnameMismatch,
+		hstsEnabled, hstsMaxAge, hstsIncludeSubdomains, hstsPreload,
+		mtaSTSRecordValid, mtaSTSPolicyValid, mtaSTSPolicyExpiration, mtaSTSPolicyMode,
+		mtaSTSMXValid, mtaSTSMXExpiration, rootExpiration, rootExpiring,
+		caExpiration, caLeafRatio, caRevoked, caRevocationCheckSuccess,
+		crlFetchSuccess, crlSignatureValid, crlThisUpdate, crlNextUpdate, crlSize, crlRevoked, tlsVersionSuccess,
+		fileCertExpiration, purposeExpiration, clientCertExpiration,
+		ocspStaplePresent, ocspStapleNextUpdate, ocspStapleExpiring,
+		acmeDryRunSuccess, acmeDryRunTimestamp, httpProbeSuccess, httpProbeStatusCode,
+		checksQueued, checksInFlight, checkLag, sweepDuration, probeDuration,
+		openConnections, sweepPeakConnections, sweepBytes, sweepDNSLookups,
+		viewCheckSuccess, viewCertExpiration,
+		chainValidAhead, ctInclusionVerified, staleDeployment, checkTargetIP, tlsConnectionInfo, unresolvable, chainCertExpiration,
+		sniCheckSuccess, sniCertExpiration, portCheckSuccess, portCertExpiration,
+		addressCheckSuccess, addressCertExpiration,
+		ipVersionCheckSuccess, ipVersionCertExpiration, ipVersionHandshakeDuration,
+		availabilityRatio, chainSize, tlsVerificationOK, lifetimeElapsed, checkRetries,
+		checkErrors, lastCheck, lastSuccess, certificateValidation,
+		certNotBefore, certAge, registrationExpiration, certificateInfo, certificateSANs,
+		dnssecSignatureExpiration, dnssecSigned, certificateKeyBits, certificateWeakKey,
+		weakSignature, targetProvider, certificateRevoked, ocspResponderSuccess,
+		NewTargetInfoCollector(certmon), NewTargetAnnotationsCollector(certmon))
+	if *onceFlag {
+		status := certmon.RunOnce(ctx, *onceConcurrencyFlag, OnceOutputs{
+			File:        *onceOutputFlag,
+			Pusher:      pusher,
+			Pushgateway: *pushgatewayFlag,
+		})
+		if err := events.Close(); err != nil {
+			log.Printf("closing -event-log: %v", err)
+		}
+		os.Exit(status)
+	}
 	http.HandleFunc("/", certmon.HandleStatus)
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":"+strconv.Itoa(port), nil)
+	http.HandleFunc("/domain/", certmon.HandleDomain)
+	http.Handle("/metrics", metricsHandler())
+	http.HandleFunc("/probe", HandleProbe)
+	http.HandleFunc("/api/v1/events", events.HandleEvents)
+	http.HandleFunc("/api/v1/changes", certmon.HandleChanges)
+	http.HandleFunc("/api/v1/targets/", certmon.HandleTargets)
+	var push http.HandlerFunc
+	if opts.Aggregator != nil {
+		prometheus.MustRegister(opts.Aggregator)
+		push = opts.Aggregator.HandlePush
+	}
+	if opts.AdminToken != nil {
+		admin := NewAdminAPI(certmon, opts.AdminToken)
+		http.HandleFunc("/api/domains", admin.Authenticate(admin.HandleDomains))
+		http.HandleFunc("/api/domains/", admin.Authenticate(admin.HandleDomains))
+		http.HandleFunc("/api/v1/targets:batch", admin.Authenticate(NewBatchImporter(certmon).HandleBatch))
+		if push != nil && *agentsFileFlag == "" {
+			push = admin.Authenticate(push)
+		}
+	}
+	if push != nil {
+		http.HandleFunc("/api/v1/agents/", push)
+	}
+	http.HandleFunc("/roots", opts.Roots.HandleRoots)
+	http.HandleFunc("/issuers", certmon.HandleIssuers)
+	if *publicDomainsFlag != "" {
+		public := NewPublicStatus(certmon, strings.Split(*publicDomainsFlag, ","))
+		http.HandleFunc("/public/status.json", public.HandleStatus)
+	}
+
+	clientCerts := NewClientCertRegistry()
+	if err := clientCerts.RegisterList(*clientCertsFlag); err != nil {
+		log.Fatalf("bad -client-certs: %v", err)
+	}
+	go clientCerts.Run(ctx, time.Minute)
+
+	if *certFilesFlag != "" {
+		go NewFileSource(strings.Split(*certFilesFlag, ",")).Run(ctx, time.Minute)
+	}
+
+	if *dryRunFlag != "" {
+		provider, err := ParseDNSProvider(*dryRunDNSFlag)
+		if err != nil {
+			log.Fatalf("bad -acme-dry-run-dns: %v", err)
+		}
+		var eab *acme.ExternalAccountBinding
+		if *dryRunEABFlag != "" {
+			if eab, err = ParseExternalAccountBinding(*dryRunEABFlag); err != nil {
+				log.Fatalf("bad -acme-dry-run-eab: %v", err)
+			}
+		}
+		dryRun, err := NewRenewalDryRun(*dryRunDirFlag, strings.Split(*dryRunFlag, ","), provider, eab)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go dryRun.Run(ctx, *dryRunIntervalFlag)
+	}
+
+	if *mtaSTSFlag != "" {
+		go RunMTASTS(ctx, strings.Split(*mtaSTSFlag, ","), 10*time.Minute)
+	}
+
+	reporter := NewReporter(events, time.Duration(*nearMissFlag)*24*time.Hour, *reportDirFlag)
+	go reporter.Run(ctx)
+	http.HandleFunc("/report", reporter.HandleReport)
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), TLSConfig: &tls.Config{}}
+	if *tlsClientCAFileFlag != "" {
+		pem, err := os.ReadFile(*tlsClientCAFileFlag)
+		if err != nil {
+			log.Fatalf("bad -tls-client-ca-file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("bad -tls-client-ca-file: no certificates in %s", *tlsClientCAFileFlag)
+		}
+		// Other clients, such as Prometheus or browsers, need not
+		// present a certificate; the aggregator checks it per agent.
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// On SIGINT or SIGTERM, stop the background work and the server,
+	// so that the events which the store has not written yet get
+	// written before exiting.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		log.Printf("stopping on %v", sig)
+		cancel()
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if *tlsCertFileFlag == "" {
+		err = server.ListenAndServe()
+	} else {
+		err = server.ListenAndServeTLS(*tlsCertFileFlag, *tlsKeyFileFlag)
+	}
+	if err := events.Close(); err != nil {
+		log.Printf("closing -event-log: %v", err)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a comma-separated list of days, such as "30,14,7".
+func parseDays(s string) ([]int, error) {
+	var days []int
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		d, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// Serves the metrics in the classic Prometheus text format, or in the
+// OpenMetrics format if the scraper asks for it in its Accept header.
+// Scrapers that cannot set headers can pass ?format=openmetrics or
+// ?format=prometheus instead.
+func metricsHandler() http.Handler {
+	handler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("format") {
+		case "":
+		case "openmetrics":
+			r.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+		case "prometheus":
+			r.Header.Set("Accept", "text/plain; version=0.0.4")
+		default:
+			http.Error(w, "unknown format", http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,310 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var mtaSTSRecordValid = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "mta_sts_record_valid",
+		Help:      "Whether the _mta-sts TXT record of a mail domain is valid (1) or not (0).",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var mtaSTSPolicyValid = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "mta_sts_policy_valid",
+		Help:      "Whether the MTA-STS policy of a mail domain could be fetched and parsed (1) or not (0).",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var mtaSTSPolicyExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "mta_sts_policy_expiration_timestamp",
+		Help:      "Time when senders that fetched the MTA-STS policy of a mail domain at the last check will stop caching it, in seconds since 1970-01-01 midnight UTC.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var mtaSTSPolicyMode = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "mta_sts_policy_mode",
+		Help:      "Mode of the MTA-STS policy of a mail domain; always 1.",
+	},
+	[]string{
+		"domain",
+		"mode",
+	},
+)
+
+var mtaSTSMXValid = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "mta_sts_mx_valid",
+		Help:      "Whether a mail exchanger of a domain is covered by its MTA-STS policy and presents a valid certificate over STARTTLS (1) or not (0).",
+	},
+	[]string{
+		"domain",
+		"mx",
+	},
+)
+
+var mtaSTSMXExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "mta_sts_mx_certificate_expiration_timestamp",
+		Help:      "Earliest expiration date in the certificate chain of a mail exchanger, in seconds since 1970-01-01 midnight UTC.",
+	},
+	[]string{
+		"domain",
+		"mx",
+	},
+)
+
+// An MTA-STS policy, as specified in RFC 8461, section 3.2.
+type MTASTSPolicy struct {
+	Mode   string
+	MX     []string
+	MaxAge time.Duration
+}
+
+// Largest max_age allowed by RFC 8461.
+const mtaSTSMaxAge = 31557600 * time.Second
+
+func ParseMTASTSPolicy(r io.Reader) (*MTASTSPolicy, error) {
+	p := &MTASTSPolicy{}
+	version, maxAge := "", ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed policy line %q", line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(value))
+		case "max_age":
+			maxAge = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported policy version %q", version)
+	}
+	switch p.Mode {
+	case "enforce", "testing", "none":
+	default:
+		return nil, fmt.Errorf("unknown policy mode %q", p.Mode)
+	}
+	if p.Mode != "none" && len(p.MX) == 0 {
+		return nil, errors.New("policy lists no mx")
+	}
+	secs, err := strconv.ParseInt(maxAge, 10, 64)
+	if err != nil || secs < 0 || time.Duration(secs)*time.Second > mtaSTSMaxAge {
+		return nil, fmt.Errorf("bad max_age %q", maxAge)
+	}
+	p.MaxAge = time.Duration(secs) * time.Second
+	return p, nil
+}
+
+// Reports whether host matches one of the mx patterns of the policy.
+// A leading "*." matches exactly one label.
+func (p *MTASTSPolicy) Matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		if pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.IndexByte(host, '.')
+			if i > 0 && host[i:] == pattern[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var mtaSTSClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		// RFC 8461, section 3.3: policy fetches must not follow redirects.
+		return http.ErrUseLastResponse
+	},
+}
+
+// Looks up the _mta-sts TXT record of domain, and returns its id.
+func LookupMTASTSRecord(domain string) (string, error) {
+	records, err := net.LookupTXT("_mta-sts." + domain)
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	for _, rec := range records {
+		if !strings.HasPrefix(rec, "v=STSv1;") && rec != "v=STSv1" {
+			continue
+		}
+		for _, field := range strings.Split(rec, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				ids = append(ids, field[3:])
+			}
+		}
+	}
+	if len(ids) != 1 {
+		return "", fmt.Errorf("expected one STSv1 record with an id, found %d", len(ids))
+	}
+	return ids[0], nil
+}
+
+func FetchMTASTSPolicy(domain string) (*MTASTSPolicy, error) {
+	resp, err := mtaSTSClient.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy fetch returned status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		return nil, fmt.Errorf("policy has content type %q, expected text/plain", ct)
+	}
+	return ParseMTASTSPolicy(io.LimitReader(resp.Body, 64*1024))
+}
+
+// Connects to an SMTP server, upgrades the connection with STARTTLS,
+// and returns the state of the TLS connection. Certificate verification
+// happens according to config.
+func smtpStartTLS(dial dialFunc, addr string, config *tls.Config, timeout time.Duration) (tls.ConnectionState, error) {
+	conn, err := dial(addr, timeout)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return tls.ConnectionState{}, err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		return tls.ConnectionState{}, errors.New("server does not offer STARTTLS")
+	}
+	if err := c.StartTLS(config); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	state, _ := c.TLSConnectionState()
+	c.Quit()
+	return state, nil
+}
+
+// Checks the MTA-STS setup of a mail domain, and exports the result.
+// Returns the policy, or nil if it could not be fetched.
+func CheckMTASTS(domain string) *MTASTSPolicy {
+	_, err := LookupMTASTSRecord(domain)
+	mtaSTSRecordValid.WithLabelValues(domain).Set(boolToFloat(err == nil))
+
+	fetched := time.Now()
+	policy, err := FetchMTASTSPolicy(domain)
+	mtaSTSPolicyValid.WithLabelValues(domain).Set(boolToFloat(err == nil))
+	if err != nil {
+		mtaSTSPolicyExpiration.DeleteLabelValues(domain)
+		return nil
+	}
+	mtaSTSPolicyExpiration.WithLabelValues(domain).Set(float64(fetched.Add(policy.MaxAge).Unix()))
+
+	mxs, err := net.LookupMX(domain)
+	if err != nil {
+		return policy
+	}
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		state, err := smtpStartTLS(dialDirect, net.JoinHostPort(host, "25"), &tls.Config{ServerName: host}, 30*time.Second)
+		if err != nil {
+			mtaSTSMXValid.WithLabelValues(domain, host).Set(0)
+			mtaSTSMXExpiration.DeleteLabelValues(domain, host)
+			continue
+		}
+		mtaSTSMXValid.WithLabelValues(domain, host).Set(boolToFloat(policy.Matches(host)))
+		exp := state.PeerCertificates[0].NotAfter
+		for _, cert := range state.PeerCertificates[1:] {
+			if cert.NotAfter.Before(exp) {
+				exp = cert.NotAfter
+			}
+		}
+		mtaSTSMXExpiration.WithLabelValues(domain, host).Set(float64(exp.Unix()))
+	}
+	return policy
+}
+
+// Periodically checks the MTA-STS setup of mail domains, until ctx
+// is done.
+func RunMTASTS(ctx context.Context, domains []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	modes := make(map[string]string, len(domains))
+	for {
+		for _, domain := range domains {
+			mode := ""
+			if policy := CheckMTASTS(domain); policy != nil {
+				mode = policy.Mode
+			}
+			if old, ok := modes[domain]; ok && old != mode {
+				mtaSTSPolicyMode.DeleteLabelValues(domain, old)
+			}
+			if mode == "" {
+				delete(modes, domain)
+			} else {
+				modes[domain] = mode
+				mtaSTSPolicyMode.WithLabelValues(domain, mode).Set(1)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy string
+		want   *MTASTSPolicy
+	}{
+		{
+			"CRLF",
+			"version: STSv1\r\nmode: enforce\r\nmx: mail.example.org\r\nmx: *.example.net\r\nmax_age: 604800\r\n",
+			&MTASTSPolicy{Mode: "enforce", MX: []string{"mail.example.org", "*.example.net"}, MaxAge: 7 * 24 * time.Hour},
+		},
+		{
+			"LF",
+			"version: STSv1\nmode: testing\nmx: MAIL.example.org\nmax_age: 86400\n",
+			&MTASTSPolicy{Mode: "testing", MX: []string{"mail.example.org"}, MaxAge: 24 * time.Hour},
+		},
+		{
+			"mode none",
+			"version: STSv1\r\nmode: none\r\nmax_age: 86400\r\n",
+			&MTASTSPolicy{Mode: "none", MaxAge: 24 * time.Hour},
+		},
+		{"missing version", "mode: enforce\r\nmx: mail.example.org\r\nmax_age: 86400\r\n", nil},
+		{"wrong version", "version: STSv2\r\nmode: enforce\r\nmx: mail.example.org\r\nmax_age: 86400\r\n", nil},
+		{"unknown mode", "version: STSv1\r\nmode: strict\r\nmx: mail.example.org\r\nmax_age: 86400\r\n", nil},
+		{"no mx", "version: STSv1\r\nmode: enforce\r\nmax_age: 86400\r\n", nil},
+		{"missing max_age", "version: STSv1\r\nmode: enforce\r\nmx: mail.example.org\r\n", nil},
+		{"max_age too large", "version: STSv1\r\nmode: enforce\r\nmx: mail.example.org\r\nmax_age: 31557601\r\n", nil},
+		{"malformed line", "version: STSv1\r\nmode enforce\r\nmx: mail.example.org\r\nmax_age: 86400\r\n", nil},
+	} {
+		got, err := ParseMTASTSPolicy(strings.NewReader(tc.policy))
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %+v, want error", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMTASTSPolicyMatches(t *testing.T) {
+	p := &MTASTSPolicy{MX: []string{"mail.example.com", "*.example.org"}}
+	for _, tc := range []struct {
+		host string
+		want bool
+	}{
+		{"mail.example.com", true},
+		{"MAIL.Example.com.", true},
+		{"mx1.mail.example.com", false},
+		{"mx1.example.org", true},
+		{"mx1.example.org.", true},
+		{"a.mx1.example.org", false},
+		{"example.org", false},
+		{".example.org", false},
+		{"mx1.example.org.evil.net", false},
+	} {
+		if got := p.Matches(tc.host); got != tc.want {
+			t.Errorf("Matches(%q) = %v, want %v", tc.host, got, tc.want)
+		}
+	}
+}
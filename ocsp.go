@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ocsp"
+)
+
+var ocspStaplePresent = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ocsp_staple_present",
+		Help:      "Whether the server stapled a valid OCSP response to the handshake (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var ocspStapleNextUpdate = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ocsp_staple_next_update_timestamp",
+		Help:      "The nextUpdate time of the stapled OCSP response, in seconds since 1970-01-01 midnight UTC, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var ocspStapleExpiring = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ocsp_staple_expiring",
+		Help:      "Whether the remaining validity of the stapled OCSP response is below the largest warning threshold (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var certificateRevoked = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "certificate_revoked",
+		Help:      "Whether the stapled OCSP response or, with -ocsp-responder, the OCSP responder of the CA says that the leaf certificate was revoked (1) or not (0), by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var ocspResponderSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "ocsp_responder_success",
+		Help:      "Whether the OCSP responder of the leaf certificate answered the most recent query with a valid response (1) or not (0), by domain name. Only with -ocsp-responder.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Parses the OCSP response that a server stapled to the handshake.
+// If the chain contains the issuer, the signature gets verified.
+func ParseStaple(staple []byte, chain []*x509.Certificate) (*ocsp.Response, error) {
+	if len(chain) > 1 {
+		return ocsp.ParseResponseForCert(staple, chain[0], chain[1])
+	}
+	return ocsp.ParseResponse(staple, nil)
+}
+
+// Parses a comma-separated list of durations, such as "48h,24h,6h",
+// and returns them sorted in descending order.
+func ParseDurations(s string) ([]time.Duration, error) {
+	var result []time.Duration
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		d, err := time.ParseDuration(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] > result[j] })
+	return result, nil
+}
+
+// Exports the freshness of the OCSP staple in a check result, and logs
+// an event whenever its remaining validity falls below another of the
+// thresholds. Returns the smallest threshold crossed, or zero.
+func (cm *CertMon) observeStaple(domain string, result *CheckResult, previous time.Duration) time.Duration {
+	thresholds := cm.opts.StapleThresholds
+	if result.Staple == nil {
+		ocspStaplePresent.WithLabelValues(domain).Set(0)
+		ocspStapleNextUpdate.DeleteLabelValues(domain)
+		ocspStapleExpiring.DeleteLabelValues(domain)
+		return 0
+	}
+
+	ocspStaplePresent.WithLabelValues(domain).Set(1)
+	next := result.Staple.NextUpdate
+	if next.IsZero() {
+		ocspStapleNextUpdate.DeleteLabelValues(domain)
+		ocspStapleExpiring.DeleteLabelValues(domain)
+		return 0
+	}
+	ocspStapleNextUpdate.WithLabelValues(domain).Set(float64(next.Unix()))
+
+	remaining := time.Until(next)
+	var crossed time.Duration
+	for _, t := range thresholds {
+		if remaining < t {
+			crossed = t
+		}
+	}
+	ocspStapleExpiring.WithLabelValues(domain).Set(boolToFloat(crossed != 0))
+	if crossed != 0 && (previous == 0 || crossed < previous) {
+		cm.opts.Events.Record(Event{
+			Type:    EventStapleThresholdCrossed,
+			Domain:  domain,
+			Message: fmt.Sprintf(stapleThresholdMessage, crossed),
+		})
+	}
+	return crossed
+}
+
+// Asks the OCSP responder named in the leaf of a chain about its status.
+// The issuer gets downloaded if the server did not present it.
+func QueryResponder(chain []*x509.Certificate, timeout time.Duration) (*ocsp.Response, error) {
+	leaf := chain[0]
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errors.New("certificate names no OCSP responder")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	} else {
+		var err error
+		if issuer, err = fetchIssuer(ctx, leaf); err != nil {
+			return nil, err
+		}
+	}
+	return queryOCSP(ctx, leaf.OCSPServer[0], leaf, issuer)
+}
+
+// Returns when the leaf certificate was revoked according to the stapled
+// OCSP response or the one from the responder, and which of them said
+// so, or the zero time if neither did. A response from the responder
+// only counts if it is about the leaf, since it gets refreshed by deep
+// scans only.
+func revocation(leaf *x509.Certificate, staple, responder *ocsp.Response) (time.Time, string) {
+	if staple != nil && staple.Status == ocsp.Revoked {
+		return staple.RevokedAt, "stapled OCSP response"
+	}
+	if responder != nil && responder.Status == ocsp.Revoked && responder.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+		return responder.RevokedAt, "OCSP responder"
+	}
+	return time.Time{}, ""
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Where to deliver the results of a single sweep, for running certmon
+// from cron in environments that forbid long-running daemons.
+type OnceOutputs struct {
+	// File for writing the results as JSON, in the format pushed to a
+	// central certmon; "-" means standard output.
+	File string
+
+	// If not nil, the results get pushed to a central certmon.
+	Pusher *Pusher
+
+	// If not empty, the metrics get pushed to the Prometheus Pushgateway
+	// at this URL, under the job name "certmon".
+	Pushgateway string
+}
+
+// Checks every target once, with up to concurrency checks at the same
+// time, and returns when all checks are done.
+func (cm *CertMon) CheckAll(concurrency int) {
+	cm.mutex.Lock()
+	domains := make([]string, 0, len(cm.domains))
+	for domain := range cm.domains {
+		domains = append(domains, domain)
+	}
+	cm.mutex.Unlock()
+	sort.Strings(domains)
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, domain := range domains {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(domain string) {
+			defer wg.Done()
+			checksInFlight.Inc()
+			cm.check(domain)
+			checksInFlight.Dec()
+			cm.checked(domain)
+			<-sem
+		}(domain)
+	}
+	wg.Wait()
+}
+
+// Checks every target once, delivers the results to out, and returns
+// the exit status for the process: 0 if all checks succeeded, 1 if some
+// check failed, and 2 if the results could not be delivered.
+func (cm *CertMon) RunOnce(ctx context.Context, concurrency int, out OnceOutputs) int {
+	cm.CheckAll(concurrency)
+	report := cm.AgentReport()
+
+	exitCode := 0
+	for _, r := range report.Results {
+		if !r.Success {
+			log.Printf("%s: %s", r.Domain, r.Error)
+			exitCode = 1
+		}
+	}
+
+	if out.File != "" {
+		if err := writeReport(out.File, report); err != nil {
+			log.Printf("writing results: %v", err)
+			exitCode = 2
+		}
+	}
+	if out.Pusher != nil {
+		if err := out.Pusher.Push(ctx, report); err != nil {
+			log.Printf("pushing results to %s: %v", out.Pusher.url, err)
+			exitCode = 2
+		}
+	}
+	if out.Pushgateway != "" {
+		pusher := push.New(out.Pushgateway, "certmon").Gatherer(prometheus.DefaultGatherer)
+		if err := pusher.Push(); err != nil {
+			log.Printf("pushing metrics to %s: %v", out.Pushgateway, err)
+			exitCode = 2
+		}
+	}
+	return exitCode
+}
+
+func writeReport(filename string, report *AgentReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if filename == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	// Write to a temporary file first, so readers never see a
+	// partially written one.
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
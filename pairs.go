@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pairIssuerMismatch = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "pair_issuer_mismatch",
+		Help:      "Whether two paired domains serve certificates from different certificate authorities (1) or not (0).",
+	},
+	[]string{
+		"domain",
+		"peer",
+	},
+)
+
+var pairSANMismatch = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "pair_san_mismatch",
+		Help:      "Whether two paired domains serve certificates whose subject alternative names differ (1) or not (0), after replacing each domain by a placeholder.",
+	},
+	[]string{
+		"domain",
+		"peer",
+	},
+)
+
+// Two targets that are expected to serve equivalent certificates,
+// such as a staging and a production environment.
+type Pair struct {
+	Domain, Peer string
+}
+
+// Parses a comma-separated list of pairs, such as
+// "staging.example.org=example.org,test.example.net=example.net".
+func ParsePairs(s string) ([]Pair, error) {
+	var pairs []Pair
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		parts := strings.Split(p, "=")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad pair %q, expected domain=peer", p)
+		}
+		pairs = append(pairs, Pair{Domain: parts[0], Peer: parts[1]})
+	}
+	return pairs, nil
+}
+
+// Returns the name of the certificate authority that issued cert.
+// Authorities often operate several intermediates, such as "R10" and
+// "R11" for Let's Encrypt, so we compare the organization if there is one.
+func issuerName(cert *x509.Certificate) string {
+	if len(cert.Issuer.Organization) > 0 {
+		return strings.Join(cert.Issuer.Organization, ", ")
+	}
+	return cert.Issuer.String()
+}
+
+// Returns the subject alternative names of cert, sorted, with domain
+// and its subdomains replaced by a placeholder. For example, the names
+// of www.staging.example.org for domain staging.example.org become
+// "www.*", so they can be compared to those of another environment.
+func relativeSANs(cert *x509.Certificate, domain string) []string {
+	names := make([]string, 0, len(cert.DNSNames))
+	for _, name := range cert.DNSNames {
+		name = strings.ToLower(name)
+		if name == domain {
+			name = "*"
+		} else if strings.HasSuffix(name, "."+domain) {
+			name = strings.TrimSuffix(name, domain) + "*"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Compares the leaf certificates of a pair of domains, returning whether
+// their issuers and their relative subject alternative names match.
+func (p Pair) Compare(cert, peerCert *x509.Certificate) (sameIssuer, sameSANs bool) {
+	sameIssuer = issuerName(cert) == issuerName(peerCert)
+	a := relativeSANs(cert, p.Domain)
+	b := relativeSANs(peerCert, p.Peer)
+	sameSANs = strings.Join(a, " ") == strings.Join(b, " ")
+	return sameIssuer, sameSANs
+}
+
+func (p Pair) exportMetrics(cert, peerCert *x509.Certificate) {
+	sameIssuer, sameSANs := p.Compare(cert, peerCert)
+	pairIssuerMismatch.WithLabelValues(p.Domain, p.Peer).Set(boolToFloat(!sameIssuer))
+	pairSANMismatch.WithLabelValues(p.Domain, p.Peer).Set(boolToFloat(!sameSANs))
+}
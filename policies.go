@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var certificateValidation = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "certificate_validation_level",
+		Help:      "Always 1, labeled with the validation level (dv, iv, ov, ev or unknown) that the policies of the leaf certificate assert, by domain name.",
+	},
+	[]string{
+		"domain",
+		"level",
+	},
+)
+
+// Certificate policies reserved by the CA/Browser Forum for asserting
+// how the CA validated the subject. Since 2020, the Baseline Requirements
+// oblige publicly trusted CAs to include one of them in every certificate.
+var (
+	oidPolicyEV = asn1.ObjectIdentifier{2, 23, 140, 1, 1}
+	oidPolicyDV = asn1.ObjectIdentifier{2, 23, 140, 1, 2, 1}
+	oidPolicyOV = asn1.ObjectIdentifier{2, 23, 140, 1, 2, 2}
+	oidPolicyIV = asn1.ObjectIdentifier{2, 23, 140, 1, 2, 3}
+)
+
+// Label values of certmon_certificate_validation_level.
+var validationLevels = []string{"dv", "iv", "ov", "ev", "unknown"}
+
+// Returns the validation level asserted by the policies of a certificate,
+// as in "EV", or an empty string if it asserts none. If a certificate
+// asserts several levels, the highest one wins.
+func validationLevel(cert *x509.Certificate) string {
+	level := ""
+	for _, oid := range cert.PolicyIdentifiers {
+		switch {
+		case oid.Equal(oidPolicyEV):
+			return "EV"
+		case oid.Equal(oidPolicyOV):
+			level = "OV"
+		case oid.Equal(oidPolicyIV) && level != "OV":
+			level = "IV"
+		case oid.Equal(oidPolicyDV) && level == "":
+			level = "DV"
+		}
+	}
+	return level
+}
+
+// Returns the policy identifiers of a certificate in dotted notation,
+// separated by commas.
+func policyOIDs(cert *x509.Certificate) string {
+	oids := make([]string, 0, len(cert.PolicyIdentifiers))
+	for _, oid := range cert.PolicyIdentifiers {
+		oids = append(oids, oid.String())
+	}
+	return strings.Join(oids, ", ")
+}
+
+func exportValidationLevel(domain string, cert *x509.Certificate) {
+	level := strings.ToLower(validationName(validationLevel(cert)))
+	for _, l := range validationLevels {
+		if l != level {
+			certificateValidation.DeleteLabelValues(domain, l)
+		}
+	}
+	certificateValidation.WithLabelValues(domain, level).Set(1)
+}
+
+// Returns a validation level for display, where the empty level
+// of certificates without a CA/Browser Forum policy is "unknown".
+func validationName(level string) string {
+	if level == "" {
+		return "unknown"
+	}
+	return level
+}
@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Checks a target on demand and serves metrics for just that target,
+// following the multi-target exporter pattern of the Prometheus
+// blackbox exporter. The target comes in the syntax of the -hosts flag,
+// URL-encoded, as in /probe?target=example.org:8443. This lets the
+// target list live in Prometheus scrape configurations:
+//
+//	scrape_configs:
+//	  - job_name: certmon
+//	    metrics_path: /probe
+//	    static_configs:
+//	      - targets: [example.org, mail.example.org:25?protocol=smtp]
+//	    relabel_configs:
+//	      - source_labels: [__address__]
+//	        target_label: __param_target
+//	      - source_labels: [__param_target]
+//	        target_label: instance
+//	      - target_label: __address__
+//	        replacement: certmon:8080
+//
+// Options that read local files, such as client_cert or ca_file, are
+// rejected.
+func HandleProbe(w http.ResponseWriter, r *http.Request) {
+	spec := r.URL.Query().Get("target")
+
+	// Anyone who can reach /probe could otherwise make certmon present
+	// any certificate it can read to a server of their choice, or find
+	// out which files exist on the machine that runs certmon. This gets
+	// checked before parsing, which already reads the files.
+	if i := strings.IndexByte(spec, '?'); i >= 0 {
+		options, _ := url.ParseQuery(spec[i+1:])
+		for _, key := range []string{"client_cert", "client_key", "ca_file", "trusted_intermediates"} {
+			if _, ok := options[key]; ok {
+				http.Error(w, "bad target: "+key+" is not supported for probes", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	t, err := ParseTarget(spec)
+	if err != nil {
+		http.Error(w, "bad target: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Finish before Prometheus gives up on the scrape.
+	timeout := t.CheckTimeout()
+	if s := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); s != "" {
+		if secs, err := strconv.ParseFloat(s, 64); err == nil && secs > 0 {
+			if d := time.Duration(secs * float64(time.Second)); d < timeout {
+				timeout = d
+			}
+		}
+	}
+
+	success := prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "probe_success",
+		Help:      "Whether the TLS handshake succeeded on all ports of the target (1) or not (0).",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "probe_duration_seconds",
+		Help:      "How long the probe took, in seconds.",
+	})
+
+	// Same metrics as for the monitored targets.
+	expiration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "tls_certificate_expiration_timestamp",
+		Help:      "TLS certificate expiration dates, in seconds since 1970-01-01 midnight UTC, by domain name.",
+	}, []string{"domain"})
+	mismatch := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "hostname_mismatch",
+		Help:      "Whether the served certificate is not valid for the domain name (1) or it is (0), by domain name.",
+	}, []string{"domain"})
+	targetIP := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "check_target_ip",
+		Help:      "Always 1, labeled with the IP address that the check connected to, by domain name and port.",
+	}, []string{"domain", "port", "ip"})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(success, duration, expiration, mismatch, targetIP)
+
+	start := time.Now()
+	ok := true
+	var earliest time.Time
+	for _, port := range t.Ports {
+		result, err := checkCertificateAt(t.DNSResolver(), t.ProxyURL(port), t.Host, t.Host, port, t.Protocol, t.TLSConfig(), t.CheckConnectTimeout(), timeout)
+		if err != nil {
+			log.Printf("probe %s:%d: %v", t.Host, port, err)
+			ok = false
+			var hostErr x509.HostnameError
+			if errors.As(err, &hostErr) {
+				mismatch.WithLabelValues(t.Host).Set(1)
+			}
+			continue
+		}
+		targetIP.WithLabelValues(t.Host, strconv.Itoa(port), result.Address).Set(1)
+		if earliest.IsZero() || result.Expiration.Before(earliest) {
+			earliest = result.Expiration
+		}
+	}
+	if ok {
+		mismatch.WithLabelValues(t.Host).Set(0)
+	}
+	if !earliest.IsZero() {
+		expiration.WithLabelValues(t.Host).Set(float64(earliest.Unix()))
+	}
+	success.Set(boolToFloat(ok))
+	duration.Set(time.Since(start).Seconds())
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
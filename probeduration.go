@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var probeDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Subsystem: "certmon",
+		Name:      "probe_duration_seconds",
+		Help:      "How long the phases of successful checks took, in seconds, by domain name and phase (dns, connect, handshake). The handshake phase includes any STARTTLS negotiation; with a proxy, the connect phase includes talking to the proxy.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{
+		"domain",
+		"phase",
+	},
+)
+
+// Label values of certmon_probe_duration_seconds.
+var probePhases = []string{"dns", "connect", "handshake"}
+
+// How long the phases of a check took. DNS is zero if no name
+// had to be looked up, because the check connected to an IP address
+// or the proxy looked up the name.
+type PhaseDurations struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	Handshake time.Duration
+}
+
+// Wraps dial so that the time spent in it gets added to total.
+func timedDialer(dial dialFunc, total *time.Duration) dialFunc {
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(addr, timeout)
+		*total += time.Since(start)
+		return conn, err
+	}
+}
+
+func observeProbeDuration(domain string, d PhaseDurations) {
+	if d.DNS > 0 {
+		probeDuration.WithLabelValues(domain, "dns").Observe(d.DNS.Seconds())
+	}
+	probeDuration.WithLabelValues(domain, "connect").Observe(d.Connect.Seconds())
+	probeDuration.WithLabelValues(domain, "handshake").Observe(d.Handshake.Seconds())
+}
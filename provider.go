@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var targetProvider = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "target_provider",
+		Help:      "Always 1, labeled with the CDN or hosting provider that serves a target (cloudflare, fastly, akamai, aws, azure, google or self-hosted), as guessed from the certificate issuer and names, the CNAME of the target, and the reverse DNS of its addresses, by domain name. For grouping alerts by provider.",
+	},
+	[]string{
+		"domain",
+		"provider",
+	},
+)
+
+// Signals for recognizing a provider. Suffixes get matched against the
+// canonical name of the target, its reverse DNS names and the names in
+// its certificate; issuers against the organization of the issuer.
+type providerSignals struct {
+	name     string
+	suffixes []string
+	issuers  []string
+}
+
+// Providers in the order in which they get tried. CDNs come first,
+// since they often front origins in the clouds.
+var providers = []providerSignals{
+	{
+		name:     "cloudflare",
+		suffixes: []string{".cdn.cloudflare.net", ".cloudflaressl.com"},
+		issuers:  []string{"Cloudflare, Inc."},
+	},
+	{
+		name:     "fastly",
+		suffixes: []string{".fastly.net", ".fastlylb.net"},
+		issuers:  []string{"Certainly"},
+	},
+	{
+		name:     "akamai",
+		suffixes: []string{".akamaiedge.net", ".edgekey.net", ".edgesuite.net", ".akamai.net", ".akamaitechnologies.com"},
+	},
+	{
+		name:     "aws",
+		suffixes: []string{".cloudfront.net", ".amazonaws.com"},
+		issuers:  []string{"Amazon"},
+	},
+	{
+		name:     "azure",
+		suffixes: []string{".azureedge.net", ".azurefd.net", ".azurewebsites.net", ".cloudapp.azure.com", ".trafficmanager.net"},
+		issuers:  []string{"Microsoft Corporation"},
+	},
+	{
+		name:     "google",
+		suffixes: []string{".googlehosted.com", ".googleusercontent.com", ".1e100.net", ".appspot.com"},
+	},
+}
+
+// Returns the provider that serves a target with the given certificate,
+// canonical name and reverse DNS names, or "self-hosted" if none of the
+// known providers matches.
+func classifyProvider(leaf *x509.Certificate, cname string, reverseNames []string) string {
+	names := append([]string{cname}, reverseNames...)
+	names = append(names, leaf.DNSNames...)
+	for _, p := range providers {
+		for _, org := range leaf.Issuer.Organization {
+			if contains(p.issuers, org) {
+				return p.name
+			}
+		}
+		for _, name := range names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			for _, suffix := range p.suffixes {
+				if strings.HasSuffix(name, suffix) {
+					return p.name
+				}
+			}
+		}
+	}
+	return "self-hosted"
+}
+
+// Guesses the provider that serves a target, and exports it. Looking up
+// the canonical name needs a DNS query, which is why this is part of
+// deep scans; reverse DNS names are only known with -enrich.
+func (cm *CertMon) observeProvider(domain string, target Target, leaf *x509.Certificate) {
+	var cname string
+	if net.ParseIP(target.Host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), target.CheckTimeout())
+		countLookup()
+		cname, _ = target.DNSResolver().LookupCNAME(ctx, target.Host)
+		cancel()
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	status, ok := cm.domains[domain]
+	if !ok {
+		return
+	}
+	var reverseNames []string
+	if cm.opts.Enricher != nil {
+		addrs := make([]string, 0, len(status.addresses))
+		for _, addr := range status.addresses {
+			addrs = append(addrs, addr)
+		}
+		reverseNames = cm.opts.Enricher.ReverseNames(addrs)
+	}
+	provider := classifyProvider(leaf, cname, reverseNames)
+	if status.provider != "" && status.provider != provider {
+		targetProvider.DeleteLabelValues(domain, status.provider)
+	}
+	targetProvider.WithLabelValues(domain, provider).Set(1)
+	status.provider = provider
+}
@@ -0,0 +1,288 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Opens a TCP connection to addr, giving up after timeout.
+type dialFunc func(addr string, timeout time.Duration) (net.Conn, error)
+
+func dialDirect(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// Proxy for targets without a proxy option, given by -proxy; if nil,
+// the proxy gets taken from the HTTPS_PROXY and NO_PROXY environment
+// variables.
+var defaultProxy *url.URL
+
+// Parses the URL of a proxy, such as "http://proxy.example.org:3128"
+// or "socks5://localhost:1080".
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in proxy %q", s)
+	}
+	return u, nil
+}
+
+// Returns the proxy for reaching host on port, or nil for connecting
+// directly.
+func proxyFor(host string, port int) *url.URL {
+	if defaultProxy != nil {
+		return defaultProxy
+	}
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: net.JoinHostPort(host, strconv.Itoa(port))}}
+	proxy, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		return nil
+	}
+	return proxy
+}
+
+// Returns a function that dials through proxy, or directly if proxy
+// is nil.
+func proxyDialer(proxy *url.URL) dialFunc {
+	if proxy == nil {
+		return dialDirect
+	}
+	if proxy.Scheme == "socks5" {
+		return func(addr string, timeout time.Duration) (net.Conn, error) {
+			return dialSOCKS5(proxy, addr, timeout)
+		}
+	}
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		return dialHTTPProxy(proxy, addr, timeout)
+	}
+}
+
+// Asks an HTTP proxy to open a tunnel to addr, with the CONNECT method.
+func dialHTTPProxy(proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", proxy.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Servers that speak first, such as SMTP, may have sent their
+	// greeting along with the response of the proxy.
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// A connection whose first bytes were read into a buffer already.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Asks a SOCKS5 proxy to connect to addr, as specified in RFC 1928.
+// The host name is passed to the proxy for resolving, which is what
+// SSH dynamic forwards and Tor expect. If the proxy URL has a user,
+// it gets authenticated with username and password (RFC 1929).
+func dialSOCKS5(proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("bad port in %q", addr)
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name too long: %q", host)
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "1080")
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := socks5Connect(conn, proxy.User, host, port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	const (
+		noAuth       = 0x00
+		passwordAuth = 0x02
+	)
+	method := byte(noAuth)
+	if user != nil {
+		method = passwordAuth
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	if reply[1] != method {
+		return fmt.Errorf("SOCKS5 authentication method not accepted")
+	}
+
+	if method == passwordAuth {
+		password, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS5 credentials too long")
+		}
+		msg := []byte{1, byte(len(name))}
+		msg = append(msg, name...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, 1)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	} else {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [4]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return fmt.Errorf("SOCKS5 CONNECT %s: %s", net.JoinHostPort(host, strconv.Itoa(port)), socks5Error(resp[1]))
+	}
+
+	// Skip the address the proxy bound to.
+	var skip int
+	switch resp[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("bad SOCKS5 address type %d", resp[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func socks5Error(code byte) string {
+	switch code {
+	case 1:
+		return "general failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("error %d", code)
+}
@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Status of a domain as shown to the public, without any internal
+// details such as ports, addresses, error messages or notes.
+type PublicDomainStatus struct {
+	Domain string `json:"domain"`
+
+	// "ok", "failing" or "unknown".
+	Status     string     `json:"status"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+// Serves the status of an allowlisted set of domains for external status
+// page generators, at /public/status.json.
+type PublicStatus struct {
+	cm      *CertMon
+	domains []string
+}
+
+func NewPublicStatus(cm *CertMon, domains []string) *PublicStatus {
+	sorted := append([]string(nil), domains...)
+	sort.Strings(sorted)
+	return &PublicStatus{cm: cm, domains: sorted}
+}
+
+// Returns "ok", "failing" or "unknown" if the target was not checked yet.
+func (s *domainStatus) state() string {
+	if s.failing {
+		return "failing"
+	} else if s.leaf != nil {
+		return "ok"
+	}
+	return "unknown"
+}
+
+func (ps *PublicStatus) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	result := make([]PublicDomainStatus, 0, len(ps.domains))
+	ps.cm.mutex.Lock()
+	for _, domain := range ps.domains {
+		s := PublicDomainStatus{Domain: domain, Status: "unknown"}
+		if status, ok := ps.cm.domains[domain]; ok {
+			s.Status = status.state()
+			if !status.expiration.IsZero() {
+				exp := status.expiration.UTC()
+				s.Expiration = &exp
+			}
+		}
+		result = append(result, s)
+	}
+	ps.cm.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
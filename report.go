@@ -0,0 +1,297 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Generates weekly and monthly summaries from the event log.
+type Reporter struct {
+	events *EventLog
+
+	// Renewals with less lead time than this count as near-misses.
+	nearMiss time.Duration
+
+	// If not empty, reports for each completed period get written
+	// into this directory.
+	dir string
+}
+
+type Report struct {
+	Period     string
+	Start, End time.Time
+
+	Renewals        []ReportRenewal
+	NearMisses      []ReportRenewal
+	AverageLeadTime time.Duration
+	Failing         []ReportFailure
+}
+
+type ReportRenewal struct {
+	Domain   string
+	Detected time.Time
+	LeadTime time.Duration
+}
+
+type ReportFailure struct {
+	Domain    string
+	Failures  int
+	LastError string
+}
+
+func NewReporter(events *EventLog, nearMiss time.Duration, dir string) *Reporter {
+	return &Reporter{events: events, nearMiss: nearMiss, dir: dir}
+}
+
+// Returns the start and end of the week or month containing day.
+// Weeks start on Monday.
+func reportPeriod(period string, day time.Time) (time.Time, time.Time, error) {
+	day = day.UTC()
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "week":
+		start := midnight.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7), nil
+	case "month":
+		start := midnight.AddDate(0, 0, 1-day.Day())
+		return start, start.AddDate(0, 1, 0), nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown report period %q", period)
+	}
+}
+
+// Builds the report for the time interval [start, end).
+func (rep *Reporter) Build(period string, start, end time.Time) *Report {
+	r := &Report{Period: period, Start: start, End: end}
+
+	var totalLeadTime time.Duration
+	failing := make(map[string]*ReportFailure)
+	failingAtStart := make(map[string]bool)
+	for _, e := range rep.events.Query("", "", time.Time{}) {
+		if !e.Time.Before(end) {
+			break
+		}
+		if e.Time.Before(start) {
+			switch e.Type {
+			case EventCheckFailed, EventHostnameMismatch:
+				failingAtStart[e.Domain] = true
+			case EventCheckRecovered:
+				delete(failingAtStart, e.Domain)
+			}
+			continue
+		}
+
+		switch e.Type {
+		case EventRenewalDetected:
+			if e.OldExpiration == nil {
+				continue
+			}
+			renewal := ReportRenewal{
+				Domain:   e.Domain,
+				Detected: e.Time,
+				LeadTime: e.OldExpiration.Sub(e.Time),
+			}
+			r.Renewals = append(r.Renewals, renewal)
+			totalLeadTime += renewal.LeadTime
+			if renewal.LeadTime < rep.nearMiss {
+				r.NearMisses = append(r.NearMisses, renewal)
+			}
+
+		case EventCheckFailed, EventHostnameMismatch:
+			f := failing[e.Domain]
+			if f == nil {
+				f = &ReportFailure{Domain: e.Domain}
+				failing[e.Domain] = f
+			}
+			f.Failures += 1
+			f.LastError = e.Message
+		}
+	}
+
+	for domain := range failingAtStart {
+		if failing[domain] == nil {
+			failing[domain] = &ReportFailure{Domain: domain}
+		}
+	}
+	for _, f := range failing {
+		r.Failing = append(r.Failing, *f)
+	}
+	sort.Slice(r.Failing, func(i, j int) bool {
+		return r.Failing[i].Domain < r.Failing[j].Domain
+	})
+
+	if len(r.Renewals) > 0 {
+		r.AverageLeadTime = totalLeadTime / time.Duration(len(r.Renewals))
+	}
+	return r
+}
+
+func formatDays(d time.Duration) string {
+	return strconv.FormatFloat(d.Hours()/24, 'f', 1, 64)
+}
+
+func (r *Report) WriteHTML(w io.Writer) error {
+	title := fmt.Sprintf("CertMon report for the %s of %s", r.Period, r.Start.Format("2006-01-02"))
+	fmt.Fprintf(w, "%s<body><h1>%s</h1>\n", htmlHead, html.EscapeString(title))
+	fmt.Fprintf(w, "<p>Period: %s to %s</p>\n",
+		r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+	fmt.Fprintf(w, "<p>Certificates renewed: %d<br/>Near-misses: %d<br/>Average renewal lead time: %s days<br/>Targets with failing checks: %d</p>\n",
+		len(r.Renewals), len(r.NearMisses), formatDays(r.AverageLeadTime), len(r.Failing))
+
+	writeRenewals := func(heading string, renewals []ReportRenewal) {
+		fmt.Fprintf(w, "<h2>%s</h2>\n<p><table>\n<tr><th>Domain</th><th>Renewal detected</th><th>Lead time [days]</th></tr>\n", heading)
+		for _, ren := range renewals {
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+				html.EscapeString(ren.Domain), ren.Detected.Format(time.RFC3339), formatDays(ren.LeadTime))
+		}
+		fmt.Fprintf(w, "</table></p>\n")
+	}
+	writeRenewals("Renewed certificates", r.Renewals)
+	writeRenewals("Near-misses", r.NearMisses)
+
+	fmt.Fprintf(w, "<h2>Failing checks</h2>\n<p><table>\n<tr><th>Domain</th><th>Failures</th><th>Last error</th></tr>\n")
+	for _, f := range r.Failing {
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+			html.EscapeString(f.Domain), f.Failures, html.EscapeString(f.LastError))
+	}
+	_, err := fmt.Fprintf(w, "</table></p></body></html>\n")
+	return err
+}
+
+// Writes the report as CSV, one row per renewal and failing target.
+func (r *Report) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"kind", "domain", "time", "lead_time_days", "failures", "last_error"})
+	nearMiss := make(map[ReportRenewal]bool, len(r.NearMisses))
+	for _, ren := range r.NearMisses {
+		nearMiss[ren] = true
+	}
+	for _, ren := range r.Renewals {
+		kind := "renewal"
+		if nearMiss[ren] {
+			kind = "near_miss"
+		}
+		out.Write([]string{kind, ren.Domain, ren.Detected.Format(time.RFC3339), formatDays(ren.LeadTime), "", ""})
+	}
+	for _, f := range r.Failing {
+		out.Write([]string{"failing", f.Domain, "", "", strconv.Itoa(f.Failures), f.LastError})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Serves a report. The query parameter period is "week" or "month",
+// format is "html" or "csv", and date (YYYY-MM-DD) selects the period
+// containing that day. Without a date, the report covers the most
+// recently completed period.
+func (rep *Reporter) HandleReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	period := q.Get("period")
+	if period == "" {
+		period = "month"
+	}
+
+	day := time.Now()
+	if d := q.Get("date"); d != "" {
+		t, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			http.Error(w, "bad value for date: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		day = t
+	} else if start, _, err := reportPeriod(period, day); err == nil {
+		day = start.Add(-time.Hour)
+	}
+
+	start, end, err := reportPeriod(period, day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := rep.Build(period, start, end)
+	switch q.Get("format") {
+	case "", "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		report.WriteHTML(w)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		report.WriteCSV(w)
+	default:
+		http.Error(w, "unknown report format", http.StatusBadRequest)
+	}
+}
+
+// Periodically writes reports for completed weeks and months into
+// the report directory, unless they exist already.
+func (rep *Reporter) Run(ctx context.Context) {
+	if rep.dir == "" {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		for _, period := range []string{"week", "month"} {
+			if err := rep.writeCompleted(period, time.Now()); err != nil {
+				log.Printf("writing %s report: %v", period, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rep *Reporter) writeCompleted(period string, now time.Time) error {
+	current, _, err := reportPeriod(period, now)
+	if err != nil {
+		return err
+	}
+	start, end, err := reportPeriod(period, current.Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Join(rep.dir, fmt.Sprintf("certmon-%s-%s", period, start.Format("2006-01-02")))
+	if _, err := os.Stat(base + ".html"); err == nil {
+		return nil
+	}
+
+	report := rep.Build(period, start, end)
+	writers := []struct {
+		ext   string
+		write func(io.Writer) error
+	}{
+		{".csv", report.WriteCSV},
+		{".html", report.WriteHTML},
+	}
+	for _, wr := range writers {
+		f, err := os.Create(base + wr.ext)
+		if err != nil {
+			return err
+		}
+		if err := wr.write(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var openConnections = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "open_connections",
+		Help:      "Number of connections that checks currently have open to targets and proxies.",
+	},
+)
+
+var sweepPeakConnections = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "sweep_connections_peak",
+		Help:      "Largest number of connections that checks had open at the same time during the most recent sweep.",
+	},
+)
+
+var sweepBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "sweep_bytes",
+		Help:      "Bytes that checks sent to and received from targets and proxies during the most recent sweep, by direction (sent, received). DNS traffic is not included.",
+	},
+	[]string{
+		"direction",
+	},
+)
+
+var sweepDNSLookups = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "sweep_dns_lookups",
+		Help:      "Number of names that checks looked up during the most recent sweep.",
+	},
+)
+
+// Resources used by checks since the current sweep started.
+type resourceUsage struct {
+	mutex          sync.Mutex
+	open, peak     int
+	sent, received int64
+	lookups        int
+}
+
+var usage resourceUsage
+
+// Limits how many connections checks may have open at the same time,
+// set by -max-connections; nil means no limit.
+var connectionSlots chan struct{}
+
+var errTooManyConnections = errors.New("too many open connections")
+
+// Waits for a free connection slot, giving up when ctx is done.
+func acquireConnection(ctx context.Context) error {
+	if connectionSlots == nil {
+		return nil
+	}
+	select {
+	case connectionSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errTooManyConnections
+	}
+}
+
+func releaseConnection() {
+	if connectionSlots != nil {
+		<-connectionSlots
+	}
+}
+
+// Wraps dial so that its connections get counted, and wait for a free
+// slot if connections are limited. Waiting counts towards the timeout.
+func countedDialer(dial dialFunc) dialFunc {
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := acquireConnection(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(addr, timeout-time.Since(start))
+		return countConnection(conn, err)
+	}
+}
+
+// Like countedDialer, for the DialContext of HTTP transports. Since
+// the dialer looks up names itself, lookups get counted here too.
+func countedDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) == nil {
+			countLookup()
+		}
+		if err := acquireConnection(ctx); err != nil {
+			return nil, err
+		}
+		return countConnection(dial(ctx, network, addr))
+	}
+}
+
+func countConnection(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		releaseConnection()
+		return nil, err
+	}
+	usage.mutex.Lock()
+	usage.open += 1
+	if usage.open > usage.peak {
+		usage.peak = usage.open
+	}
+	usage.mutex.Unlock()
+	openConnections.Inc()
+	return &countedConn{Conn: conn}, nil
+}
+
+// Notes that a check looked up a name in DNS.
+func countLookup() {
+	usage.mutex.Lock()
+	usage.lookups += 1
+	usage.mutex.Unlock()
+}
+
+// Exports the resources used during the sweep that just completed,
+// and starts counting afresh for the next one.
+func exportSweepUsage() {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	sweepPeakConnections.Set(float64(usage.peak))
+	sweepBytes.WithLabelValues("sent").Set(float64(usage.sent))
+	sweepBytes.WithLabelValues("received").Set(float64(usage.received))
+	sweepDNSLookups.Set(float64(usage.lookups))
+	usage.peak = usage.open
+	usage.sent, usage.received, usage.lookups = 0, 0, 0
+}
+
+// A connection whose traffic gets added to the resource usage, and
+// which frees its connection slot when closed.
+type countedConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	usage.mutex.Lock()
+	usage.received += int64(n)
+	usage.mutex.Unlock()
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	usage.mutex.Lock()
+	usage.sent += int64(n)
+	usage.mutex.Unlock()
+	return n, err
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		usage.mutex.Lock()
+		usage.open -= 1
+		usage.mutex.Unlock()
+		openConnections.Dec()
+		releaseConnection()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Appends the results of every sweep as newline-delimited JSON, one
+// line per target, for log pipelines such as jq, Loki or a SIEM.
+type ResultWriter struct {
+	mutex    sync.Mutex
+	filename string
+}
+
+// A line written by ResultWriter, such as
+// {"time":"2021-07-01T12:00:00Z","domain":"example.org","expiration":"2021-09-01T00:00:00Z","success":true}.
+type resultLine struct {
+	Time time.Time `json:"time"`
+	AgentResult
+}
+
+// Creates a writer that appends to filename, or writes to standard
+// output if filename is "-". The file gets opened for every sweep, so
+// it can be rotated by external tools.
+func NewResultWriter(filename string) *ResultWriter {
+	return &ResultWriter{filename: filename}
+}
+
+func (rw *ResultWriter) Write(report *AgentReport) error {
+	now := time.Now().UTC()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range report.Results {
+		if err := enc.Encode(resultLine{Time: now, AgentResult: r}); err != nil {
+			return err
+		}
+	}
+
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	var w io.Writer = os.Stdout
+	if rw.filename != "-" {
+		f, err := os.OpenFile(rw.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var checkRetries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "certmon",
+		Name:      "check_retries_total",
+		Help:      "Number of handshakes that got retried after a failure that may have been transient, by domain name.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Default number of attempts for reaching the handshake with a target
+// before its check fails, set by -attempts.
+var defaultAttempts = 3
+
+// Delay before the first retry, set by -retry-delay. It doubles with
+// every further retry.
+var retryDelay = time.Second
+
+// Returns how often to attempt the handshake with the target before
+// its check fails.
+func (t *Target) CheckAttempts() int {
+	if t.Attempts > 0 {
+		return t.Attempts
+	}
+	return defaultAttempts
+}
+
+// Tells whether a failed check may succeed when retried shortly after.
+// Certificates that do not verify and names that do not exist won't
+// change within seconds.
+func isTransient(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	return !isVerificationError(err)
+}
+
+// Checks the certificate of a target on one of its ports, retrying
+// transient failures with exponential backoff and jitter, so that
+// a network blip does not fail the check.
+func (cm *CertMon) checkPortWithRetries(domain string, target Target, port int) (*CheckResult, error) {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		result, err := target.checkPort(port, target.TLSConfig())
+		if err == nil || attempt >= target.CheckAttempts() || !isTransient(err) {
+			return result, err
+		}
+		checkRetries.WithLabelValues(domain).Inc()
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-cm.ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
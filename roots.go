@@ -0,0 +1,257 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rootExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "root_expiration_timestamp",
+		Help:      "Earliest expiration date of the root certificates that the chain of a domain anchors to, in seconds since 1970-01-01 midnight UTC.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var rootExpiring = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "root_expiring",
+		Help:      "Whether the chain of a domain anchors to a root certificate that expires within the configured window (1) or not (0).",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// A set of trusted root certificates, such as the bundle that ships
+// with an operating system or browser.
+type RootStore struct {
+	Name  string
+	Certs []*x509.Certificate
+	pool  *x509.CertPool
+}
+
+// Loads a root store from a file with PEM-encoded certificates.
+// The store gets named after the file.
+func LoadRootStore(path string) (*RootStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &RootStore{Name: filepath.Base(path), pool: x509.NewCertPool()}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		store.Certs = append(store.Certs, cert)
+		store.pool.AddCert(cert)
+	}
+	if len(store.Certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return store, nil
+}
+
+// Roots for verifying the chains of targets without a ca_file option;
+// nil means the system roots. Set by -ca-file.
+var defaultRootCAs *x509.CertPool
+
+// Returns the system roots together with the certificates in a PEM file,
+// such as the root of a private PKI.
+func systemRootsWith(path string) (*x509.CertPool, error) {
+	store, err := LoadRootStore(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range store.Certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// Keeps track of the root certificates that monitored chains anchor to.
+type RootTracker struct {
+	stores []*RootStore
+	window time.Duration
+
+	mutex   sync.Mutex
+	anchors map[string][]rootAnchor
+}
+
+type rootAnchor struct {
+	store string
+	cert  *x509.Certificate
+}
+
+func NewRootTracker(stores []*RootStore, window time.Duration) *RootTracker {
+	return &RootTracker{
+		stores:  stores,
+		window:  window,
+		anchors: make(map[string][]rootAnchor),
+	}
+}
+
+// Finds the roots that the chain of a domain anchors to, and exports
+// their earliest expiration. Without configured stores, we use the
+// chains verified against the system roots during the check.
+func (rt *RootTracker) Observe(domain string, result *CheckResult) {
+	var anchors []rootAnchor
+	add := func(store string, chains [][]*x509.Certificate) {
+		for _, chain := range chains {
+			root := chain[len(chain)-1]
+			dup := false
+			for _, a := range anchors {
+				if a.store == store && bytes.Equal(a.cert.Raw, root.Raw) {
+					dup = true
+				}
+			}
+			if !dup {
+				anchors = append(anchors, rootAnchor{store: store, cert: root})
+			}
+		}
+	}
+
+	if len(rt.stores) == 0 {
+		add("system", result.Verified)
+	} else {
+		intermediates := x509.NewCertPool()
+		for _, cert := range result.Chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		for _, store := range rt.stores {
+			chains, err := result.Chain[0].Verify(x509.VerifyOptions{
+				Roots:         store.pool,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			if err == nil {
+				add(store.Name, chains)
+			}
+		}
+	}
+
+	rt.mutex.Lock()
+	rt.anchors[domain] = anchors
+	rt.mutex.Unlock()
+
+	if len(anchors) == 0 {
+		rootExpiration.DeleteLabelValues(domain)
+		rootExpiring.DeleteLabelValues(domain)
+		return
+	}
+	earliest := anchors[0].cert.NotAfter
+	for _, a := range anchors[1:] {
+		if a.cert.NotAfter.Before(earliest) {
+			earliest = a.cert.NotAfter
+		}
+	}
+	rootExpiration.WithLabelValues(domain).Set(float64(earliest.Unix()))
+	rootExpiring.WithLabelValues(domain).Set(boolToFloat(time.Until(earliest) < rt.window))
+}
+
+// Forgets a domain that is not monitored anymore.
+func (rt *RootTracker) Forget(domain string) {
+	rt.mutex.Lock()
+	delete(rt.anchors, domain)
+	rt.mutex.Unlock()
+	rootExpiration.DeleteLabelValues(domain)
+	rootExpiring.DeleteLabelValues(domain)
+}
+
+// Serves a fleet-wide report about the root certificates that monitored
+// chains anchor to, and about the roots in the configured stores that
+// expire within the window.
+func (rt *RootTracker) HandleRoots(w http.ResponseWriter, r *http.Request) {
+	type rootInfo struct {
+		anchor  rootAnchor
+		domains []string
+	}
+	roots := make(map[string]*rootInfo)
+	key := func(a rootAnchor) string { return a.store + "\x00" + string(a.cert.Raw) }
+
+	rt.mutex.Lock()
+	for domain, anchors := range rt.anchors {
+		for _, a := range anchors {
+			info := roots[key(a)]
+			if info == nil {
+				info = &rootInfo{anchor: a}
+				roots[key(a)] = info
+			}
+			info.domains = append(info.domains, domain)
+		}
+	}
+	rt.mutex.Unlock()
+
+	for _, store := range rt.stores {
+		for _, cert := range store.Certs {
+			a := rootAnchor{store: store.Name, cert: cert}
+			if roots[key(a)] == nil && time.Until(cert.NotAfter) < rt.window {
+				roots[key(a)] = &rootInfo{anchor: a}
+			}
+		}
+	}
+
+	list := make([]*rootInfo, 0, len(roots))
+	for _, info := range roots {
+		sort.Strings(info.domains)
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		exp_i, exp_j := list[i].anchor.cert.NotAfter, list[j].anchor.cert.NotAfter
+		if !exp_i.Equal(exp_j) {
+			return exp_i.Before(exp_j)
+		}
+		return list[i].anchor.store < list[j].anchor.store
+	})
+
+	fmt.Fprintf(w, "%s", htmlHead+`<body><h1>CertMon: Root Certificates</h1>
+<p>Root certificates that monitored chains anchor to, together with
+roots in the configured stores that expire within the warning window.</p>
+<p><table>
+<tr><th>Root</th><th>Store</th><th>Expires</th><th>Domains</th></tr>
+`)
+	for _, info := range list {
+		expires := info.anchor.cert.NotAfter.Format(time.RFC3339)
+		if time.Until(info.anchor.cert.NotAfter) < rt.window {
+			expires += " (expiring)"
+		}
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(info.anchor.cert.Subject.String()),
+			html.EscapeString(info.anchor.store),
+			expires,
+			html.EscapeString(strings.Join(info.domains, ", ")))
+	}
+	fmt.Fprintf(w, "%s", "</table></p></body></html>\n")
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var checksQueued = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "checks_queued",
+		Help:      "Number of checks that are due, but waiting for their jitter delay.",
+	},
+)
+
+var checksInFlight = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "checks_in_flight",
+		Help:      "Number of checks currently talking to servers.",
+	},
+)
+
+var checkLag = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Subsystem: "certmon",
+		Name:      "check_lag_seconds",
+		Help:      "How much later than scheduled checks started, not counting the intended jitter delay, in seconds. Lag grows when checks take longer than their interval, or when the instance is overloaded.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	},
+)
+
+var sweepDuration = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "sweep_duration_seconds",
+		Help:      "How long the most recent sweep took to check every target at least once, in seconds.",
+	},
+)
+
+// Starts a new sweep over all targets. The caller must hold cm.mutex.
+func (cm *CertMon) startSweep() {
+	cm.sweepStart = time.Now()
+	cm.sweepPending = make(map[string]bool, len(cm.domains))
+	for domain := range cm.domains {
+		cm.sweepPending[domain] = true
+	}
+}
+
+// Notes that a domain has been checked, successfully or not. Once every
+// target has been checked, the duration and resource usage of the sweep
+// get exported, and the results get written if there is a result writer.
+func (cm *CertMon) checked(domain string) {
+	cm.mutex.Lock()
+	delete(cm.sweepPending, domain)
+	done := len(cm.sweepPending) == 0
+	if done {
+		sweepDuration.Set(time.Since(cm.sweepStart).Seconds())
+		exportSweepUsage()
+		cm.startSweep()
+	}
+	cm.mutex.Unlock()
+
+	if done && cm.opts.Results != nil {
+		if err := cm.opts.Results.Write(cm.AgentReport()); err != nil {
+			log.Printf("writing results: %v", err)
+		}
+	}
+}
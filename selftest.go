@@ -0,0 +1,386 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// A local TLS server for the self-test, which serves a certificate
+// with some property that the checks must detect.
+type selfTestFixture struct {
+	name string
+
+	// What the checks should find, for the output.
+	want string
+
+	// Issues the chain to serve for host.
+	chain func(ca *selfTestCA, host string) (tls.Certificate, error)
+
+	// Protocol that upgrades to TLS, as in the protocol option of
+	// targets; empty for direct TLS.
+	protocol string
+
+	// Tells whether the checks found what they should.
+	ok func(status *domainStatus) bool
+}
+
+var selfTestFixtures = []selfTestFixture{
+	{
+		name: "valid",
+		want: "check succeeds",
+		chain: func(ca *selfTestCA, host string) (tls.Certificate, error) {
+			return ca.issue(host, -time.Hour, 90*24*time.Hour, nil, true)
+		},
+		ok: func(status *domainStatus) bool {
+			return !status.failing && status.leaf != nil
+		},
+	},
+	{
+		name: "expired",
+		want: "check fails, certificate expired",
+		chain: func(ca *selfTestCA, host string) (tls.Certificate, error) {
+			return ca.issue(host, -90*24*time.Hour, -24*time.Hour, nil, true)
+		},
+		ok: func(status *domainStatus) bool {
+			return status.failing && strings.Contains(lastError(status), "expired")
+		},
+	},
+	{
+		name: "wrong-name",
+		want: "hostname mismatch",
+		chain: func(ca *selfTestCA, host string) (tls.Certificate, error) {
+			return ca.issue("other.selftest", -time.Hour, 90*24*time.Hour, nil, true)
+		},
+		ok: func(status *domainStatus) bool {
+			return status.hostnameMismatch
+		},
+	},
+	{
+		name: "missing-intermediate",
+		want: "check fails, chain does not verify",
+		chain: func(ca *selfTestCA, host string) (tls.Certificate, error) {
+			return ca.issue(host, -time.Hour, 90*24*time.Hour, nil, false)
+		},
+		ok: func(status *domainStatus) bool {
+			return status.failing && strings.Contains(lastError(status), "unknown authority")
+		},
+	},
+	{
+		name: "weak-key",
+		want: "check succeeds, weak key detected",
+		chain: func(ca *selfTestCA, host string) (tls.Certificate, error) {
+			key, err := rsa.GenerateKey(rand.Reader, 1024)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+			return ca.issue(host, -time.Hour, 90*24*time.Hour, key, true)
+		},
+		ok: func(status *domainStatus) bool {
+			return !status.failing && status.leaf != nil && weakKey(status.leaf) != ""
+		},
+	},
+	{
+		name:     "smtp-starttls",
+		want:     "check succeeds after STARTTLS",
+		protocol: ProtocolSMTP,
+		chain: func(ca *selfTestCA, host string) (tls.Certificate, error) {
+			return ca.issue(host, -time.Hour, 90*24*time.Hour, nil, true)
+		},
+		ok: func(status *domainStatus) bool {
+			return !status.failing && status.leaf != nil && status.protocol == ProtocolSMTP
+		},
+	},
+}
+
+func lastError(status *domainStatus) string {
+	if len(status.errors) == 0 {
+		return ""
+	}
+	return status.errors[len(status.errors)-1].Error
+}
+
+// Starts a local TLS server for every fixture, checks them all with
+// the usual pipeline, and prints whether each check found what it
+// should. Returns the exit status for the process: 0 if all fixtures
+// passed, and 1 otherwise. The fixtures get reached under names in
+// .selftest, which a built-in DNS server resolves to 127.0.0.1, so
+// the self-test needs no network access.
+func RunSelfTest() int {
+	ca, err := newSelfTestCA()
+	if err != nil {
+		fmt.Printf("creating test CA: %v\n", err)
+		return 1
+	}
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("starting DNS server: %v\n", err)
+		return 1
+	}
+	defer dns.Close()
+	go serveSelfTestDNS(dns)
+
+	targets := make([]Target, 0, len(selfTestFixtures))
+	for _, f := range selfTestFixtures {
+		host := f.name + ".selftest"
+		cert, err := f.chain(ca, host)
+		if err != nil {
+			fmt.Printf("%s: %v\n", f.name, err)
+			return 1
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Printf("%s: %v\n", f.name, err)
+			return 1
+		}
+		defer ln.Close()
+		go serveSelfTestTLS(ln, &tls.Config{Certificates: []tls.Certificate{cert}}, f.protocol)
+
+		port := ln.Addr().(*net.TCPAddr).Port
+		spec := fmt.Sprintf("%s:%d?resolver=%s&proxy=direct", host, port, dns.LocalAddr())
+		if f.protocol != "" {
+			spec += "&protocol=" + f.protocol
+		}
+		t, err := ParseTarget(spec)
+		if err != nil {
+			fmt.Printf("%s: %v\n", f.name, err)
+			return 1
+		}
+		t.rootCAs = ca.roots
+		targets = append(targets, t)
+	}
+
+	events, _ := NewEventLog(nil)
+	opts := Options{Events: events, UnresolvableBackoff: time.Hour, Once: true}
+	cm := NewCertMon(targets, opts, context.Background())
+	cm.CheckAll(len(targets))
+
+	exitCode := 0
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	for i, f := range selfTestFixtures {
+		status := cm.domains[targets[i].Host]
+		result := "PASS"
+		if !f.ok(status) {
+			result = "FAIL"
+			exitCode = 1
+		}
+		got := "check succeeded"
+		if status.failing {
+			got = lastError(status)
+		}
+		fmt.Printf("%s %-20s want: %s; got: %s\n", result, f.name, f.want, got)
+	}
+	return exitCode
+}
+
+// Completes the handshake with every client, after the STARTTLS flow
+// of protocol if it is not empty, and hangs up.
+func serveSelfTestTLS(ln net.Listener, config *tls.Config, protocol string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			switch protocol {
+			case "":
+				tls.Server(conn, config).Handshake()
+			case ProtocolSMTP:
+				serveSelfTestSMTP(conn, config)
+			}
+		}()
+	}
+}
+
+// Speaks just enough SMTP for clients to start TLS, and to say hello
+// and quit over the upgraded connection.
+func serveSelfTestSMTP(conn net.Conn, config *tls.Config) {
+	r := bufio.NewReader(conn)
+	var w io.Writer = conn
+	fmt.Fprintf(w, "220 selftest ESMTP\r\n")
+	secure := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.TrimSpace(line))
+		if i := strings.IndexByte(verb, ' '); i >= 0 {
+			verb = verb[:i]
+		}
+		switch {
+		case (verb == "EHLO" || verb == "HELO") && !secure:
+			fmt.Fprintf(w, "250-selftest\r\n250 STARTTLS\r\n")
+		case verb == "EHLO" || verb == "HELO":
+			fmt.Fprintf(w, "250 selftest\r\n")
+		case verb == "STARTTLS" && !secure:
+			fmt.Fprintf(w, "220 ready to start TLS\r\n")
+			tlsConn := tls.Server(conn, config)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			r, w, secure = bufio.NewReader(tlsConn), tlsConn, true
+		case verb == "QUIT":
+			fmt.Fprintf(w, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(w, "502 not implemented\r\n")
+		}
+	}
+}
+
+// Answers every DNS query for an A record with 127.0.0.1, and queries
+// for other types with no records.
+func serveSelfTestDNS(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:n]
+		if n < 12 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+			continue
+		}
+
+		// The question section holds the name as length-prefixed
+		// labels, followed by the type and class.
+		end := 12
+		for end < n && msg[end] != 0 {
+			end += int(msg[end]) + 1
+		}
+		end += 5
+		if end > n {
+			continue
+		}
+		qtype := binary.BigEndian.Uint16(msg[end-4:])
+
+		resp := make([]byte, 12, end+16)
+		copy(resp, msg[:2])
+		binary.BigEndian.PutUint16(resp[2:], 0x8180) // response, recursion available
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		resp = append(resp, msg[12:end]...)
+		if qtype == 1 {
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = append(resp,
+				0xc0, 12, // name: pointer to the question
+				0, 1, 0, 1, // A, IN
+				0, 0, 0, 60, // TTL
+				0, 4, 127, 0, 0, 1)
+		}
+		conn.WriteTo(resp, addr)
+	}
+}
+
+// A throwaway root and intermediate CA for issuing fixture certificates.
+type selfTestCA struct {
+	roots        *x509.CertPool
+	intermediate *x509.Certificate
+	key          crypto.Signer
+}
+
+func newSelfTestCA() (*selfTestCA, error) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "certmon self-test root"},
+		NotBefore:             now.Add(-365 * 24 * time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "certmon self-test intermediate"},
+		NotBefore:             rootTemplate.NotBefore,
+		NotAfter:              rootTemplate.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err = x509.CreateCertificate(rand.Reader, template, root, key.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+	intermediate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &selfTestCA{roots: roots, intermediate: intermediate, key: key}, nil
+}
+
+// Issues a certificate for host, valid from notBefore to notAfter
+// relative to now, for key or a fresh ECDSA key if key is nil. The
+// returned chain includes the intermediate if withIntermediate is true.
+func (ca *selfTestCA) issue(host string, notBefore, notAfter time.Duration, key crypto.Signer, withIntermediate bool) (tls.Certificate, error) {
+	if key == nil {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    now.Add(notBefore),
+		NotAfter:     now.Add(notAfter),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.intermediate, key.Public(), ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	if withIntermediate {
+		cert.Certificate = append(cert.Certificate, ca.intermediate.Raw)
+	}
+	return cert, nil
+}
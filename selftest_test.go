@@ -0,0 +1,15 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import "testing"
+
+func TestSelfTest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts local servers")
+	}
+	if got := RunSelfTest(); got != 0 {
+		t.Errorf("RunSelfTest() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events that a security team wants in its SIEM, with their name and
+// severity in the Common Event Format (CEF), from 0 (lowest) to 10.
+var securityEvents = map[string]struct {
+	name     string
+	severity int
+}{
+	EventCertificateObserved: {"New certificate observed", 3},
+	EventIssuerChanged:       {"Certificate issuer changed", 5},
+	EventPortMismatch:        {"Ports serve different certificates", 5},
+	EventHostnameMismatch:    {"Certificate not valid for host name", 7},
+	EventWeakKey:             {"Weak certificate key", 7},
+	EventValidationChanged:   {"Certificate validation level changed", 5},
+	EventRevoked:             {"Certificate revoked", 9},
+	EventCARevoked:           {"Issuing CA revoked", 10},
+}
+
+// Forwards security-relevant events to a syslog server, formatted in
+// the Common Event Format that most SIEMs parse out of the box. The
+// syslog messages follow RFC 5424; over TCP, they are separated by
+// newlines.
+type SyslogForwarder struct {
+	network, addr string
+	hostname      string
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+// Creates a forwarder to a syslog server given as URL, such as
+// "udp://siem.example.org:514" or "tcp://siem.example.org:601".
+// The port defaults to 514.
+func NewSyslogForwarder(s string) (*SyslogForwarder, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in %q", s)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "514"
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	return &SyslogForwarder{
+		network:  u.Scheme,
+		addr:     net.JoinHostPort(u.Hostname(), port),
+		hostname: hostname,
+	}, nil
+}
+
+// Sends an event to the syslog server, unless it is not relevant for
+// security. A broken connection gets re-established once.
+func (f *SyslogForwarder) Forward(e Event) error {
+	t, ok := securityEvents[e.Type]
+	if !ok {
+		return nil
+	}
+
+	// Facility security/authorization (4), severity warning (4).
+	msg := fmt.Sprintf("<36>1 %s %s certmon - %s - %s\n",
+		e.Time.UTC().Format(time.RFC3339Nano), f.hostname, e.Type,
+		cefMessage(e, t.name, t.severity))
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if f.conn == nil {
+			if f.conn, err = net.DialTimeout(f.network, f.addr, 10*time.Second); err != nil {
+				return err
+			}
+		}
+		f.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err = f.conn.Write([]byte(msg)); err == nil {
+			return nil
+		}
+		f.conn.Close()
+		f.conn = nil
+	}
+	return err
+}
+
+// Formats an event in the Common Event Format.
+func cefMessage(e Event, name string, severity int) string {
+	ext := []string{
+		"rt=" + fmt.Sprint(e.Time.UnixMilli()),
+		"dhost=" + cefValue(e.Domain),
+	}
+	if e.Message != "" {
+		ext = append(ext, "msg="+cefValue(e.Message))
+	}
+	if c := e.Certificate; c != nil {
+		ext = append(ext,
+			"cs1Label=fingerprint", "cs1="+cefValue(c.Fingerprint),
+			"cs2Label=issuer", "cs2="+cefValue(c.Issuer),
+			"cs3Label=subject", "cs3="+cefValue(c.Subject))
+	}
+	return fmt.Sprintf("CEF:0|certmon|certmon|2|%s|%s|%d|%s",
+		cefHeader(e.Type), cefHeader(name), severity, strings.Join(ext, " "))
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+
+func cefHeader(s string) string {
+	return cefHeaderEscaper.Replace(s)
+}
+
+func cefValue(s string) string {
+	return cefValueEscaper.Replace(s)
+}
@@ -0,0 +1,33 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCEFMessageEscaping(t *testing.T) {
+	e := Event{
+		Time:    time.UnixMilli(1700000000123),
+		Type:    EventCertificateObserved,
+		Domain:  "example.org",
+		Message: "new|cert act=blocked\\\nCEF:0|forged",
+		Certificate: &ObservedCertificate{
+			Fingerprint: "ab12",
+			Subject:     "CN=evil|x suser=root\\ y\r\nz",
+			Issuer:      "CN=Test CA",
+		},
+	}
+	got := cefMessage(e, `New|cert\`, 3)
+	want := `CEF:0|certmon|certmon|2|certificate_observed|New\|cert\\|3|` +
+		`rt=1700000000123 dhost=example.org ` +
+		`msg=new|cert act\=blocked\\\nCEF:0|forged ` +
+		`cs1Label=fingerprint cs1=ab12 ` +
+		`cs2Label=issuer cs2=CN\=Test CA ` +
+		`cs3Label=subject cs3=CN\=evil|x suser\=root\\ y\r\nz`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
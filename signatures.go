@@ -0,0 +1,46 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var weakSignature = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "chain_weak_signature",
+		Help:      "Whether some certificate that the server presented is signed with MD2, MD5 or SHA-1 (1) or not (0), by domain name. Self-signed roots are not counted, since clients do not check their signatures.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+// Signature algorithms whose hash functions are broken for collisions.
+var weakSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.MD2WithRSA:    true,
+	x509.MD5WithRSA:    true,
+	x509.SHA1WithRSA:   true,
+	x509.DSAWithSHA1:   true,
+	x509.ECDSAWithSHA1: true,
+}
+
+// Describes the certificates of a chain that have weak signatures,
+// as in "CN=Example CA (SHA1-RSA)".
+func weakSignatures(chain []*x509.Certificate) []string {
+	var result []string
+	for _, cert := range chain {
+		if bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+			continue
+		}
+		if weakSignatureAlgorithms[cert.SignatureAlgorithm] {
+			result = append(result, cert.Subject.String()+" ("+cert.SignatureAlgorithm.String()+")")
+		}
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sniCheckSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "sni_check_success",
+		Help:      "Whether the most recent handshake with a server name sent to the target succeeded (1) or failed (0), by domain name and server name.",
+	},
+	[]string{
+		"domain",
+		"sni",
+	},
+)
+
+var sniCertExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "sni_tls_certificate_expiration_timestamp",
+		Help:      "TLS certificate expiration dates served for a server name by the target, in seconds since 1970-01-01 midnight UTC, by domain name and server name.",
+	},
+	[]string{
+		"domain",
+		"sni",
+	},
+)
+
+// Checks the certificates that a target serves for each of its
+// additional server names, such as the tenants behind an SNI router,
+// on its first port. Each certificate must be valid for the name it
+// was requested for.
+func checkSNI(domain string, target Target) {
+	for _, name := range target.SNI {
+		config := target.TLSConfig()
+		config.ServerName = name
+		result, err := target.checkPort(target.Ports[0], config)
+		sniCheckSuccess.WithLabelValues(domain, name).Set(boolToFloat(err == nil))
+		if err != nil {
+			log.Printf("%s: server name %s: %v", domain, name, err)
+			sniCertExpiration.DeleteLabelValues(domain, name)
+			continue
+		}
+		sniCertExpiration.WithLabelValues(domain, name).Set(float64(result.Expiration.Unix()))
+	}
+}
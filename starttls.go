@@ -0,0 +1,500 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// Protocols for reaching the TLS handshake of a target.
+const (
+	ProtocolTLS  = "tls"
+	ProtocolSMTP = "smtp"
+	ProtocolIMAP = "imap"
+	ProtocolPOP3 = "pop3"
+	ProtocolFTP  = "ftp"
+	ProtocolLDAP = "ldap"
+	ProtocolXMPP = "xmpp"
+	ProtocolNNTP = "nntp"
+
+	// Databases, which negotiate TLS in their own wire protocol.
+	ProtocolPostgres = "postgres"
+	ProtocolMySQL    = "mysql"
+
+	// DNS resolvers, which get sent a query after the handshake.
+	ProtocolDoT = "dot"
+	ProtocolDoH = "doh"
+
+	// Tries direct TLS first, then falls back to the STARTTLS flow
+	// that is usual for the port.
+	ProtocolAuto = "auto"
+)
+
+// STARTTLS flows that are usual for well-known ports.
+var startTLSPorts = map[int]string{
+	21:   ProtocolFTP,
+	25:   ProtocolSMTP,
+	110:  ProtocolPOP3,
+	119:  ProtocolNNTP,
+	143:  ProtocolIMAP,
+	389:  ProtocolLDAP,
+	587:  ProtocolSMTP,
+	3306: ProtocolMySQL,
+	5222: ProtocolXMPP,
+	5269: ProtocolXMPP,
+	5432: ProtocolPostgres,
+}
+
+// Ports for targets given as URLs without a port, such as
+// "ldap://ldap.example.org", by scheme.
+var defaultPorts = map[string]int{
+	ProtocolTLS:  443,
+	ProtocolSMTP: 25,
+	ProtocolIMAP: 143,
+	ProtocolPOP3: 110,
+	ProtocolFTP:  21,
+	ProtocolLDAP: 389,
+	ProtocolXMPP: 5222,
+	ProtocolNNTP: 119,
+
+	ProtocolPostgres: 5432,
+	ProtocolMySQL:    3306,
+
+	ProtocolDoT: 853,
+	ProtocolDoH: 443,
+}
+
+// Ports for schemes of protocols that start with TLS right away, such
+// as "nntps://news.example.org".
+var implicitTLSPorts = map[string]int{
+	"https": 443,
+	"smtps": 465,
+	"nntps": 563,
+	"ldaps": 636,
+	"ftps":  990,
+	"imaps": 993,
+	"pop3s": 995,
+}
+
+func parseProtocol(s string) (string, error) {
+	switch s {
+	case ProtocolTLS, ProtocolSMTP, ProtocolIMAP, ProtocolPOP3,
+		ProtocolFTP, ProtocolLDAP, ProtocolXMPP, ProtocolNNTP, ProtocolPostgres,
+		ProtocolMySQL, ProtocolDoT, ProtocolDoH, ProtocolAuto:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown protocol %q", s)
+}
+
+// Performs a TLS handshake with host on port, speaking protocol to get
+// there. The connection goes to dialHost, which is usually host itself
+// but may be an address that host resolves to, and gets opened by dial. Returns the state of the
+// TLS connection, and the protocol that was used in the end, which
+// differs from the requested one for "auto". Connecting and reaching the
+// handshake must not take longer than timeout.
+func handshake(dial dialFunc, protocol, host, dialHost string, port int, config *tls.Config, timeout time.Duration) (tls.ConnectionState, string, error) {
+	addr := net.JoinHostPort(dialHost, strconv.Itoa(port))
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	switch protocol {
+	case "", ProtocolTLS:
+		state, err := directTLS(dial, addr, config, timeout)
+		return state, ProtocolTLS, err
+	case ProtocolSMTP:
+		state, err := smtpStartTLS(dial, addr, config, timeout)
+		return state, protocol, err
+	case ProtocolIMAP, ProtocolPOP3:
+		state, err := lineStartTLS(dial, protocol, addr, config, timeout)
+		return state, protocol, err
+	case ProtocolFTP:
+		state, err := startTLS(dial, addr, config, timeout, negotiateFTP)
+		return state, protocol, err
+	case ProtocolLDAP:
+		state, err := startTLS(dial, addr, config, timeout, negotiateLDAP)
+		return state, protocol, err
+	case ProtocolNNTP:
+		state, err := startTLS(dial, addr, config, timeout, negotiateNNTP)
+		return state, protocol, err
+	case ProtocolPostgres:
+		state, err := startTLS(dial, addr, config, timeout, negotiatePostgres)
+		return state, protocol, err
+	case ProtocolMySQL:
+		state, err := startTLS(dial, addr, config, timeout, negotiateMySQL)
+		return state, protocol, err
+	case ProtocolDoT:
+		state, err := dnsOverTLS(dial, addr, config, timeout)
+		return state, protocol, err
+	case ProtocolDoH:
+		state, err := dnsOverHTTPS(dial, addr, config, timeout)
+		return state, protocol, err
+	case ProtocolXMPP:
+		namespace := "jabber:client"
+		if port == 5269 {
+			namespace = "jabber:server"
+		}
+		state, err := startTLS(dial, addr, config, timeout, func(conn net.Conn, r *bufio.Reader) error {
+			return negotiateXMPP(conn, r, config.ServerName, namespace)
+		})
+		return state, protocol, err
+	case ProtocolAuto:
+		state, err := directTLS(dial, addr, config, timeout)
+		fallback, ok := startTLSPorts[port]
+		if err == nil || !ok {
+			return state, ProtocolTLS, err
+		}
+		return handshake(dial, fallback, host, dialHost, port, config, timeout)
+	}
+	return tls.ConnectionState{}, protocol, fmt.Errorf("unknown protocol %q", protocol)
+}
+
+func directTLS(dial dialFunc, addr string, config *tls.Config, timeout time.Duration) (tls.ConnectionState, error) {
+	conn, err := dialTLS(dial, addr, config, timeout)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+// Connects to addr with dial, and performs a TLS handshake. Connecting
+// and the handshake must not take longer than timeout in total.
+func dialTLS(dial dialFunc, addr string, config *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	conn, err := dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Upgrades an IMAP or POP3 connection with STARTTLS, respectively STLS.
+// Both protocols greet with a single line and confirm the command with
+// a line starting with "OK" (IMAP, after the tag) or "+OK" (POP3).
+func lineStartTLS(dial dialFunc, protocol, addr string, config *tls.Config, timeout time.Duration) (tls.ConnectionState, error) {
+	conn, err := dial(addr, timeout)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	command, ok := "STLS\r\n", "+OK"
+	if protocol == ProtocolIMAP {
+		command, ok = "a1 STARTTLS\r\n", "a1 OK"
+	}
+	reader := bufio.NewReader(conn)
+	greeting, err := reader.ReadString('\n')
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "+OK") {
+		return tls.ConnectionState{}, fmt.Errorf("unexpected %s greeting: %q", protocol, strings.TrimSpace(greeting))
+	}
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		// IMAP servers may send untagged responses first.
+		if strings.HasPrefix(line, "* ") {
+			continue
+		}
+		if !strings.HasPrefix(line, ok) {
+			return tls.ConnectionState{}, fmt.Errorf("server refused STARTTLS: %q", strings.TrimSpace(line))
+		}
+		break
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return tlsConn.ConnectionState(), nil
+}
+
+// Connects to addr, runs negotiate to get the server to start TLS,
+// and performs the TLS handshake.
+func startTLS(dial dialFunc, addr string, config *tls.Config, timeout time.Duration, negotiate func(net.Conn, *bufio.Reader) error) (tls.ConnectionState, error) {
+	conn, err := dial(addr, timeout)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := negotiate(conn, bufio.NewReader(conn)); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return tlsConn.ConnectionState(), nil
+}
+
+// Reads an FTP reply, which may span several lines as in "220-Hello",
+// "220 Ready", and returns its code and last line.
+func readFTPReply(r *bufio.Reader) (string, string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	if len(line) < 4 {
+		return "", "", fmt.Errorf("bad FTP reply: %q", strings.TrimSpace(line))
+	}
+	code := line[:3]
+	for line[3] == '-' {
+		if line, err = r.ReadString('\n'); err != nil {
+			return "", "", err
+		}
+		for len(line) < 4 || line[:3] != code {
+			if line, err = r.ReadString('\n'); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	return code, strings.TrimSpace(line), nil
+}
+
+// Upgrades an FTP control connection with AUTH TLS (RFC 4217).
+func negotiateFTP(conn net.Conn, r *bufio.Reader) error {
+	code, line, err := readFTPReply(r)
+	if err != nil {
+		return err
+	}
+	if code != "220" {
+		return fmt.Errorf("unexpected ftp greeting: %q", line)
+	}
+	if _, err := conn.Write([]byte("AUTH TLS\r\n")); err != nil {
+		return err
+	}
+	if code, line, err = readFTPReply(r); err != nil {
+		return err
+	}
+	if code != "234" {
+		return fmt.Errorf("server refused STARTTLS: %q", line)
+	}
+	return nil
+}
+
+// Asks an NNTP server to start TLS (RFC 4642). Greetings and responses
+// are single lines starting with a status code.
+func negotiateNNTP(conn net.Conn, r *bufio.Reader) error {
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "200") && !strings.HasPrefix(greeting, "201") {
+		return fmt.Errorf("unexpected nntp greeting: %q", strings.TrimSpace(greeting))
+	}
+	if _, err := conn.Write([]byte("STARTTLS\r\n")); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "382") {
+		return fmt.Errorf("server refused STARTTLS: %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// LDAP extended request for StartTLS (RFC 4511, section 4.14.1), with
+// message ID 1.
+var ldapStartTLSRequest = []byte{
+	0x30, 0x1d, // LDAPMessage
+	0x02, 0x01, 0x01, // messageID
+	0x77, 0x18, // [APPLICATION 23] ExtendedRequest
+	0x80, 0x16, // [0] requestName
+	'1', '.', '3', '.', '6', '.', '1', '.', '4', '.', '1', '.',
+	'1', '4', '6', '6', '.', '2', '0', '0', '3', '7',
+}
+
+// Upgrades an LDAP connection with the StartTLS extended operation.
+func negotiateLDAP(conn net.Conn, r *bufio.Reader) error {
+	if _, err := conn.Write(ldapStartTLSRequest); err != nil {
+		return err
+	}
+
+	// Read the LDAPMessage of the response, whose length may be given
+	// in short or long form.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != 0x30 {
+		return fmt.Errorf("bad LDAP response")
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 {
+			return fmt.Errorf("bad LDAP response")
+		}
+		lengthBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return err
+		}
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	msg := cryptobyte.String(body)
+	var msgID int
+	var resp cryptobyte.String
+	var resultCode int
+	if !msg.ReadASN1Integer(&msgID) ||
+		!msg.ReadASN1(&resp, cbasn1.Tag(24).Constructed()|0x40) ||
+		!resp.ReadASN1Enum(&resultCode) {
+		return fmt.Errorf("bad LDAP response")
+	}
+	if resultCode != 0 {
+		return fmt.Errorf("server refused STARTTLS: LDAP result code %d", resultCode)
+	}
+	return nil
+}
+
+// Upgrades an XMPP stream with STARTTLS (RFC 6120, section 5).
+func negotiateXMPP(conn net.Conn, r *bufio.Reader, domain, namespace string) error {
+	open := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' version='1.0' xmlns='%s' xmlns:stream='http://etherx.jabber.org/streams'>",
+		domain, namespace)
+	if _, err := conn.Write([]byte(open)); err != nil {
+		return err
+	}
+	features, err := readUntil(r, "</stream:features>")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(features, "urn:ietf:params:xml:ns:xmpp-tls") {
+		return fmt.Errorf("server does not offer STARTTLS")
+	}
+	if _, err := conn.Write([]byte("<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")); err != nil {
+		return err
+	}
+	reply, err := readUntil(r, ">")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(reply, "<proceed") {
+		return fmt.Errorf("server refused STARTTLS: %q", reply)
+	}
+	return nil
+}
+
+// Reads until the input ends with suffix, for at most 64 KiB.
+func readUntil(r *bufio.Reader, suffix string) (string, error) {
+	var buf strings.Builder
+	for buf.Len() < 64<<10 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		buf.WriteByte(b)
+		if strings.HasSuffix(buf.String(), suffix) {
+			return buf.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no %q within 64 KiB", suffix)
+}
+
+// Asks a PostgreSQL server to start TLS with an SSLRequest message.
+func negotiatePostgres(conn net.Conn, r *bufio.Reader) error {
+	request := []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	answer, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if answer != 'S' {
+		return fmt.Errorf("server refused STARTTLS: %q", answer)
+	}
+	return nil
+}
+
+// Capability flags of the MySQL client/server protocol.
+const (
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConnection = 0x00008000
+)
+
+// Reads the initial handshake packet of a MySQL server, and answers it
+// with an SSLRequest packet.
+func negotiateMySQL(conn net.Conn, r *bufio.Reader) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	if len(payload) > 0 && payload[0] == 0xff {
+		// An error packet, such as for hosts that are not allowed
+		// to connect.
+		msg := payload[1:]
+		if len(msg) > 2 {
+			msg = msg[2:]
+		}
+		return fmt.Errorf("mysql error: %q", string(msg))
+	}
+	if len(payload) == 0 || payload[0] != 10 {
+		return fmt.Errorf("unsupported mysql protocol")
+	}
+	// Protocol version, server version, connection ID, first part of
+	// the auth plugin data, filler, lower capability flags.
+	end := bytes.IndexByte(payload[1:], 0)
+	offset := 1 + end + 1 + 4 + 8 + 1
+	if end < 0 || len(payload) < offset+2 {
+		return fmt.Errorf("bad mysql handshake")
+	}
+	capabilities := int(payload[offset]) | int(payload[offset+1])<<8
+	if capabilities&mysqlClientSSL == 0 {
+		return fmt.Errorf("server does not offer TLS")
+	}
+
+	request := make([]byte, 4+32)
+	request[0] = 32 // payload length
+	request[3] = header[3] + 1
+	binary.LittleEndian.PutUint32(request[4:],
+		mysqlClientProtocol41|mysqlClientSSL|mysqlClientSecureConnection)
+	binary.LittleEndian.PutUint32(request[8:], 1<<24) // max packet size
+	request[12] = 33                                  // utf8_general_ci
+	_, err := conn.Write(request)
+	return err
+}
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Runs negotiate against a fake server, which gets the other end of
+// the connection. Returns once the server is done.
+func fakeNegotiation(negotiate func(net.Conn, *bufio.Reader) error, server func(net.Conn)) error {
+	client, srv := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer srv.Close()
+		srv.SetDeadline(time.Now().Add(5 * time.Second))
+		server(srv)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	err := negotiate(client, bufio.NewReader(client))
+	client.Close()
+	<-done
+	return err
+}
+
+func TestNegotiateNNTP(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		greeting string
+		reply    string
+		ok       bool
+	}{
+		{"posting allowed", "200 news.example.org ready\r\n", "382 Continue with TLS negotiation\r\n", true},
+		{"no posting", "201 news.example.org ready, no posting\r\n", "382 Continue with TLS negotiation\r\n", true},
+		{"refused", "200 news.example.org ready\r\n", "580 Can not initiate TLS negotiation\r\n", false},
+		{"not supported", "200 news.example.org ready\r\n", "502 Command unavailable\r\n", false},
+		{"unavailable", "400 Service temporarily unavailable\r\n", "", false},
+		{"truncated greeting", "200 news.exa", "", false},
+		{"truncated reply", "200 news.example.org ready\r\n", "38", false},
+	} {
+		var command string
+		err := fakeNegotiation(negotiateNNTP, func(conn net.Conn) {
+			conn.Write([]byte(tc.greeting))
+			if tc.reply == "" {
+				return
+			}
+			command, _ = bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte(tc.reply))
+		})
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: got error %v, want ok=%v", tc.name, err, tc.ok)
+		}
+		if tc.reply != "" && command != "STARTTLS\r\n" {
+			t.Errorf("%s: server got %q, want %q", tc.name, command, "STARTTLS\r\n")
+		}
+	}
+}
+
+func TestNegotiatePostgres(t *testing.T) {
+	sslRequest := []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+	for _, tc := range []struct {
+		name   string
+		answer []byte
+		ok     bool
+	}{
+		{"accepted", []byte("S"), true},
+		{"refused", []byte("N"), false},
+		{"error", []byte("E"), false},
+		{"closed", nil, false},
+	} {
+		var request []byte
+		err := fakeNegotiation(negotiatePostgres, func(conn net.Conn) {
+			request = make([]byte, len(sslRequest))
+			io.ReadFull(conn, request)
+			conn.Write(tc.answer)
+		})
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: got error %v, want ok=%v", tc.name, err, tc.ok)
+		}
+		if !bytes.Equal(request, sslRequest) {
+			t.Errorf("%s: server got %x, want %x", tc.name, request, sslRequest)
+		}
+	}
+}
+
+// Returns the initial handshake packet of a MySQL 8 server with the
+// given lower capability flags.
+func mysqlHandshake(capabilities uint16) []byte {
+	payload := []byte{10}
+	payload = append(payload, "8.0.36\x00"...)
+	payload = binary.LittleEndian.AppendUint32(payload, 42) // connection ID
+	payload = append(payload, "abcdefgh"...)                // auth plugin data
+	payload = append(payload, 0)                            // filler
+	payload = binary.LittleEndian.AppendUint16(payload, capabilities)
+	payload = append(payload, 255)                              // utf8mb4_0900_ai_ci
+	payload = binary.LittleEndian.AppendUint16(payload, 2)      // status
+	payload = binary.LittleEndian.AppendUint16(payload, 0xdfff) // upper capabilities
+	payload = append(payload, 21)
+	payload = append(payload, make([]byte, 10)...)
+	payload = append(payload, "ijklmnopqrst\x00caching_sha2_password\x00"...)
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 0}
+	return append(header, payload...)
+}
+
+func TestNegotiateMySQL(t *testing.T) {
+	errorPacket := []byte{0xff, 0x6a, 0x04}
+	errorPacket = append(errorPacket, "Host 'x' is not allowed to connect"...)
+	for _, tc := range []struct {
+		name      string
+		handshake []byte
+		ok        bool
+	}{
+		{"with CLIENT_SSL", mysqlHandshake(0xffff), true},
+		{"without CLIENT_SSL", mysqlHandshake(0xffff &^ mysqlClientSSL), false},
+		{"error packet", append([]byte{byte(len(errorPacket)), 0, 0, 0}, errorPacket...), false},
+		{"old protocol", []byte{2, 0, 0, 0, 9, 0}, false},
+		{"truncated", mysqlHandshake(0xffff)[:20], false},
+	} {
+		var request []byte
+		err := fakeNegotiation(negotiateMySQL, func(conn net.Conn) {
+			conn.Write(tc.handshake)
+			if tc.ok {
+				request = make([]byte, 36)
+				io.ReadFull(conn, request)
+			}
+		})
+		if tc.ok != (err == nil) {
+			t.Errorf("%s: got error %v, want ok=%v", tc.name, err, tc.ok)
+		}
+		if !tc.ok {
+			continue
+		}
+		if request[0] != 32 || request[1] != 0 || request[2] != 0 || request[3] != 1 {
+			t.Errorf("%s: bad SSLRequest header %x", tc.name, request[:4])
+		}
+		if flags := binary.LittleEndian.Uint32(request[4:]); flags&mysqlClientSSL == 0 {
+			t.Errorf("%s: SSLRequest without CLIENT_SSL: %x", tc.name, flags)
+		}
+	}
+}
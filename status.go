@@ -0,0 +1,612 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Start of the HTML pages served by certmon, up to and including </head>.
+const htmlHead = `<html>
+<head>
+<link href='https://tools-static.wmflabs.org/fontcdn/css?family=Roboto+Slab:400,700' rel='stylesheet' type='text/css'/>
+<style>
+* {
+  font-family: 'Roboto Slab', serif;
+}
+h1 {
+  color: #0066ff;
+  margin-left: 1em;
+  margin-top: 1em;
+}
+h2 {
+  margin-left: 2em;
+}
+p {
+  margin-left: 5em;
+}
+th {
+  text-align: left;
+}
+</style>
+</head>
+`
+
+// Returns the time zone for displaying times to the user. It comes from
+// the tz query parameter, such as "?tz=Europe/Zurich", which also gets
+// remembered in a cookie for later visits. Defaults to UTC.
+func userLocation(w http.ResponseWriter, r *http.Request) *time.Location {
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:   "tz",
+				Value:  tz,
+				Path:   "/",
+				MaxAge: 365 * 24 * 60 * 60,
+			})
+			return loc
+		}
+	}
+	if c, err := r.Cookie("tz"); err == nil {
+		if loc, err := time.LoadLocation(c.Value); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// Formats a time in RFC 3339 format for the given location, followed
+// by the time relative to now, such as "in 23 days".
+func formatTime(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(time.RFC3339) + " (" + relativeTime(time.Until(t)) + ")"
+}
+
+func relativeTime(d time.Duration) string {
+	future := d >= 0
+	if !future {
+		d = -d
+	}
+	var s string
+	switch {
+	case d >= 48*time.Hour:
+		s = fmt.Sprintf("%d days", int(d.Hours()/24))
+	case d >= 2*time.Hour:
+		s = fmt.Sprintf("%d hours", int(d.Hours()))
+	case d >= 2*time.Minute:
+		s = fmt.Sprintf("%d minutes", int(d.Minutes()))
+	default:
+		return "now"
+	}
+	if future {
+		return "in " + s
+	}
+	return s + " ago"
+}
+
+// Writes a form for choosing the time zone of displayed times.
+func writeTimeZoneForm(w http.ResponseWriter, loc *time.Location) {
+	fmt.Fprintf(w, "<p><form>Times are shown for <input name=\"tz\" value=\"%s\"/> <input type=\"submit\" value=\"Change time zone\"/></form></p>\n",
+		html.EscapeString(loc.String()))
+}
+
+// Serves a web page with the current status of this server.
+func (cm *CertMon) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	loc := userLocation(w, r)
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	domains := make([]string, 0, len(cm.domains))
+	for dom, _ := range cm.domains {
+		domains = append(domains, dom)
+	}
+
+	// Sort by expiration date; if equal, use domain name as secondary key.
+	sort.Slice(domains, func(i, j int) bool {
+		exp_i := cm.domains[domains[i]].expiration
+		exp_j := cm.domains[domains[j]].expiration
+		if exp_i != exp_j {
+			return exp_i.Before(exp_j)
+		} else {
+			return domains[i] < domains[j]
+		}
+	})
+
+	fmt.Fprintf(w, "%s", htmlHead+`<body><h1>CertMon: Monitoring TLS Certificates</h1>
+<p>Every 30 seconds, this job checks the expiration dates of TLS certificates.
+It exposes these dates as <a href="/metrics">metrics</a> for monitoring with <a href="https://prometheus.io/">Prometheus</a>.</p>
+
+<p>Source code: <a href="https://github.com/brawer/certmon">https://github.com/brawer/certmon</a></p>
+`)
+	writeTimeZoneForm(w, loc)
+	fmt.Fprintf(w, "%s", `<p><table>
+<tr><th>Domain</th><th>Certificate expires</th><th>Common name</th><th>Names</th><th>Issuer</th><th>Serial number</th></tr>
+`)
+	for _, domain := range domains {
+		status := cm.domains[domain]
+		expires := "unknown"
+		if !status.expiration.IsZero() {
+			expires = formatTime(status.expiration, loc)
+		}
+		if status.renewalOverdue {
+			expires += " (renewal overdue)"
+		}
+		if status.portMismatch {
+			expires += " (ports serve different certificates)"
+		}
+		if status.hostnameMismatch {
+			expires += " (certificate not valid for this name)"
+		}
+		if status.unresolvable {
+			expires += " (unresolvable)"
+		}
+		if status.snoozedUntil.After(time.Now()) {
+			expires += " (snoozed until " + status.snoozedUntil.In(loc).Format(time.RFC3339) + ")"
+		}
+		commonName, names, issuer, serial := "", "", "", ""
+		if status.leaf != nil {
+			commonName = status.leaf.Subject.CommonName
+			names = strings.Join(subjectAltNames(status.leaf), ", ")
+			issuer = status.leaf.Issuer.CommonName
+			serial = serialNumber(status.leaf)
+		}
+		fmt.Fprintf(w, "<tr><td><a href=\"/domain/%s\">%s</a></td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			url.PathEscape(domain), html.EscapeString(domain), expires,
+			html.EscapeString(commonName), html.EscapeString(names),
+			html.EscapeString(issuer), serial)
+	}
+
+	fmt.Fprintf(w, "%s", "</table></p>\n")
+
+	if len(cm.opts.Pairs) > 0 {
+		fmt.Fprintf(w, "%s", `<h2>Paired domains</h2>
+<p><table>
+<tr><th>Domain</th><th>Peer</th><th>Issuer</th><th>Names</th></tr>
+`)
+		for _, p := range cm.opts.Pairs {
+			a, b := cm.domains[p.Domain], cm.domains[p.Peer]
+			issuer, names := "unknown", "unknown"
+			if a != nil && b != nil && a.leaf != nil && b.leaf != nil {
+				sameIssuer, sameSANs := p.Compare(a.leaf, b.leaf)
+				issuer, names = "same", "same"
+				if !sameIssuer {
+					issuer = "differs"
+				}
+				if !sameSANs {
+					names = "differ"
+				}
+			}
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+				html.EscapeString(p.Domain), html.EscapeString(p.Peer), issuer, names)
+		}
+		fmt.Fprintf(w, "%s", "</table></p>\n")
+	}
+
+	if cm.opts.Aggregator != nil {
+		cm.opts.Aggregator.WriteHTML(w, loc)
+	}
+
+	fmt.Fprintf(w, "%s", "</body></html>\n")
+}
+
+// Tells whether a request comes from a page of the same origin, as far
+// as browsers reveal it. Requests without any of these headers, such as
+// those of scripts, count as same-origin; they need the token anyway.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// Returns the subject alternative names of a certificate, both DNS
+// names and IP addresses.
+func subjectAltNames(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// Serves a web page with details about a single domain, at /domain/<name>.
+// Posting a snooze_until date (YYYY-MM-DD) snoozes the domain through
+// the end of that day, in the user's time zone; posting an empty date
+// lifts the snooze. Posts must come from a page of the same origin and
+// carry the admin token, either as bearer token or in the token field
+// of the form; without -admin-token-file, the page is read-only.
+func (cm *CertMon) HandleDomain(w http.ResponseWriter, r *http.Request) {
+	domain := strings.TrimPrefix(r.URL.Path, "/domain/")
+	if strings.HasSuffix(domain, "/chain.pem") {
+		cm.handleChain(w, r, strings.TrimSuffix(domain, "/chain.pem"))
+		return
+	}
+	loc := userLocation(w, r)
+	if r.Method == http.MethodPost {
+		if cm.opts.AdminToken == nil {
+			http.Error(w, "snoozing needs -admin-token-file", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.PostFormValue("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), cm.opts.AdminToken) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var until time.Time
+		if date := r.PostFormValue("snooze_until"); date != "" {
+			day, err := time.ParseInLocation("2006-01-02", date, loc)
+			if err != nil {
+				http.Error(w, "bad value for snooze_until: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			until = day.AddDate(0, 0, 1)
+			if !until.After(time.Now()) {
+				http.Error(w, "snooze_until is in the past", http.StatusBadRequest)
+				return
+			}
+		}
+		source := "status page"
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			source += " from " + host
+		}
+		if err := cm.Snooze(domain, until, source); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	status, ok := cm.domains[domain]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ports := make([]string, 0, len(status.target.Ports))
+	for _, port := range status.target.Ports {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	state := "ok"
+	if status.hostnameMismatch {
+		state = "certificate not valid for this name"
+	} else if status.unresolvable {
+		state = "unresolvable, next attempt " + formatTime(status.unresolvableUntil, loc)
+	} else if status.failing {
+		state = "failing"
+	} else if status.leaf == nil {
+		state = "not checked yet"
+	}
+
+	fmt.Fprintf(w, "%s<body><h1>CertMon: %s</h1>\n<p><table>\n", htmlHead, html.EscapeString(domain))
+	row := func(key, value string) {
+		fmt.Fprintf(w, "<tr><th>%s</th><td>%s</td></tr>\n", key, html.EscapeString(value))
+	}
+	row("Ports", strings.Join(ports, ", "))
+	if status.target.ServerName != "" {
+		row("Server name", status.target.ServerName)
+	}
+	if status.target.CAFile != "" {
+		row("CA bundle", "configured")
+	}
+	if status.target.TrustedIntermediates != "" {
+		row("Trusted intermediates", "configured")
+	}
+	if status.target.Insecure {
+		row("Verification", "skipped (insecure)")
+	}
+	if status.target.ClientCert != "" {
+		row("Client certificate", "configured")
+	}
+	if alpn := status.target.ALPNProtocols(); len(alpn) > 0 {
+		row("ALPN", strings.Join(alpn, " "))
+	}
+	if status.protocol != "" {
+		row("Protocol", status.protocol)
+	}
+	if status.tlsVersion != "" {
+		row("Connection", "TLS "+status.tlsVersion+", "+status.cipherSuite)
+	}
+	if status.provider != "" {
+		row("Provider", status.provider)
+	}
+	row("Check", state)
+	if d := status.target.DeepScanInterval(); d > 0 && !status.deepScanned.IsZero() {
+		row("Last deep scan", formatTime(status.deepScanned, loc)+", every "+d.String())
+	}
+	var avail []string
+	for _, w := range availabilityWindows {
+		if r, ok := status.availability.ratio(time.Now(), w.duration); ok {
+			avail = append(avail, fmt.Sprintf("%.2f%% (%s)", 100*r, w.name))
+		}
+	}
+	if len(avail) > 0 {
+		row("Availability", strings.Join(avail, ", "))
+	}
+	if len(status.addresses) > 0 {
+		var addrs []string
+		for _, port := range status.target.Ports {
+			if addr, ok := status.addresses[port]; ok {
+				addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(port)))
+			}
+		}
+		row("Connected to", strings.Join(addrs, ", "))
+		if e := cm.opts.Enricher; e != nil {
+			var ips []string
+			for _, addr := range status.addresses {
+				ips = append(ips, addr)
+			}
+			if names := e.ReverseNames(ips); len(names) > 0 {
+				row("Reverse DNS", strings.Join(names, ", "))
+			}
+		}
+	}
+	if e := cm.opts.Enricher; e != nil {
+		if reg := e.Registration(domain); reg != nil {
+			row("Registered domain", reg.Domain)
+			if reg.Registrar != "" {
+				row("Registrar", reg.Registrar)
+			}
+			if !reg.Expiration.IsZero() {
+				row("Registration expires", formatTime(reg.Expiration, loc))
+			}
+		}
+	}
+	if status.target.Owner != "" {
+		row("Owner", status.target.Owner)
+	}
+	if status.target.Notes != "" {
+		row("Notes", status.target.Notes)
+	}
+	if rb := status.target.Runbook; rb != "" {
+		fmt.Fprintf(w, "<tr><th>Runbook</th><td><a href=\"%s\">%s</a></td></tr>\n",
+			html.EscapeString(rb), html.EscapeString(rb))
+	}
+	if status.leaf != nil {
+		row("Certificate expires", formatTime(status.expiration, loc))
+		row("Common name", status.leaf.Subject.CommonName)
+		row("Names", strings.Join(subjectAltNames(status.leaf), ", "))
+		row("Issuer", status.leaf.Issuer.String())
+		row("Serial number", serialNumber(status.leaf))
+		if oids := policyOIDs(status.leaf); oids != "" {
+			row("Validation", validationName(validationLevel(status.leaf))+" ("+oids+")")
+		} else {
+			row("Validation", validationName(""))
+		}
+		fmt.Fprintf(w, "<tr><th>Chain</th><td><a href=\"/domain/%s/chain.pem\">chain.pem</a> (%d certificates, %d bytes)</td></tr>\n",
+			url.PathEscape(domain), len(status.chain), chainBytes(status.chain))
+		if weak := weakSignatures(status.chain); len(weak) > 0 {
+			row("Weak signatures", strings.Join(weak, ", "))
+		}
+	}
+	if status.aheadErr != nil {
+		row("Chain in the future", status.aheadErr.Error())
+	}
+	if status.staple != nil && !status.staple.NextUpdate.IsZero() {
+		row("OCSP staple valid until", formatTime(status.staple.NextUpdate, loc))
+	}
+	if status.revoked {
+		row("Revocation", "revoked")
+	}
+	snoozed := status.snoozedUntil.After(time.Now())
+	if snoozed {
+		row("Snoozed until", formatTime(status.snoozedUntil, loc))
+	}
+	fmt.Fprintf(w, "%s", "</table></p>\n")
+	if len(status.inventory) > 0 {
+		fmt.Fprintf(w, "%s", "<h2>Certificate history</h2>\n<p><table>\n<tr><th>First seen</th><th>Valid from</th><th>Valid until</th><th>Issuer</th><th>SHA-256</th></tr>\n")
+		for i := len(status.inventory) - 1; i >= 0; i-- {
+			c := status.inventory[i]
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+				c.FirstSeen.In(loc).Format(time.RFC3339), c.NotBefore.In(loc).Format(time.RFC3339),
+				c.NotAfter.In(loc).Format(time.RFC3339), html.EscapeString(c.Issuer), c.Fingerprint)
+		}
+		fmt.Fprintf(w, "%s", "</table></p>\n")
+	}
+	if len(status.errors) > 0 {
+		fmt.Fprintf(w, "%s", "<h2>Recent errors</h2>\n<p><table>\n<tr><th>Time</th><th>Error</th></tr>\n")
+		for i := len(status.errors) - 1; i >= 0; i-- {
+			e := status.errors[i]
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td></tr>\n",
+				formatTime(e.Time, loc), html.EscapeString(e.Error))
+		}
+		fmt.Fprintf(w, "%s", "</table></p>\n")
+	}
+	if cm.opts.AdminToken != nil {
+		fmt.Fprintf(w, "%s", "<p><form method=\"post\">Snooze until <input type=\"date\" name=\"snooze_until\"/> <input type=\"password\" name=\"token\" placeholder=\"Admin token\"/> <input type=\"submit\" value=\"Snooze\"/></form></p>\n")
+		if snoozed {
+			fmt.Fprintf(w, "%s", "<p><form method=\"post\"><input type=\"hidden\" name=\"snooze_until\" value=\"\"/><input type=\"password\" name=\"token\" placeholder=\"Admin token\"/> <input type=\"submit\" value=\"Lift snooze\"/></form></p>\n")
+		}
+	}
+	writeTimeZoneForm(w, loc)
+	fmt.Fprintf(w, "%s", "<p><a href=\"/\">Back to overview</a></p></body></html>\n")
+}
+
+// Serves the certificates that a domain presented in its most recent
+// check, exactly as received, at /domain/<name>/chain.pem.
+func (cm *CertMon) handleChain(w http.ResponseWriter, r *http.Request, domain string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	status, ok := cm.domains[domain]
+	if !ok || len(status.chain) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	for _, cert := range status.chain {
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+}
+
+// Effective configuration of a target, with defaults filled in, for
+// debugging why a target behaves unexpectedly. Since it gets served
+// without a token, it only tells whether files such as a ca_file are
+// configured, not their paths.
+type TargetConfig struct {
+	Host             string            `json:"host"`
+	Ports            []int             `json:"ports"`
+	Protocol         string            `json:"protocol"`
+	ServerName       string            `json:"server_name"`
+	Resolvers        []string          `json:"resolvers,omitempty"`
+	Proxy            string            `json:"proxy,omitempty"`
+	CAFile           bool              `json:"ca_file,omitempty"`
+	Intermediates    bool              `json:"trusted_intermediates,omitempty"`
+	ClientCert       bool              `json:"client_cert,omitempty"`
+	ALPN             []string          `json:"alpn,omitempty"`
+	UserAgent        string            `json:"user_agent,omitempty"`
+	Interval         string            `json:"interval"`
+	DeepInterval     string            `json:"deep_interval,omitempty"`
+	Timeout          string            `json:"timeout"`
+	ConnectTimeout   string            `json:"connect_timeout"`
+	Attempts         int               `json:"attempts"`
+	ThresholdDays    []int             `json:"threshold_days"`
+	MinTLS           string            `json:"min_tls,omitempty"`
+	MaxTLS           string            `json:"max_tls,omitempty"`
+	ProbeTLSVersions []string          `json:"tls_versions,omitempty"`
+	Views            []string          `json:"views,omitempty"`
+	SNI              []string          `json:"sni,omitempty"`
+	AllAddresses     bool              `json:"all_addresses"`
+	Insecure         bool              `json:"insecure"`
+	DualStack        bool              `json:"dual_stack"`
+	HTTPPath         string            `json:"http_path,omitempty"`
+	HTTPStatus       int               `json:"http_status,omitempty"`
+	MinFreshDays     int               `json:"min_fresh_days,omitempty"`
+	VerifyCT         bool              `json:"verify_ct"`
+	DNSSEC           bool              `json:"dnssec"`
+	Owner            string            `json:"owner,omitempty"`
+	Notes            string            `json:"notes,omitempty"`
+	Runbook          string            `json:"runbook,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	SnoozedUntil     *time.Time        `json:"snoozed_until,omitempty"`
+}
+
+// Returns the effective configuration of a target.
+func (cm *CertMon) TargetConfig(domain string) (*TargetConfig, bool) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	status, ok := cm.domains[domain]
+	if !ok {
+		return nil, false
+	}
+	t := status.target
+	c := &TargetConfig{
+		Host:          t.Host,
+		Ports:         t.Ports,
+		Protocol:      t.Protocol,
+		ServerName:    t.ServerName,
+		Resolvers:     t.Resolvers,
+		CAFile:        t.CAFile != "",
+		Intermediates: t.TrustedIntermediates != "",
+		ClientCert:    t.ClientCert != "",
+		Interval:      t.CheckInterval().String(),
+		Timeout:       t.CheckTimeout().String(),
+		ThresholdDays: cm.opts.Thresholds,
+		Views:         t.Views,
+		SNI:           t.SNI,
+		AllAddresses:  t.AllAddresses,
+		Insecure:      t.Insecure,
+		DualStack:     t.DualStack,
+		HTTPPath:      t.HTTPPath,
+		HTTPStatus:    t.HTTPStatus,
+		MinFreshDays:  t.MinFreshDays,
+		VerifyCT:      t.VerifyCT,
+		Notes:         t.Notes,
+		Runbook:       t.Runbook,
+		Labels:        t.Labels,
+	}
+	if c.Protocol == "" {
+		c.Protocol = ProtocolTLS
+	}
+	if c.ServerName == "" {
+		c.ServerName = t.Host
+	}
+	c.ConnectTimeout = t.CheckConnectTimeout().String()
+	if d := t.DeepScanInterval(); d > 0 {
+		c.DeepInterval = d.String()
+	}
+	c.Attempts = t.CheckAttempts()
+	c.DNSSEC = t.DNSSEC
+	c.ALPN, c.UserAgent = t.ALPNProtocols(), t.HTTPUserAgent()
+	c.Owner = t.Owner
+	if proxy := t.ProxyURL(t.Ports[0]); proxy != nil {
+		c.Proxy = proxy.Redacted()
+	}
+	if t.MinTLSVersion != 0 {
+		c.MinTLS = tlsVersionName(t.MinTLSVersion)
+	}
+	if t.MaxTLSVersion != 0 {
+		c.MaxTLS = tlsVersionName(t.MaxTLSVersion)
+	}
+	for _, v := range t.ProbeTLSVersions {
+		c.ProbeTLSVersions = append(c.ProbeTLSVersions, tlsVersionName(v))
+	}
+	if until := status.snoozedUntil; until.After(time.Now()) {
+		c.SnoozedUntil = &until
+	}
+	return c, true
+}
+
+// Serves information about a target as JSON: its effective configuration
+// at /api/v1/targets/<domain>, and newest first, its recent check errors
+// at /api/v1/targets/<domain>/errors and every certificate it ever served
+// at /api/v1/targets/<domain>/certificates.
+func (cm *CertMon) HandleTargets(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/targets/")
+	domain, sub := path, ""
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		domain, sub = path[:i], path[i+1:]
+	}
+	var result interface{}
+	var ok bool
+	switch sub {
+	case "":
+		result, ok = cm.TargetConfig(domain)
+	case "errors":
+		result, ok = cm.Errors(domain)
+	case "certificates":
+		result, ok = cm.Inventory(domain)
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
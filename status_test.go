@@ -0,0 +1,32 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelativeTime(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "now"},
+		{30 * time.Second, "now"},
+		{-30 * time.Second, "now"},
+		{2*time.Minute - time.Nanosecond, "now"},
+		{2 * time.Minute, "in 2 minutes"},
+		{-2 * time.Minute, "2 minutes ago"},
+		{90*time.Minute + 59*time.Second, "in 90 minutes"},
+		{2 * time.Hour, "in 2 hours"},
+		{-47*time.Hour - 59*time.Minute, "47 hours ago"},
+		{48 * time.Hour, "in 2 days"},
+		{-90 * 24 * time.Hour, "90 days ago"},
+	} {
+		if got := relativeTime(tc.d); got != tc.want {
+			t.Errorf("relativeTime(%v) = %q, want %q", tc.d, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
+	_ "modernc.org/sqlite"
+)
+
+// Persists the events of an EventLog.
+type EventStore interface {
+	// Returns all stored events, oldest first.
+	Load() ([]Event, error)
+
+	// Appends an event.
+	Append(e Event) error
+}
+
+// Opens the event store given by a -event-log specification:
+//
+//	/var/lib/certmon/events.jsonl         file with one JSON event per line
+//	sqlite:/var/lib/certmon/events.db     embedded SQLite database
+//	bolt:/var/lib/certmon/events.bolt     embedded BoltDB database
+//	postgres://user@db.example.org/certmon  PostgreSQL database
+//
+// An empty specification returns nil, for keeping events in memory only.
+// The SQL stores keep events in a table named certmon_events, which gets
+// created if needed. Installations that share a PostgreSQL database need
+// to give each certmon its own schema, such as with search_path=<name>
+// in the connection URL.
+func OpenEventStore(spec string) (EventStore, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "sqlite:"):
+		return openSQLEventStore("sqlite", strings.TrimPrefix(spec, "sqlite:"))
+	case strings.HasPrefix(spec, "bolt:"):
+		return openBoltEventStore(strings.TrimPrefix(spec, "bolt:"))
+	case strings.HasPrefix(spec, "postgres://"), strings.HasPrefix(spec, "postgresql://"):
+		return openSQLEventStore("postgres", spec)
+	}
+	return openFileEventStore(spec)
+}
+
+// Stores events in a file, one JSON object per line.
+type fileEventStore struct {
+	path string
+	file *os.File
+}
+
+func openFileEventStore(path string) (*fileEventStore, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileEventStore{path: path, file: f}, nil
+}
+
+func (s *fileEventStore) Load() ([]Event, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+func (s *fileEventStore) Append(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Stores events in a BoltDB bucket, keyed by a big-endian sequence
+// number so that iteration returns them in the order of recording.
+type boltEventStore struct {
+	db *bolt.DB
+}
+
+var boltEventsBucket = []byte("events")
+
+func openBoltEventStore(path string) (*boltEventStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltEventsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltEventStore{db: db}, nil
+}
+
+func (s *boltEventStore) Load() ([]Event, error) {
+	var events []Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltEventsBucket).ForEach(func(k, v []byte) error {
+			var e Event
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			events = append(events, e)
+			return nil
+		})
+	})
+	return events, err
+}
+
+func (s *boltEventStore) Append(e Event) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltEventsBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], seq)
+		return bucket.Put(key[:], value)
+	})
+}
+
+// Stores events in a SQL table. Besides the event as JSON, the time,
+// type and domain get their own columns, for querying the history
+// with SQL. Events get written by a goroutine, so that a slow or
+// unreachable database does not hold up the checks that record them.
+type sqlEventStore struct {
+	db    *sql.DB
+	queue chan sqlEventRow
+	done  chan struct{}
+}
+
+type sqlEventRow struct {
+	event Event
+	data  []byte
+}
+
+// How many events may wait for getting written to a SQL store, and how
+// long writing each of them may take.
+const (
+	sqlEventQueueSize    = 1000
+	sqlEventWriteTimeout = 10 * time.Second
+)
+
+// Statements for creating the events table, by driver.
+var sqlEventTables = map[string]string{
+	"sqlite": `CREATE TABLE IF NOT EXISTS certmon_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time TIMESTAMP NOT NULL,
+		type TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		event TEXT NOT NULL)`,
+	"postgres": `CREATE TABLE IF NOT EXISTS certmon_events (
+		id BIGSERIAL PRIMARY KEY,
+		time TIMESTAMPTZ NOT NULL,
+		type TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		event JSONB NOT NULL)`,
+}
+
+func openSQLEventStore(driver, dsn string) (*sqlEventStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqlEventTables[driver]); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating table certmon_events: %w", err)
+	}
+	s := &sqlEventStore{
+		db:    db,
+		queue: make(chan sqlEventRow, sqlEventQueueSize),
+		done:  make(chan struct{}),
+	}
+	go s.write()
+	return s, nil
+}
+
+func (s *sqlEventStore) Load() ([]Event, error) {
+	rows, err := s.db.Query("SELECT event FROM certmon_events ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Queues an event for writing. If the database has fallen too far
+// behind, the event only stays in memory.
+func (s *sqlEventStore) Append(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- sqlEventRow{event: e, data: data}:
+		return nil
+	default:
+		return fmt.Errorf("event store is behind, not storing %s event", e.Type)
+	}
+}
+
+func (s *sqlEventStore) write() {
+	defer close(s.done)
+	for row := range s.queue {
+		e := row.event
+		ctx, cancel := context.WithTimeout(context.Background(), sqlEventWriteTimeout)
+		_, err := s.db.ExecContext(ctx, "INSERT INTO certmon_events (time, type, domain, event) VALUES ($1, $2, $3, $4)",
+			e.Time, e.Type, e.Domain, string(row.data))
+		cancel()
+		if err != nil {
+			log.Printf("storing %s event: %v", e.Type, err)
+		}
+	}
+}
+
+// Writes the queued events, and closes the database.
+func (s *sqlEventStore) Close() error {
+	close(s.queue)
+	<-s.done
+	return s.db.Close()
+}
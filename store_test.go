@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLEventStoreSQLite(t *testing.T) {
+	testSQLEventStore(t, "sqlite", filepath.Join(t.TempDir(), "events.db"))
+}
+
+// Needs a scratch PostgreSQL database, such as
+// CERTMON_TEST_POSTGRES=postgres://postgres@localhost/certmon_test?sslmode=disable
+func TestSQLEventStorePostgres(t *testing.T) {
+	dsn := os.Getenv("CERTMON_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("CERTMON_TEST_POSTGRES not set")
+	}
+	testSQLEventStore(t, "postgres", dsn)
+}
+
+func testSQLEventStore(t *testing.T, driver, dsn string) {
+	store, err := openSQLEventStore(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := "test-" + time.Now().Format("20060102150405.000000000") + ".example.org"
+	now := time.Now().UTC().Truncate(time.Second)
+	want := []Event{
+		{Time: now, Type: EventTargetAdded, Domain: domain},
+		{Time: now, Type: EventSnoozed, Domain: domain, Message: "snoozed until " + now.Format(time.RFC3339), SnoozedUntil: &now},
+		{Time: now, Type: EventTargetRemoved, Domain: domain},
+	}
+	for _, e := range want {
+		if err := store.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = openSQLEventStore(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	events, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Event
+	for _, e := range events {
+		if e.Domain == domain {
+			got = append(got, e)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Type != want[i].Type || got[i].Message != want[i].Message || !got[i].Time.Equal(want[i].Time) {
+			t.Errorf("event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if s := got[1].SnoozedUntil; s == nil || !s.Equal(now) {
+		t.Errorf("got snoozed_until %v, want %v", s, now)
+	}
+}
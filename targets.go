@@ -0,0 +1,619 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A monitored host, together with the ports whose certificates get
+// checked. The ports are expected to serve the same certificate.
+type Target struct {
+	Host  string
+	Ports []int
+
+	// Range of TLS versions for the main check; zero means the default
+	// of crypto/tls.
+	MinTLSVersion, MaxTLSVersion uint16
+
+	// TLS versions for which to attempt a separate handshake, exporting
+	// whether the server accepts each of them.
+	ProbeTLSVersions []uint16
+
+	// How to reach the TLS handshake, such as "tls" (the default),
+	// "smtp" for STARTTLS, or "auto" to pick by port if direct TLS fails.
+	Protocol string
+
+	// Names of DNS views in which to check the target additionally,
+	// for hosts that resolve differently on internal and external
+	// resolvers.
+	Views []string
+
+	// Path for an HTTP GET request after the handshake, such as
+	// "/healthz", and the status code it is expected to return.
+	// No request is made if the path is empty.
+	HTTPPath   string
+	HTTPStatus int
+
+	// Minimum number of days that a certificate must be valid for when
+	// it gets deployed by a renewal; zero disables the check.
+	MinFreshDays int
+
+	// Whether to verify inclusion proofs for the embedded SCTs.
+	VerifyCT bool
+
+	// Further server names to send in separate handshakes, for hosts
+	// that route connections to tenants by SNI.
+	SNI []string
+
+	// Whether to check every address that Host resolves to, rather
+	// than only the first one that accepts connections.
+	AllAddresses bool
+
+	// Whether to check the target over IPv4 and IPv6 separately.
+	DualStack bool
+
+	// Whether to export when the DNSSEC signatures over the address
+	// records of Host expire, for names in signed zones.
+	DNSSEC bool
+
+	// DNS servers for looking up Host, such as "10.0.0.53:53", for
+	// names in split-horizon zones; empty means the resolver given by
+	// -resolver, or else the system resolver.
+	Resolvers []string
+
+	// URL of the proxy for reaching the target, such as
+	// "http://proxy.example.org:3128" or "socks5://localhost:1080",
+	// or "direct" for connecting directly; empty means the proxy given
+	// by -proxy or HTTPS_PROXY.
+	Proxy string
+
+	// Server name to send in the handshake and to verify the certificate
+	// for, when connecting to Host by IP address, such as a single
+	// backend behind a load balancer. Empty means Host.
+	ServerName string
+
+	// Application protocols to offer in the handshake, such as "h2" and
+	// "http/1.1", for servers that treat clients offering none as
+	// suspicious; empty means those given by -alpn.
+	ALPN []string
+
+	// User-Agent header of the HTTP requests after the handshake;
+	// empty means the one given by -user-agent.
+	UserAgent string
+
+	// PEM files with a client certificate and its private key, for
+	// servers that reject handshakes without one. An empty ClientKey
+	// means the key is in the ClientCert file, after the certificate.
+	ClientCert, ClientKey string
+
+	// PEM file with the root certificates for verifying the chain of
+	// the target, such as the root of a private PKI, instead of the
+	// system roots or those given by -ca-file.
+	CAFile string
+
+	// PEM file with intermediate certificates to trust as anchors,
+	// like clients of private PKIs that are deliberately shipped
+	// without the root. Like CAFile, it replaces the system roots.
+	TrustedIntermediates string
+
+	// Trust anchors loaded from CAFile and TrustedIntermediates, or nil.
+	rootCAs *x509.CertPool
+
+	// Whether to accept certificates that do not verify, such as
+	// self-signed ones, so that their expiration still gets tracked.
+	// Whether they verified gets exported separately.
+	Insecure bool
+
+	// Free-text notes and a link to the renewal procedure, shown to
+	// whoever needs to act on the target.
+	Notes, Runbook string
+
+	// Team or person responsible for the target, such as "web-team".
+	Owner string
+
+	// Time between checks, the timeout for reaching the TLS handshake,
+	// and the timeout for establishing the connection within it; zero
+	// means the defaults.
+	Interval, Timeout, ConnectTimeout time.Duration
+
+	// Time between deep scans, which run the expensive parts of a
+	// check: probing TLS versions, verifying CT inclusion and fetching
+	// the HSTS policy. Zero means the default.
+	DeepInterval time.Duration
+
+	// How often to attempt the handshake before the check fails, with
+	// exponential backoff in between; zero means the default.
+	Attempts int
+
+	// Labels for certmon_target_info, such as team="web", for joining
+	// certmon metrics with the owners of targets. Only settable in
+	// the -config file.
+	Labels map[string]string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if v, ok := tlsVersions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// Returns the name of a TLS version, such as "1.2".
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+const defaultCheckInterval = 10 * time.Second
+
+// Returns the time between checks of the target.
+func (t *Target) CheckInterval() time.Duration {
+	if t.Interval > 0 {
+		return t.Interval
+	}
+	return defaultCheckInterval
+}
+
+// Default time between deep scans, set by -deep-interval; zero means
+// that every check is a deep scan.
+var defaultDeepInterval time.Duration
+
+// Returns the time between deep scans of the target.
+func (t *Target) DeepScanInterval() time.Duration {
+	if t.DeepInterval > 0 {
+		return t.DeepInterval
+	}
+	return defaultDeepInterval
+}
+
+// Default timeout for reaching the TLS handshake, set by -timeout.
+var defaultCheckTimeout = 30 * time.Second
+
+// Default timeout for establishing connections, set by -connect-timeout;
+// zero means the timeout for reaching the handshake.
+var defaultConnectTimeout time.Duration
+
+// Default application protocols and User-Agent, set by -alpn and
+// -user-agent.
+var defaultALPN []string
+var defaultUserAgent string
+
+// Returns the application protocols to offer in the handshake.
+func (t *Target) ALPNProtocols() []string {
+	if len(t.ALPN) > 0 {
+		return t.ALPN
+	}
+	return defaultALPN
+}
+
+// Returns the User-Agent header for HTTP requests to the target, or an
+// empty string for the default of the Go HTTP client.
+func (t *Target) HTTPUserAgent() string {
+	if t.UserAgent != "" {
+		return t.UserAgent
+	}
+	return defaultUserAgent
+}
+
+// Returns the timeout for reaching the TLS handshake with the target.
+func (t *Target) CheckTimeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return defaultCheckTimeout
+}
+
+// Returns the timeout for establishing the connection to the target,
+// or to its proxy. It is never longer than the check timeout.
+func (t *Target) CheckConnectTimeout() time.Duration {
+	d := t.ConnectTimeout
+	if d <= 0 {
+		d = defaultConnectTimeout
+	}
+	if timeout := t.CheckTimeout(); d <= 0 || d > timeout {
+		return timeout
+	}
+	return d
+}
+
+// Returns the resolver for looking up the target.
+func (t *Target) DNSResolver() *net.Resolver {
+	if len(t.Resolvers) == 0 {
+		return net.DefaultResolver
+	}
+	return NewResolver(t.Resolvers)
+}
+
+// Returns the proxy for reaching the target on port, or nil for
+// connecting directly.
+func (t *Target) ProxyURL(port int) *url.URL {
+	switch t.Proxy {
+	case "":
+		return proxyFor(t.Host, port)
+	case "direct":
+		return nil
+	}
+	// Checked when parsing the options.
+	proxy, _ := parseProxy(t.Proxy)
+	return proxy
+}
+
+// Checks the certificate of the target on one of its ports.
+func (t *Target) checkPort(port int, config *tls.Config) (*CheckResult, error) {
+	return checkCertificateAt(t.DNSResolver(), t.ProxyURL(port), t.Host, t.Host, port, t.Protocol, config, t.CheckConnectTimeout(), t.CheckTimeout())
+}
+
+// Returns the TLS configuration for checking the target.
+func (t *Target) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		RootCAs:            t.RootCAs(),
+		ServerName:         t.ServerName,
+		MinVersion:         t.MinTLSVersion,
+		MaxVersion:         t.MaxTLSVersion,
+		InsecureSkipVerify: t.Insecure,
+		NextProtos:         t.ALPNProtocols(),
+	}
+	if t.ClientCert != "" {
+		certFile, keyFile := t.ClientCert, t.ClientKey
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		// Read the files for every handshake, since credentials get
+		// rotated on disk.
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loadClientCertificate(certFile, keyFile)
+		}
+	}
+	return config
+}
+
+// Returns the roots for verifying the chain of the target, or nil for
+// the system roots.
+func (t *Target) RootCAs() *x509.CertPool {
+	if t.rootCAs != nil {
+		return t.rootCAs
+	}
+	return defaultRootCAs
+}
+
+// Parses a target specification, such as "example.org",
+// "smtp://mail.example.org:587" or "example.org:443/8443?min_tls=1.2",
+// into a Target. The specification has an optional scheme, a host, its
+// optional ports, and options in URL query syntax; README.md lists the
+// options. Files named by options, such as ca_file, get read already.
+func ParseTarget(s string) (Target, error) {
+	s = strings.TrimSpace(s)
+	scheme := ""
+	defaultPort := 443
+	if i := strings.Index(s, "://"); i >= 0 {
+		scheme, s = s[:i], s[i+3:]
+		if port, ok := implicitTLSPorts[scheme]; ok {
+			scheme, defaultPort = ProtocolTLS, port
+		} else if _, err := parseProtocol(scheme); err != nil || scheme == ProtocolAuto {
+			return Target{}, fmt.Errorf("unknown scheme %q", scheme)
+		} else if port, ok := defaultPorts[scheme]; ok {
+			defaultPort = port
+		}
+	}
+	options := ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		s, options = s[:i], s[i+1:]
+	}
+	s = strings.TrimSuffix(s, "/")
+	host, ports, err := splitHostPorts(s)
+	if err != nil {
+		return Target{}, err
+	}
+	if host == "" {
+		return Target{}, fmt.Errorf("missing host in %q", s)
+	}
+	if !utf8.ValidString(host) {
+		return Target{}, fmt.Errorf("host in %q is not valid UTF-8", s)
+	}
+
+	t := Target{Host: host}
+	if scheme != "" && scheme != ProtocolTLS {
+		t.Protocol = scheme
+	}
+	if ports == "" {
+		t.Ports = []int{defaultPort}
+	} else {
+		for _, p := range strings.Split(ports, "/") {
+			port, err := strconv.Atoi(p)
+			if err != nil || port <= 0 || port > 65535 {
+				return Target{}, fmt.Errorf("bad port %q in %q", p, s)
+			}
+			t.Ports = append(t.Ports, port)
+		}
+	}
+
+	if err := t.parseOptions(options); err != nil {
+		return Target{}, fmt.Errorf("%s: %v", s, err)
+	}
+	return t, nil
+}
+
+// Splits a target into its host and its slash-separated ports, which
+// are empty if the target has none. IPv6 addresses need brackets for
+// giving ports, as in "[2001:db8::1]:443"; without brackets, they are
+// taken as a host without ports.
+func splitHostPorts(s string) (host, ports string, err error) {
+	switch {
+	case strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]"):
+		return s[1 : len(s)-1], "", nil
+	case strings.HasPrefix(s, "["):
+		return net.SplitHostPort(s)
+	case strings.Count(s, ":") > 1:
+		return s, "", nil
+	}
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		return s[:i], s[i+1:], nil
+	}
+	return s, "", nil
+}
+
+func (t *Target) parseOptions(options string) error {
+	values, err := url.ParseQuery(options)
+	if err != nil {
+		return err
+	}
+	for key, vals := range values {
+		value := vals[len(vals)-1]
+
+		// Many options end up in metric labels, such as sni or owner,
+		// and Prometheus rejects label values that are not UTF-8.
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("value for %s is not valid UTF-8", key)
+		}
+		switch key {
+		case "min_tls":
+			if t.MinTLSVersion, err = parseTLSVersion(value); err != nil {
+				return err
+			}
+		case "max_tls":
+			if t.MaxTLSVersion, err = parseTLSVersion(value); err != nil {
+				return err
+			}
+		case "tls_versions":
+			t.ProbeTLSVersions = nil
+			for _, name := range strings.Split(value, "/") {
+				v, err := parseTLSVersion(name)
+				if err != nil {
+					return err
+				}
+				t.ProbeTLSVersions = append(t.ProbeTLSVersions, v)
+			}
+		case "protocol":
+			if t.Protocol, err = parseProtocol(value); err != nil {
+				return err
+			}
+		case "views":
+			t.Views = strings.Split(value, "/")
+		case "sni":
+			t.SNI = strings.Split(value, "/")
+		case "alpn":
+			// Protocol names can contain slashes, as in "http/1.1",
+			// so they are separated by spaces.
+			t.ALPN = strings.Fields(value)
+		case "user_agent":
+			t.UserAgent = value
+		case "resolver":
+			if t.Resolvers, err = ParseDNSServers(value, "/"); err != nil {
+				return err
+			}
+		case "proxy":
+			if value != "direct" {
+				if _, err := parseProxy(value); err != nil {
+					return err
+				}
+			}
+			t.Proxy = value
+		case "servername":
+			if value == "" || net.ParseIP(value) != nil {
+				return fmt.Errorf("bad server name %q", value)
+			}
+			t.ServerName = value
+		case "client_cert", "client_key":
+			if value == "" {
+				return fmt.Errorf("empty value for %s", key)
+			}
+			if key == "client_cert" {
+				t.ClientCert = value
+			} else {
+				t.ClientKey = value
+			}
+		case "ca_file", "trusted_intermediates":
+			if value == "" {
+				return fmt.Errorf("empty value for %s", key)
+			}
+			if key == "ca_file" {
+				t.CAFile = value
+			} else {
+				t.TrustedIntermediates = value
+			}
+		case "http_path":
+			if !strings.HasPrefix(value, "/") {
+				return fmt.Errorf("bad HTTP path %q", value)
+			}
+			t.HTTPPath = value
+			if t.HTTPStatus == 0 {
+				t.HTTPStatus = http.StatusOK
+			}
+		case "http_status":
+			code, err := strconv.Atoi(value)
+			if err != nil || code < 100 || code > 599 {
+				return fmt.Errorf("bad HTTP status %q", value)
+			}
+			t.HTTPStatus = code
+		case "min_fresh_days":
+			days, err := strconv.Atoi(value)
+			if err != nil || days < 0 {
+				return fmt.Errorf("bad value for min_fresh_days: %q", value)
+			}
+			t.MinFreshDays = days
+		case "verify_ct":
+			if t.VerifyCT, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("bad value for verify_ct: %q", value)
+			}
+		case "dnssec":
+			if t.DNSSEC, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("bad value for dnssec: %q", value)
+			}
+		case "all_addresses":
+			if t.AllAddresses, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("bad value for all_addresses: %q", value)
+			}
+		case "insecure":
+			if t.Insecure, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("bad value for insecure: %q", value)
+			}
+		case "dual_stack":
+			if t.DualStack, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("bad value for dual_stack: %q", value)
+			}
+		case "interval", "deep_interval", "timeout", "connect_timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("bad value for %s: %q", key, value)
+			}
+			switch key {
+			case "interval":
+				t.Interval = d
+			case "deep_interval":
+				t.DeepInterval = d
+			case "timeout":
+				t.Timeout = d
+			default:
+				t.ConnectTimeout = d
+			}
+		case "attempts":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("bad value for attempts: %q", value)
+			}
+			t.Attempts = n
+		case "notes":
+			t.Notes = value
+		case "owner":
+			t.Owner = value
+		case "runbook":
+			u, err := url.Parse(value)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("bad runbook URL %q", value)
+			}
+			t.Runbook = value
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if t.ClientKey != "" && t.ClientCert == "" {
+		return fmt.Errorf("client_key without client_cert")
+	}
+	return t.loadTrustAnchors()
+}
+
+// Loads the certificates given by CAFile and TrustedIntermediates into
+// a pool of trust anchors, which replaces the system roots.
+func (t *Target) loadTrustAnchors() error {
+	t.rootCAs = nil
+	if t.CAFile == "" && t.TrustedIntermediates == "" {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	for _, path := range []string{t.CAFile, t.TrustedIntermediates} {
+		if path == "" {
+			continue
+		}
+		store, err := LoadRootStore(path)
+		if err != nil {
+			return err
+		}
+		for _, cert := range store.Certs {
+			pool.AddCert(cert)
+		}
+	}
+	t.rootCAs = pool
+	return nil
+}
+
+// Parses a comma-separated list of target specifications. Entries for
+// the same host get merged into one target with the ports of all of
+// them, as in "example.org:443,example.org:8443". Such entries must have
+// the same scheme and options; otherwise, it would be unclear which
+// ones apply.
+func ParseTargets(s string) ([]Target, error) {
+	var targets []Target
+	index := make(map[string]int)
+	for _, spec := range strings.Split(s, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		t, err := ParseTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[t.Host]
+		if !ok {
+			index[t.Host] = len(targets)
+			targets = append(targets, t)
+			continue
+		}
+		if !sameOptions(targets[i], t) {
+			return nil, fmt.Errorf("%s: options differ from an earlier entry for %s", strings.TrimSpace(spec), t.Host)
+		}
+		for _, port := range t.Ports {
+			if !containsPort(targets[i].Ports, port) {
+				targets[i].Ports = append(targets[i].Ports, port)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// Tells whether two targets are the same apart from their ports.
+func sameOptions(a, b Target) bool {
+	a.Ports, b.Ports = nil, nil
+	a.rootCAs, b.rootCAs = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTLSVersion(versions []uint16, v uint16) bool {
+	for _, version := range versions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTargetsMergesPorts(t *testing.T) {
+	targets, err := ParseTargets("example.org:443?min_tls=1.2, example.org:8443?min_tls=1.2, example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("got %d targets, want 2", len(targets))
+	}
+	if got, want := targets[0].Ports, []int{443, 8443}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got ports %v, want %v", got, want)
+	}
+	if got := targets[0].MinTLSVersion; got == 0 {
+		t.Errorf("lost min_tls when merging")
+	}
+}
+
+func TestParseTargetsRejectsConflictingOptions(t *testing.T) {
+	for _, s := range []string{
+		"example.org:443?min_tls=1.2,example.org:8443",
+		"example.org:443,example.org:8443?owner=web",
+		"example.org:443?owner=web,example.org:8443?owner=ops",
+		"smtp://mail.example.org:587,mail.example.org:465",
+	} {
+		if _, err := ParseTargets(s); err == nil {
+			t.Errorf("ParseTargets(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestParseTargetHostAndPorts(t *testing.T) {
+	for _, tc := range []struct {
+		spec  string
+		host  string
+		ports []int
+	}{
+		{"example.org", "example.org", []int{443}},
+		{"example.org:8443", "example.org", []int{8443}},
+		{"example.org:443/8443", "example.org", []int{443, 8443}},
+		{"smtp://mail.example.org", "mail.example.org", []int{25}},
+		{"10.0.0.5:443?servername=www.example.org", "10.0.0.5", []int{443}},
+		{"[2001:db8::1]:8443", "2001:db8::1", []int{8443}},
+		{"[2001:db8::1]:443/8443", "2001:db8::1", []int{443, 8443}},
+		{"[2001:db8::1]", "2001:db8::1", []int{443}},
+		{"2001:db8::1", "2001:db8::1", []int{443}},
+		{"::1", "::1", []int{443}},
+		{"smtp://[2001:db8::25]", "2001:db8::25", []int{25}},
+	} {
+		target, err := ParseTarget(tc.spec)
+		if err != nil {
+			t.Errorf("ParseTarget(%q) failed: %v", tc.spec, err)
+			continue
+		}
+		if target.Host != tc.host || !reflect.DeepEqual(target.Ports, tc.ports) {
+			t.Errorf("ParseTarget(%q) = %s %v, want %s %v", tc.spec, target.Host, target.Ports, tc.host, tc.ports)
+		}
+	}
+}
+
+func TestParseTargetRejectsBadHostAndPorts(t *testing.T) {
+	for _, spec := range []string{
+		":443",
+		"example.org:0",
+		"example.org:https",
+		"[2001:db8::1",
+		"[2001:db8::1]443",
+		"[2001:db8::1]:99999",
+	} {
+		if _, err := ParseTarget(spec); err == nil {
+			t.Errorf("ParseTarget(%q) succeeded, want error", spec)
+		}
+	}
+}
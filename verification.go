@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var tlsVerificationOK = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "tls_verification_ok",
+		Help:      "Whether the served chain verified against the trusted roots and is valid for the domain name (1) or not (0), by domain name. Absent until a certificate was obtained.",
+	},
+	[]string{
+		"domain",
+	},
+)
+
+var checkErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Subsystem: "certmon",
+		Name:      "check_errors_total",
+		Help:      "Number of failed checks, by domain name and reason: dns, connect, timeout, handshake or verify. Alerting on these tells connectivity problems apart from certificate problems.",
+	},
+	[]string{
+		"domain",
+		"reason",
+	},
+)
+
+// Reasons for failed checks, as exported in certmon_check_errors_total.
+var checkErrorReasons = []string{"dns", "connect", "timeout", "handshake", "verify"}
+
+// Classifies why a check failed, into one of checkErrorReasons.
+func checkErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case isVerificationError(err):
+		return "verify"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	}
+	return "handshake"
+}
+
+// Tells whether err means that a server presented a certificate, but
+// it did not pass verification.
+func isVerificationError(err error) bool {
+	var authErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var hostErr x509.HostnameError
+	return errors.As(err, &authErr) || errors.As(err, &invalidErr) || errors.As(err, &hostErr)
+}
+
+// Verifies a chain like the TLS handshake does, for targets whose
+// handshake skips verification.
+func (t *Target) verify(chain []*x509.Certificate) ([][]*x509.Certificate, error) {
+	name := t.ServerName
+	if name == "" {
+		name = t.Host
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	return chain[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         t.RootCAs(),
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+	})
+}
@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2021 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var viewCheckSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "view_check_success",
+		Help:      "Whether the most recent check at the address returned by a DNS view succeeded (1) or failed (0), by domain name and view.",
+	},
+	[]string{
+		"domain",
+		"view",
+	},
+)
+
+var viewCertExpiration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Subsystem: "certmon",
+		Name:      "view_tls_certificate_expiration_timestamp",
+		Help:      "TLS certificate expiration dates at the address returned by a DNS view, in seconds since 1970-01-01 midnight UTC, by domain name and view.",
+	},
+	[]string{
+		"domain",
+		"view",
+	},
+)
+
+// A view of split-horizon DNS, given by the resolver that serves it.
+// Like for any lookup, entries in /etc/hosts take precedence.
+type DNSView struct {
+	Name     string
+	Server   string
+	resolver *net.Resolver
+}
+
+// Checks that all views used by targets are defined.
+func checkViews(targets []Target, views map[string]*DNSView) error {
+	for _, t := range targets {
+		for _, v := range t.Views {
+			if views[v] == nil {
+				return fmt.Errorf("%s uses view %s, which is not in -dns-views", t.Host, v)
+			}
+		}
+	}
+	return nil
+}
+
+// Parses a comma-separated list of DNS views, such as
+// "internal=10.0.0.53,external=8.8.8.8:53". Port 53 is the default.
+func ParseDNSViews(spec string) (map[string]*DNSView, error) {
+	views := make(map[string]*DNSView)
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad view %q, expected name=resolver", entry)
+		}
+		views[parts[0]] = NewDNSView(parts[0], withDNSPort(parts[1]))
+	}
+	return views, nil
+}
+
+func NewDNSView(name, server string) *DNSView {
+	return &DNSView{
+		Name:     name,
+		Server:   server,
+		resolver: NewResolver([]string{server}),
+	}
+}
+
+// Adds the DNS port 53 to a server address that has no port.
+func withDNSPort(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+// Parses a list of DNS servers separated by sep, such as
+// "10.0.0.53,10.0.0.54:5353". Port 53 is the default.
+func ParseDNSServers(spec, sep string) ([]string, error) {
+	var servers []string
+	for _, s := range strings.Split(spec, sep) {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(withDNSPort(s))
+		if err != nil || net.ParseIP(strings.Trim(host, "[]")) == nil {
+			return nil, fmt.Errorf("bad DNS server %q", s)
+		}
+		servers = append(servers, withDNSPort(s))
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS servers in %q", spec)
+	}
+	return servers, nil
+}
+
+// Creates a resolver that sends its queries to the given DNS servers
+// instead of those in /etc/resolv.conf, taking turns so that retries
+// go to the next server. Like for any lookup, entries in /etc/hosts
+// take precedence.
+func NewResolver(servers []string) *net.Resolver {
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Checks the certificate of a target on its first port, at the first
+// address that the resolver of the view returns for it, and exports
+// the result labeled by view.
+func (v *DNSView) Check(domain string, target Target) {
+	countLookup()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	addrs, err := v.resolver.LookupHost(ctx, target.Host)
+	cancel()
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", target.Host)
+	}
+	var result *CheckResult
+	if err == nil {
+		result, err = checkCertificateAt(v.resolver, target.ProxyURL(target.Ports[0]), target.Host, addrs[0], target.Ports[0], target.Protocol, target.TLSConfig(), target.CheckConnectTimeout(), target.CheckTimeout())
+	}
+	viewCheckSuccess.WithLabelValues(domain, v.Name).Set(boolToFloat(err == nil))
+	if err != nil {
+		return
+	}
+	viewCertExpiration.WithLabelValues(domain, v.Name).Set(float64(result.Expiration.Unix()))
+}